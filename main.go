@@ -2,35 +2,656 @@ package main
 
 import (
 	"./utils"
+	"context"
+	"flag"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
 // BuildRev var is set from the command line and used in ShowBanner function to indicate build revision.
 var BuildRev string
 
+// vmsURL is the default page with VM catalog. It could be overridden with -source-url flag or GETIE_SOURCE_URL env var.
 const vmsURL = "https://dev.windows.com/en-us/microsoft-edge/tools/vms/windows/"
 
+// defaultSourceURL function returns VM catalog URL from GETIE_SOURCE_URL env var or vmsURL if it isn't set.
+func defaultSourceURL() string {
+	if sourceURL := os.Getenv("GETIE_SOURCE_URL"); sourceURL != "" {
+		return sourceURL
+	}
+	return vmsURL
+}
+
+// exitOnError function shows a friendly message and exits if an error happened.
+func exitOnError(msg string, err error) {
+	if err != nil {
+		utils.Log.Errorf("%s: %s", msg, err)
+		os.Exit(1)
+	}
+}
+
+// stringList type defines a flag which could be repeated, each value is appended to the list.
+// Default values, e.g. from the config, are replaced by the first flag value.
+type stringList struct {
+	values []string
+	set    bool
+}
+
+func (sl *stringList) String() string {
+	return strings.Join(sl.values, ", ")
+}
+
+func (sl *stringList) Set(value string) error {
+	if !sl.set {
+		sl.values, sl.set = nil, true
+	}
+	sl.values = append(sl.values, value)
+	return nil
+}
+
+// subcommands var defines usage of available subcommands. The interactive mode is used if no subcommand is given.
+var subcommands = map[string]string{
+	"download": "download [flags] [spec]  Download VM archive without installing it, e.g. download 'Linux/VirtualBox/IE11 Win7'.",
+	"install":  "install [flags] <file>   Unzip and install an already downloaded VM archive.",
+	"verify":   "verify [flags] <file>    Verify checksum of a local VM archive.",
+	"list":     "list [flags]             Print all available VMs to stdout.",
+}
+
+// usage function shows available subcommands and flags.
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [subcommand] [flags] [argument]\n\nSubcommands:\n", os.Args[0])
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", subcommands[name])
+	}
+	fmt.Fprintln(os.Stderr, "\nWithout a subcommand VM is downloaded and installed interactively.\n\nFlags:")
+	flag.PrintDefaults()
+}
+
+// parseArgs function parses a subcommand, flags and a single positional argument. Flags could be given before
+// and after the argument.
+func parseArgs() (string, string) {
+	command := ""
+	args := os.Args[1:]
+	if len(args) > 0 {
+		if _, ok := subcommands[args[0]]; ok {
+			command, args = args[0], args[1:]
+		}
+	}
+	flag.CommandLine.Parse(args)
+	argument := ""
+	if flag.NArg() > 0 {
+		argument = flag.Arg(0)
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+	if flag.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments: %s\n", strings.Join(flag.Args(), " "))
+		usage()
+		os.Exit(2)
+	}
+	if argument != "" && (command == "" || command == "list") {
+		fmt.Fprintf(os.Stderr, "Unexpected argument: %s\n", argument)
+		usage()
+		os.Exit(2)
+	}
+	if argument == "" && (command == "install" || command == "verify") {
+		fmt.Fprintf(os.Stderr, "Subcommand %s requires a file argument.\n", command)
+		usage()
+		os.Exit(2)
+	}
+	return command, argument
+}
+
+// runVM function runs steps defined by options for a selected VM, reports outcomes and exits with non-zero code
+// if a step failed.
+func runVM(userChoice utils.UserChoice, opts utils.Options, showSummary bool, output string) {
+	ctx, stop := interruptContext()
+	opts.Context = ctx
+	summary, err := utils.Run(userChoice, opts)
+	stop()
+	if err != nil {
+		switch {
+		case summary.VMPath != "":
+			utils.Log.Errorf("Install failed: %s", err)
+		case summary.ArchivePath == "":
+			utils.Log.Errorf("Download failed: %s", err)
+		default:
+			utils.Log.Errorf("Unzip failed: %s", err)
+		}
+	}
+	if showSummary {
+		utils.ShowSummary(summary)
+	}
+	if output == "json" {
+		exitOnError("Can't write JSON summary", utils.WriteSummaryJSON(summary, os.Stdout))
+	}
+	if summary.Err != nil {
+		os.Exit(1)
+	}
+}
+
+// runVMs function runs steps defined by options for several selected VMs one by one, reports outcomes of each
+// of them and exits with non-zero code if any VM failed.
+func runVMs(userChoices []utils.UserChoice, opts utils.Options, output string) {
+	ctx, stop := interruptContext()
+	opts.Context = ctx
+	summaries := utils.RunAll(userChoices, opts)
+	stop()
+	succeeded := utils.ShowSummaries(summaries)
+	if output == "json" {
+		exitOnError("Can't write JSON summary", utils.WriteSummariesJSON(summaries, os.Stdout))
+	}
+	if !succeeded {
+		os.Exit(1)
+	}
+}
+
+// interruptContext function returns a context which is cancelled on SIGINT, so a download could be stopped
+// gracefully and its incomplete file removed. The returned stop function restores default SIGINT handling.
+func interruptContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			utils.Log.Warn("Interrupted. Stopping..")
+			// NOTE: the default handling is restored so a second CTRL-C kills the tool immediately.
+			signal.Stop(interrupt)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(interrupt)
+		cancel()
+	}
+}
+
 func main() {
+	// NOTE: config is loaded before flags are defined because its values are used as flag defaults.
+	config, configErr := utils.LoadConfig(utils.ConfigPath())
+	if config.LogLevel == "" {
+		config.LogLevel = "info"
+	}
+	if config.Proxy == "" {
+		config.Proxy = os.Getenv("GETIE_PROXY")
+	}
+
+	platform := flag.String("platform", "", "Platform to use instead of the detected one, e.g. Linux, Mac or Windows.")
+	selectDefaultsOnly := flag.Bool("select-defaults-only", false, "Show options selected by default for this machine, or for -platform if it is set, and exit.")
+	bufferSize := flag.Int("buffer-size", utils.CopyBufferSize, "Buffer size in bytes used to copy downloaded and unpacked data.")
+	crossCheckMd5 := flag.Bool("cross-check-md5", false, "Verify that inline and remote MD5 sums provided by the catalog match.")
+	toStdout := flag.Bool("stdout", false, "Write downloaded VM archive to stdout. Unzip and install steps are skipped.")
+	batch := flag.Bool("batch", false, "Download all VMs available for -platform without installing them. Use -platform all for all platforms.")
+	batchJobs := flag.Int("batch-jobs", 2, "Number of concurrent downloads in batch mode.")
+	archiveFormat := flag.String("archive-format", "", "Force VM archive format instead of detecting it, e.g. zip.")
+	uniqueRun := flag.Bool("unique", false, "Unzip VM into a per-run unique folder and import it under a unique name, so concurrent installs "+
+		"of the same VM don't collide.")
+	showSummary := flag.Bool("summary", false, "Show a short report about what was done at the end.")
+	installer := flag.String("installer", "", "External command used instead of built-in hypervisor import. "+
+		"Placeholders {path}, {hypervisor} and {name} are replaced with unpacked VM details.")
+	hypervisor := flag.String("hypervisor", "", "Hypervisor to use, e.g. VirtualBox.")
+	browser := flag.String("browser", "", "Browser and OS to use, e.g. 'IE11 Win7'. A unique part of it, aliases like 'edge' "+
+		"and regular expressions are accepted too, e.g. 'edge win10'.")
+	downloadPath := flag.String("download-path", "", "Folder to download VM archive into.")
+	assumeYes := flag.Bool("yes", false, "Answer yes to all confirmations.")
+	nonInteractive := flag.Bool("non-interactive", false, "Don't prompt at all. Default options are used for missing flags. Implies -yes.")
+	timeout := flag.Duration("timeout", utils.Timeout, "How long a connection could stall before a request fails, 0 means no timeout.")
+	retries := flag.Int("retries", utils.MaxRetries, "How many times a failed request is retried.")
+	proxy := flag.String("proxy", config.Proxy, "Proxy server URL for all requests. GETIE_PROXY env var or HTTP_PROXY/HTTPS_PROXY are used if not set.")
+	offline := flag.Bool("offline", false, "Use only locally cached VM catalog.")
+	logLevel := flag.String("log-level", config.LogLevel, "Messages level to show: debug, info, warn or error.")
+	connections := flag.Int("connections", utils.Connections, "Number of concurrent connections used to download VM archive.")
+	dryRun := flag.Bool("dry-run", false, "Show what would be downloaded and installed and exit without doing anything.")
+	sourceURL := flag.String("source-url", defaultSourceURL(), "Page with VM catalog, e.g. current Microsoft VMs page or a mirror. GETIE_SOURCE_URL env var is used if set.")
+	list := flag.Bool("list", false, "Print all available VMs to stdout and exit.")
+	listFormat := flag.String("list-format", "json", "Format of -list output: json or tsv.")
+	vmSpec := flag.String("spec", "", "VM to use as a single platform/hypervisor/browser string, e.g. 'Linux/VirtualBox/MSEdge Win10'.")
+	maxRate := flag.String("max-rate", "0", "Maximum download speed per VM archive, e.g. 500K or 2M bytes per second. 0 means unlimited.")
+	deleteArchive := flag.Bool("delete-archive", false, "Delete VM archive after it is successfully unzipped and installed.")
+	minimalExtract := flag.Bool("minimal-extract", false, "Unzip only files required to import VM into the selected hypervisor.")
+	output := flag.String("output", "text", "Output mode: text or json. json writes a summary object to stdout, "+
+		"all other messages go to stderr and prompts are skipped like with -non-interactive.")
+	proxmoxStorage := flag.String("proxmox-storage", utils.ProxmoxStorage, "Proxmox storage for imported VM disks.")
+	xenConfigPath := flag.String("xen-config-path", utils.XenConfigPath, "Folder for Xen domain configs of imported VMs.")
+	vmName := flag.String("vm-name", "", "Name of the imported VM. It is derived from browser, OS and hypervisor if not set, e.g. MSEdge-Win10-VBox.")
+	force := flag.Bool("force", false, "Delete existing VM archives and download them again.")
+	showNotes := flag.Bool("show-notes", false, "Show release notes of VM catalog, including VM expiration details, and exit.")
+	verifyPath := flag.String("verify", "", "Verify checksum of a local VM archive and exit. The VM is found by the file name or -spec.")
+	mirrors := stringList{values: config.Mirrors}
+	flag.Var(&mirrors, "mirror", "Base URL of a mirror to download VM archives from, the original host is used if all mirrors fail. "+
+		"Could be repeated, mirrors are tried in order.")
+	cleanupExpired := flag.Bool("cleanup-expired", false, fmt.Sprintf("Offer to remove VMs imported by this tool more than %d days ago "+
+		"and exit.", utils.VMLifetimeDays))
+	noColor := flag.Bool("no-color", utils.NoColor, "Don't color output. NO_COLOR env var disables colors too.")
+	promptTimeout := flag.Duration("prompt-timeout", 0, "How long prompts wait for an answer before the default one is used, "+
+		"e.g. 30s. 0 means waiting forever.")
+	listHypervisors := flag.Bool("list-hypervisors", false, "Show which hypervisors are installed on this machine and exit.")
+	vmGroup := flag.String("group", "", "VirtualBox group to import VM into, e.g. /IE-VMs. Other hypervisors don't support groups.")
+	multiSelect := flag.Bool("multi", false, "Select several browser and OS options and install them one by one. "+
+		"-browser accepts comma separated options then.")
+	installFrom := flag.String("install-from", "", "Folder with an already unzipped VM to install, download and unzip steps "+
+		"are skipped. VM file is found by -hypervisor.")
+	insecure := flag.Bool("insecure", false, "Allow to download VM catalog over plain HTTP.")
+	catalogSha256 := flag.String("catalog-sha256", "", "Known-good SHA256 sum of VM catalog JSON, the catalog is rejected if it differs.")
+	trace := flag.Bool("trace", false, "Log DNS, connect, TLS handshake and first byte timings and response headers of every request. "+
+		"Implies -log-level debug.")
+	vmCPUs := flag.Int("cpus", 0, "Number of virtual CPUs set for the imported VM. 0 keeps the VM archive default.")
+	vmMemory := flag.Int("memory", 0, "Memory in megabytes set for the imported VM, e.g. 4096. 0 keeps the VM archive default.")
+	history := flag.Bool("history", false, "Show all VMs downloaded and installed by this tool and exit.")
+	userAgent := flag.String("user-agent", utils.ToolUserAgent(BuildRev), "User-Agent header sent with all requests. "+
+		"Set a browser one if a server rejects the default.")
+	var headers stringList
+	flag.Var(&headers, "header", "Extra header sent with all requests in 'Name: value' form, e.g. 'X-Proxy-Token: 123'. Could be repeated.")
+	quiet := flag.Bool("quiet", false, "Show only errors. Banner, progress, prompts and other messages are suppressed. Implies -non-interactive.")
+	convertDisks := flag.Bool("convert", false, "Convert a disk of a VM unzipped for another hypervisor if there is no VM file "+
+		"of the selected one, e.g. to install VMware VM into VirtualBox with -install-from. Requires qemu-img or vboxmanage.")
+	lockTimeout := flag.Duration("lock-timeout", utils.LockTimeout, "How long to wait for another import into the same hypervisor "+
+		"to finish, 0 means waiting forever.")
+	expectedMd5 := flag.String("expected-md5", "", "MD5 sum of the selected VM archive or a path to a file with it. "+
+		"The sum isn't fetched from the catalog then.")
+	flag.Usage = usage
+	command, argument := parseArgs()
+	switch command {
+	case "list":
+		*list = true
+	case "verify":
+		*verifyPath = argument
+	case "download":
+		if argument != "" {
+			*vmSpec = argument
+		}
+	}
+	if *downloadPath != "" {
+		*downloadPath = utils.ExpandPath(*downloadPath)
+	}
+
+	utils.NoColor = *noColor
+	level, err := utils.ParseLogLevel(*logLevel)
+	exitOnError("Invalid log level", err)
+	utils.Log.Level = level
+	if *trace {
+		utils.Trace = true
+		utils.Log.Level = utils.LevelDebug
+	}
+	if configErr != nil {
+		utils.Log.Warnf("Can't load config %s: %s", utils.ConfigPath(), configErr)
+	}
+
+	if *list && !utils.ListFormats.Contains(*listFormat) {
+		utils.Log.Errorf("List format %s isn't supported. Available formats: %v", *listFormat, utils.ListFormats)
+		os.Exit(1)
+	}
+	if *output != "text" && *output != "json" {
+		utils.Log.Errorf("Output mode %s isn't supported. Available modes: text, json", *output)
+		os.Exit(1)
+	}
+	if *output == "json" || *quiet {
+		*nonInteractive = true
+	}
+	if *toStdout || *list || *output == "json" {
+		// Stdout is reserved for VM archive data, VM list or JSON summary so all messages go to stderr.
+		utils.Console = os.Stderr
+	}
+	if *quiet {
+		// NOTE: errors are still written to stderr, results like JSON summary are written to stdout directly.
+		utils.Console = ioutil.Discard
+		utils.Log.Level = utils.LevelError
+	}
+
+	if *bufferSize <= 0 {
+		utils.Log.Error("Buffer size must be positive.")
+		os.Exit(1)
+	}
+	utils.CopyBufferSize = *bufferSize
+	utils.CrossCheckMd5 = *crossCheckMd5
+	if *expectedMd5 != "" {
+		if *batch || strings.EqualFold(*platform, "all") {
+			utils.Log.Error("Expected MD5 sum can't be used in batch mode.")
+			os.Exit(1)
+		}
+		utils.ExpectedMd5, err = utils.ReadExpectedMd5(*expectedMd5)
+		exitOnError("Invalid expected MD5", err)
+	}
+	if *archiveFormat != "" && !utils.IsArchiveFormat(*archiveFormat) {
+		utils.Log.Errorf("Archive format %s isn't supported.", *archiveFormat)
+		os.Exit(1)
+	}
+	utils.ArchiveFormat = *archiveFormat
+	utils.UniqueRun = *uniqueRun
+	utils.ForceDownload = *force
+	utils.ProxmoxStorage = *proxmoxStorage
+	utils.XenConfigPath = utils.ExpandPath(*xenConfigPath)
+	if *vmGroup != "" {
+		utils.VMGroup, err = utils.ValidateVMGroup(*vmGroup)
+		exitOnError("Invalid group", err)
+	}
+	exitOnError("Invalid VM resources", utils.ValidateVMResources(*vmCPUs, *vmMemory))
+	utils.VMCPUs, utils.VMMemory = *vmCPUs, *vmMemory
+	utils.MinimalExtract = *minimalExtract
+	utils.ConvertDisks = *convertDisks
+	utils.AssumeYes = *assumeYes || *nonInteractive
+	utils.NonInteractive = *nonInteractive
+	utils.PromptTimeout = *promptTimeout
+	utils.LockTimeout = *lockTimeout
+	utils.Timeout = *timeout
+	utils.MaxRetries = *retries
+	utils.Offline = *offline
+	utils.DryRun = *dryRun
+	if *connections < 1 {
+		utils.Log.Error("Number of connections must be positive.")
+		os.Exit(1)
+	}
+	utils.Connections = *connections
+	utils.MaxRate, err = utils.ParseRate(*maxRate)
+	exitOnError("Invalid max rate", err)
+	if *proxy != "" {
+		exitOnError("Invalid proxy", utils.SetProxy(*proxy))
+	}
+	for _, mirror := range mirrors.values {
+		exitOnError("Invalid mirror", utils.ValidateMirror(mirror))
+	}
+	utils.Mirrors = mirrors.values
+	utils.Insecure = *insecure
+	utils.UserAgent = *userAgent
+	for _, header := range headers.values {
+		name, value, err := utils.ParseHeader(header)
+		exitOnError("Invalid header", err)
+		utils.ExtraHeaders[name] = value
+	}
+	utils.CatalogSha256 = *catalogSha256
+
+	utils.EnableUTF8Console()
 	utils.ShowBanner(BuildRev)
 
-	rawData := utils.DownloadJSON(vmsURL)
-	platforms, hypervisors, browsers, availableVms := utils.ParseJSON(&rawData)
+	if *listHypervisors {
+		utils.ShowHypervisors(utils.CheckHypervisors(), os.Stdout)
+		return
+	}
+	if *history {
+		entries, err := utils.LoadHistory()
+		exitOnError("Can't load history", err)
+		utils.ShowHistory(entries, os.Stdout)
+		return
+	}
+	if *cleanupExpired {
+		exitOnError("Cleanup failed", utils.CleanupExpired())
+		return
+	}
+
+	rawData, err := utils.DownloadJSON(*sourceURL)
+	exitOnError("Can't get VM catalog", err)
+	platforms, hypervisors, browsers, availableVms, err := utils.ParseJSON(&rawData)
+	exitOnError("Can't parse VM catalog", err)
+	releaseNotes := utils.ParseReleaseNotes(&rawData)
+
+	if *showNotes {
+		utils.ShowReleaseNotes(releaseNotes)
+		return
+	}
+
+	if *list {
+		exitOnError("Can't list VMs", utils.ListVMs(availableVms, *listFormat, os.Stdout))
+		return
+	}
 
+	// Config values are used as menu defaults, flags override them.
+	defaultPlatform := utils.PreferredChoice(config.Platform, utils.GetDefaultPlatform)
+	defaultHypervisor := utils.PreferredChoice(config.Hypervisor, utils.GetDefaultHypervisor)
+	defaultBrowser := utils.PreferredChoice(config.Browser, utils.GetDefaultBrowser)
+	defaultDownloadPath := utils.PreferredChoice(config.DownloadPath, utils.GetDefaultDownloadPath)
+	downloadPaths := utils.GetDownloadPaths()
+	if config.DownloadPath != "" && !downloadPaths["All"].Contains(config.DownloadPath) {
+		downloadPaths["All"] = append(downloadPaths["All"], config.DownloadPath)
+	}
+
+	if *vmSpec != "" {
+		spec, err := utils.FindSpec(availableVms, *vmSpec)
+		exitOnError("Invalid spec", err)
+		*platform, *hypervisor, *browser = spec.Platform, spec.Hypervisor, spec.BrowserOs
+	}
+
+	if *verifyPath != "" {
+		vm, found := utils.FindArchiveImage(availableVms, *verifyPath)
+		if *vmSpec != "" {
+			vm, found = availableVms[utils.Spec{Platform: *platform, Hypervisor: *hypervisor, BrowserOs: *browser}], true
+		}
+		if !found {
+			utils.Log.Errorf("%s isn't a known VM archive name, use -spec to select VM.", *verifyPath)
+			os.Exit(1)
+		}
+		ctx, stop := interruptContext()
+		err := utils.VerifyArchive(ctx, vm, utils.ExpandPath(*verifyPath))
+		stop()
+		exitOnError("Verification failed", err)
+		return
+	}
+
+	if *platform != "" && !strings.EqualFold(*platform, "all") && !platforms["All"].Contains(*platform) {
+		utils.Log.Errorf("Platform %s isn't available. Available platforms: %v", *platform, platforms["All"])
+		os.Exit(1)
+	}
+
+	if *selectDefaultsOnly {
+		userChoice := utils.UserChoice{}
+		userChoice.Platform = utils.DefaultOption(platforms, "All", defaultPlatform)
+		if *platform != "" {
+			userChoice.Platform, err = utils.MatchOption(*platform, platforms["All"])
+			exitOnError("Invalid platform", err)
+		}
+		platformHypervisor := utils.PreferredChoice(config.Hypervisor, utils.DefaultHypervisorFor(userChoice.Platform))
+		userChoice.Hypervisor = utils.DefaultOption(hypervisors, userChoice.Platform, platformHypervisor)
+		userChoice.BrowserOs = utils.DefaultOption(browsers, userChoice.Hypervisor, defaultBrowser)
+		userChoice.DownloadPath = utils.DefaultOption(downloadPaths, "All", defaultDownloadPath)
+		utils.ShowDefaults(userChoice)
+		return
+	}
+
+	if command == "install" {
+		installPlatform := *platform
+		if installPlatform == "" {
+			installPlatform = utils.DefaultOption(platforms, "All", defaultPlatform)
+		}
+		archiveFile := utils.ExpandPath(argument)
+		spec, err := utils.FindArchiveSpec(availableVms, archiveFile, installPlatform, *hypervisor, defaultHypervisor)
+		exitOnError("Can't install", err)
+		userChoice := utils.UserChoice{Spec: spec, VMImage: availableVms[spec], DownloadPath: filepath.Dir(archiveFile)}
+		if *dryRun {
+			utils.ShowArchivePlan(userChoice, *installer, *vmName)
+			return
+		}
+		utils.ShowHypervisorWarning(userChoice.Hypervisor)
+		utils.ShowExpiryWarning(releaseNotes)
+		utils.YesNoConfirmation(fmt.Sprintf("Install %s into %s", archiveFile, userChoice.Hypervisor))
+		runVM(userChoice, utils.Options{
+			ArchivePath:   archiveFile,
+			Installer:     *installer,
+			VMName:        *vmName,
+			DeleteArchive: *deleteArchive,
+			StepFinished:  utils.EnterToContinue,
+			PhaseStarted:  utils.ShowPhase,
+		}, *showSummary, *output)
+		return
+	}
+
+	if *installFrom != "" {
+		installPlatform := *platform
+		if installPlatform == "" {
+			installPlatform = utils.DefaultOption(platforms, "All", defaultPlatform)
+		}
+		userChoice := utils.UserChoice{}
+		userChoice.Platform = installPlatform
+		userChoice.Hypervisor, err = utils.ChooseOption(*hypervisor, hypervisors, "Select hypervisor", installPlatform, defaultHypervisor)
+		exitOnError("Invalid hypervisor", err)
+		userChoice.BrowserOs = *browser
+		vmPath, err := utils.FindVMFile(userChoice.Hypervisor, utils.ExpandPath(*installFrom))
+		exitOnError("Can't install", err)
+		if *dryRun {
+			utils.ShowInstallPlan(userChoice, vmPath, *installer, *vmName)
+			return
+		}
+		utils.ShowHypervisorWarning(userChoice.Hypervisor)
+		utils.YesNoConfirmation(fmt.Sprintf("Install %s into %s", vmPath, userChoice.Hypervisor))
+		runVM(userChoice, utils.Options{
+			VMPath:       vmPath,
+			Installer:    *installer,
+			VMName:       *vmName,
+			PhaseStarted: utils.ShowPhase,
+		}, *showSummary, *output)
+		return
+	}
+
+	if strings.EqualFold(*platform, "all") {
+		*batch = true
+	}
+	if *batch {
+		batchPath := *downloadPath
+		if *dryRun {
+			// NOTE: the download path isn't validated because it could create a folder.
+			if batchPath == "" {
+				batchPath = utils.SelectOption(downloadPaths, "Select download path", "All", defaultDownloadPath)
+			}
+			exitOnError("Dry run failed", utils.ShowBatchPlan(availableVms, *platform, batchPath))
+			return
+		}
+		if batchPath != "" {
+			exitOnError("Invalid download path", utils.PrepareDownloadPath(batchPath))
+		} else {
+			batchPath = utils.SelectDownloadPath(downloadPaths, defaultDownloadPath)
+		}
+		utils.YesNoConfirmation(fmt.Sprintf("Download %d VM archives into %s", utils.CountBatch(availableVms, *platform), batchPath))
+		ctx, stop := interruptContext()
+		results, err := utils.DownloadBatch(ctx, availableVms, *platform, batchPath, *batchJobs)
+		stop()
+		exitOnError("Can't download VM archives", err)
+		if !utils.ShowBatchSummary(results) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *multiSelect && (*toStdout || utils.ExpectedMd5 != "") {
+		utils.Log.Error("Several VMs can't be written to stdout or checked with expected MD5 sum.")
+		os.Exit(1)
+	}
 	userChoice := utils.UserChoice{}
-	userChoice.Platform = utils.SelectOption(platforms, "Select platform", "All", utils.GetDefaultPlatform)
-	userChoice.Hypervisor = utils.SelectOption(hypervisors, "Select hypervisor", userChoice.Platform, utils.GetDefaultHypervisor)
-	utils.ShowHypervisorWarning(userChoice.Hypervisor)
-	userChoice.BrowserOs = utils.SelectOption(browsers, "Select browser and OS", userChoice.Hypervisor, utils.GetDefaultBrowser)
+	var browserOses []string
+	// NOTE: menus work as a small state machine, 'b' typed in a menu returns to the previous shown menu.
+	// Menus of options given with flags aren't shown.
+	menuValues := []string{*platform, *hypervisor, *browser}
+	menuErrors := []string{"Invalid platform", "Invalid hypervisor", "Invalid browser and OS"}
+	var shownMenus []int
+	for menu := 0; menu < len(menuValues); {
+		canGoBack := len(shownMenus) > 0
+		switch menu {
+		case 0:
+			userChoice.Platform, err = utils.ChooseMenuOption(*platform, platforms, "Select platform", "All",
+				defaultPlatform, canGoBack)
+		case 1:
+			userChoice.Hypervisor, err = utils.ChooseMenuOption(*hypervisor, hypervisors, "Select hypervisor",
+				userChoice.Platform, defaultHypervisor, canGoBack)
+		case 2:
+			if *multiSelect {
+				browserOses, err = utils.ChooseMenuOptions(*browser, browsers, "Select browsers and OSes",
+					userChoice.Hypervisor, defaultBrowser, canGoBack)
+			} else {
+				userChoice.BrowserOs, err = utils.ChooseMenuOption(*browser, browsers, "Select browser and OS",
+					userChoice.Hypervisor, defaultBrowser, canGoBack)
+			}
+		}
+		if err == utils.ErrBack {
+			menu, shownMenus = shownMenus[len(shownMenus)-1], shownMenus[:len(shownMenus)-1]
+			continue
+		}
+		exitOnError(menuErrors[menu], err)
+		if menu == 1 {
+			utils.ShowHypervisorWarning(userChoice.Hypervisor)
+		}
+		if menuValues[menu] == "" && !utils.NonInteractive {
+			shownMenus = append(shownMenus, menu)
+		}
+		menu++
+	}
+	if *multiSelect {
+		if *downloadPath != "" {
+			if !*dryRun {
+				exitOnError("Invalid download path", utils.PrepareDownloadPath(*downloadPath))
+			}
+			userChoice.DownloadPath = *downloadPath
+		} else {
+			userChoice.DownloadPath = utils.SelectDownloadPath(downloadPaths, defaultDownloadPath)
+		}
+		var userChoices []utils.UserChoice
+		for _, browserOs := range browserOses {
+			selected := userChoice
+			selected.BrowserOs = browserOs
+			selected.VMImage = availableVms[selected.Spec]
+			userChoices = append(userChoices, selected)
+		}
+		if *dryRun {
+			for _, selected := range userChoices {
+				exitOnError("Dry run failed", utils.ShowPlan(selected, *installer, ""))
+			}
+			return
+		}
+		utils.ShowExpiryWarning(releaseNotes)
+		utils.ConfirmUsersChoices(userChoices)
+		runVMs(userChoices, utils.Options{
+			Installer:     *installer,
+			VMName:        *vmName,
+			DeleteArchive: *deleteArchive,
+			DownloadOnly:  command == "download",
+			PhaseStarted:  utils.ShowPhase,
+		}, *output)
+		return
+	}
 	userChoice.VMImage = availableVms[userChoice.Spec]
-	userChoice.DownloadPath = utils.SelectOption(utils.GetDownloadPaths(), "Select download path", "All", utils.GetDefaultDownloadPath)
-	utils.ConfirmUsersChoice(userChoice)
-
-	utils.DownloadVM(userChoice)
-	utils.EnterToContinue("Download finished.")
-	if vmPath, err := utils.UnzipVM(userChoice); err == nil {
-		utils.EnterToContinue("Unzip finished.")
-		utils.InstallVM(userChoice.Hypervisor, vmPath)
+	if utils.ExpectedMd5 != "" && len(userChoice.VMImage.Parts) > 0 {
+		utils.Log.Error("Expected MD5 sum can't be used for VM archives split into parts.")
+		os.Exit(1)
+	}
+	if *toStdout {
+		utils.ConfirmUsersChoice(userChoice)
+		ctx, stop := interruptContext()
+		err := utils.StreamVM(ctx, userChoice, os.Stdout)
+		stop()
+		exitOnError("Download failed", err)
+		return
+	}
+	if *dryRun {
+		// NOTE: the download path isn't validated because it could create a folder.
+		userChoice.DownloadPath = *downloadPath
+		if userChoice.DownloadPath == "" {
+			userChoice.DownloadPath = utils.SelectOption(downloadPaths, "Select download path", "All", defaultDownloadPath)
+		}
+		exitOnError("Dry run failed", utils.ShowPlan(userChoice, *installer, *vmName))
+		return
+	}
+	if *downloadPath != "" {
+		exitOnError("Invalid download path", utils.PrepareDownloadPath(*downloadPath))
+		userChoice.DownloadPath = *downloadPath
 	} else {
-		fmt.Println(err)
+		userChoice.DownloadPath = utils.SelectDownloadPath(downloadPaths, defaultDownloadPath)
 	}
+	utils.ShowExpiryWarning(releaseNotes)
+	utils.ConfirmUsersChoice(userChoice)
+
+	runVM(userChoice, utils.Options{
+		Installer:     *installer,
+		VMName:        *vmName,
+		DeleteArchive: *deleteArchive,
+		DownloadOnly:  command == "download",
+		StepFinished:  utils.EnterToContinue,
+		PhaseStarted:  utils.ShowPhase,
+	}, *showSummary, *output)
 }
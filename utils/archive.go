@@ -0,0 +1,171 @@
+// Package utils contains various supplementary functions and data structures.
+// This file archive.go contains functions related to VM archive formats.
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ArchiveFormat var forces VM archive format instead of detecting it. Empty value means auto detection.
+var ArchiveFormat = ""
+
+// archiveMagic defines signatures of supported archive formats.
+var archiveMagic = map[string][]byte{
+	"zip": []byte("PK\x03\x04"),
+	// NOTE: gzip signature doesn't tell what is compressed, only tar archives are expected inside.
+	"tar.gz": []byte("\x1f\x8b"),
+	"7z":     []byte("7z\xbc\xaf\x27\x1c"),
+}
+
+// archiveExtensions defines file extensions of supported archive formats which are longer than the last dot part.
+var archiveExtensions = []string{".tar.gz", ".tgz"}
+
+// IsArchiveFormat function checks if a given archive format is supported.
+func IsArchiveFormat(format string) bool {
+	_, ok := archiveMagic[format]
+	return ok
+}
+
+// detectArchiveFormat function detects archive format by its magic bytes.
+func detectArchiveFormat(archivePath string) (string, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	header := make([]byte, 8)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	for format, magic := range archiveMagic {
+		if bytes.HasPrefix(header[:n], magic) {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("unknown archive format of '%s'", archivePath)
+}
+
+// archiveFormat function returns format of a given archive. If ArchiveFormat is set it is validated against
+// the archive magic bytes and an error is returned if the archive clearly has another format.
+func archiveFormat(archivePath string) (string, error) {
+	detected, err := detectArchiveFormat(archivePath)
+	if ArchiveFormat == "" {
+		return detected, err
+	}
+	if detected != "" && detected != ArchiveFormat {
+		return "", fmt.Errorf("archive '%s' is %s but %s format was requested", archivePath, detected, ArchiveFormat)
+	}
+	return ArchiveFormat, nil
+}
+
+// trimArchiveExtension function removes archive extension from a given path, e.g. .zip or .tar.gz.
+func trimArchiveExtension(archivePath string) string {
+	for _, extension := range archiveExtensions {
+		if strings.HasSuffix(strings.ToLower(archivePath), extension) {
+			return archivePath[:len(archivePath)-len(extension)]
+		}
+	}
+	parts := strings.Split(archivePath, ".")
+	return strings.Join(parts[:len(parts)-1], ".")
+}
+
+// safeJoin function joins an archive entry name with a folder. Entries which would be unpacked outside of
+// the folder, e.g. '../file', are rejected.
+func safeJoin(folder, name string) (string, error) {
+	target := filepath.Join(folder, filepath.FromSlash(name))
+	if target != filepath.Clean(folder) && !strings.HasPrefix(target, filepath.Clean(folder)+string(filepath.Separator)) {
+		return "", fmt.Errorf("archive entry '%s' points outside of '%s'", name, folder)
+	}
+	return target, nil
+}
+
+// untarGzip function unpacks a given tar.gz archive into a folder and returns paths of unpacked files.
+// Gzip stream has its own checksum which is verified when the archive is read till the end.
+func untarGzip(archivePath, folder string) ([]string, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer gzipReader.Close()
+
+	var collectedPaths []string
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return collectedPaths, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		filePath, err := safeJoin(folder, header.Name)
+		if err != nil {
+			return nil, err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(filePath, os.FileMode(header.Mode).Perm()|0700); err != nil {
+				return nil, err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			Log.Infof("Unpacking '%s'", header.Name)
+			if err := untarFile(tarReader, header, filePath); err != nil {
+				return nil, err
+			}
+			collectedPaths = append(collectedPaths, filePath)
+		default:
+			Log.Debugf("Skip '%s' which isn't a regular file", header.Name)
+		}
+	}
+}
+
+// untarFile function writes a single tar archive entry into a given path and restores its modification time.
+func untarFile(src io.Reader, header *tar.Header, filePath string) error {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	targetFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(header.Mode).Perm()|0200)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyBuffer(targetFile, src, make([]byte, CopyBufferSize)); err != nil {
+		removeIncomplete(targetFile)
+		return err
+	}
+	if err := targetFile.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(filePath, header.ModTime, header.ModTime)
+}
+
+// un7z function unpacks a given 7z archive into a folder with 7z tool and returns paths of unpacked files.
+func un7z(archivePath, folder string) ([]string, error) {
+	Log.Info("Unpack 7z archive. Please wait.")
+	result, err := execCommand("7z", "x", "-y", "-o"+folder, archivePath).CombinedOutput()
+	if err != nil {
+		Log.Error(string(result))
+		return nil, fmt.Errorf("7z tool failed or isn't installed: %s", err)
+	}
+	var collectedPaths []string
+	err = filepath.Walk(folder, func(filePath string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			collectedPaths = append(collectedPaths, filePath)
+		}
+		return err
+	})
+	return collectedPaths, err
+}
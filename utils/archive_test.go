@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestArchiveFormatOverride(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		override string
+		want     string
+		wantErr  string
+	}{
+		{"detected zip", "PK\x03\x04rest", "", "zip", ""},
+		{"detected tar.gz", "\x1f\x8brest", "", "tar.gz", ""},
+		{"unknown format", "plain text", "", "", "unknown archive format"},
+		{"override matches", "PK\x03\x04rest", "zip", "zip", ""},
+		{"override unknown format", "plain text", "7z", "7z", ""},
+		{"override contradicts", "PK\x03\x04rest", "tar.gz", "", "is zip but tar.gz format was requested"},
+		{"short file", "PK", "zip", "zip", ""},
+	}
+	defer func() { ArchiveFormat = "" }()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			archivePath := filepath.Join(t.TempDir(), "IE11.bin")
+			if err := ioutil.WriteFile(archivePath, []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			ArchiveFormat = test.override
+			got, err := archiveFormat(archivePath)
+			if got != test.want {
+				t.Errorf("archiveFormat = %q, want %q", got, test.want)
+			}
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Errorf("unexpected error: %s", err)
+			case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+				t.Errorf("error = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestIsArchiveFormat(t *testing.T) {
+	for format, want := range map[string]bool{"zip": true, "tar.gz": true, "7z": true, "rar": false, "": false} {
+		if got := IsArchiveFormat(format); got != want {
+			t.Errorf("IsArchiveFormat(%q) = %t, want %t", format, got, want)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+// Package utils contains various supplementary functions and data structures.
+// This file batch.go contains functions to download many VMs in a single run.
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// BatchResult type defines an outcome of a single VM archive download in batch mode.
+type BatchResult struct {
+	Spec
+	File  string
+	Bytes int64
+	Err   error
+}
+
+// batchJob type defines a single VM archive to download in batch mode.
+type batchJob struct {
+	Spec
+	VMImage
+}
+
+// batchJobs function collects unique VM archives available for a given platform.
+// Empty platform or "all" means all platforms. The same archive is often offered for several platforms,
+// so archives are deduplicated by URL.
+func batchJobs(availableVms AvailableVM, platform string) []batchJob {
+	jobsByURL := make(map[string]batchJob)
+	var urls []string
+	for spec, vm := range availableVms {
+		if platform != "" && !strings.EqualFold(platform, "all") && spec.Platform != platform {
+			continue
+		}
+		// NOTE: parts of split archives are downloaded as separate archives, they aren't joined in batch mode.
+		images := []VMImage{vm}
+		if len(vm.Parts) > 0 {
+			images = vm.Parts
+		}
+		for _, image := range images {
+			if _, seen := jobsByURL[image.FileURL]; seen {
+				continue
+			}
+			jobsByURL[image.FileURL] = batchJob{Spec: spec, VMImage: image}
+			urls = append(urls, image.FileURL)
+		}
+	}
+
+	sort.Strings(urls)
+	var jobs []batchJob
+	for _, url := range urls {
+		jobs = append(jobs, jobsByURL[url])
+	}
+	return jobs
+}
+
+// CountBatch function returns number of VM archives which DownloadBatch would download.
+func CountBatch(availableVms AvailableVM, platform string) int {
+	return len(batchJobs(availableVms, platform))
+}
+
+// downloadBatchJob function downloads a single VM archive into hypervisor specific folder.
+// Existing archives with matching checksum are kept as-is unless ForceDownload is set.
+func downloadBatchJob(ctx context.Context, job batchJob, downloadPath string) BatchResult {
+	result := BatchResult{Spec: job.Spec}
+	folder := pathJoin(downloadPath, job.Hypervisor)
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		result.Err = err
+		return result
+	}
+	result.File = pathJoin(folder, path.Base(job.FileURL))
+
+	algo := job.hashAlgo()
+	origSum, err := expectedChecksum(ctx, job.VMImage)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	if info, err := os.Stat(result.File); err == nil && !ForceDownload {
+		localSum, err := cachedFileChecksum(result.File, algo, false)
+		if err == nil && strings.EqualFold(localSum, origSum) {
+			result.Bytes = info.Size()
+			return result
+		}
+	}
+
+	if size, err := remoteSize(ctx, job.FileURL); err == nil && size > 0 {
+		if result.Err = checkDiskSpace(folder, size); result.Err != nil {
+			return result
+		}
+	}
+
+	// NOTE: the archive is renamed to its final name only when its checksum is verified.
+	newFile, err := os.Create(partialFilePath(result.File))
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer newFile.Close()
+
+	// NOTE: progress of concurrent jobs is drawn by the shared display, each job has its own line.
+	vmSum, size, err := downloadFile(ctx, job.FileURL, newFile, algo, &DownloadOptions{})
+	result.Bytes = size
+	if err == nil && !strings.EqualFold(vmSum, origSum) {
+		err = fmt.Errorf("%s sum %s doesn't match expected %s", algoName(algo), vmSum, origSum)
+	}
+	if err != nil {
+		removeIncomplete(newFile)
+		result.Err = err
+		return result
+	}
+	newFile.Close()
+	if result.Err = os.Rename(newFile.Name(), result.File); result.Err == nil {
+		saveChecksumCache(result.File, algo, vmSum)
+	}
+	return result
+}
+
+// batchSize function returns how many bytes the given jobs would download. Archives which exist with the remote
+// size are expected to be kept, archives of unknown size aren't counted.
+func batchSize(ctx context.Context, jobs []batchJob, downloadPath string) int64 {
+	var total int64
+	for _, job := range jobs {
+		size, err := remoteSize(ctx, job.FileURL)
+		if err != nil || size <= 0 {
+			Log.Debugf("Can't get size of %s: %v", job.FileURL, err)
+			continue
+		}
+		file := pathJoin(pathJoin(downloadPath, job.Hypervisor), path.Base(job.FileURL))
+		if info, err := os.Stat(file); err == nil && info.Size() == size && !ForceDownload {
+			continue
+		}
+		total += size
+	}
+	return total
+}
+
+// DownloadBatch function downloads all VM archives available for a given platform using several concurrent jobs.
+// An error is returned before any download starts if there isn't enough disk space for the whole batch. Failed
+// downloads don't stop the others, all outcomes are returned.
+func DownloadBatch(ctx context.Context, availableVms AvailableVM, platform, downloadPath string,
+	concurrency int) ([]BatchResult, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	batch := batchJobs(availableVms, platform)
+	if err := os.MkdirAll(downloadPath, 0755); err != nil {
+		return nil, err
+	}
+	// NOTE: concurrent jobs check free space only for their own archives, so together they could run out of it.
+	if err := checkDiskSpace(downloadPath, batchSize(ctx, batch, downloadPath)); err != nil {
+		return nil, err
+	}
+	jobs := make(chan batchJob)
+	var results []BatchResult
+	var resultsMutex sync.Mutex
+	var wg sync.WaitGroup
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				Log.Infof("Downloading %s", job.FileURL)
+				result := downloadBatchJob(ctx, job, downloadPath)
+				recordBatchResult(result, job.hashAlgo())
+				resultsMutex.Lock()
+				results = append(results, result)
+				resultsMutex.Unlock()
+			}
+		}()
+	}
+	for _, job := range batch {
+		jobs <- job
+	}
+	close(jobs)
+	wg.Wait()
+	return results, nil
+}
+
+// ShowBatchSummary function shows outcomes of a batch download and returns true if all downloads succeeded.
+func ShowBatchSummary(results []BatchResult) bool {
+	var totalBytes int64
+	failed := 0
+	for _, result := range results {
+		totalBytes += result.Bytes
+		if result.Err != nil {
+			failed++
+			Log.Errorf("FAILED %s %s: %s", result.Hypervisor, result.BrowserOs, result.Err)
+		} else {
+			Log.Infof("OK %s %s: %s", result.Hypervisor, result.BrowserOs, result.File)
+		}
+	}
+	Log.Infof("Downloaded %d of %d VM archives, %d failed. Total %d bytes.",
+		len(results)-failed, len(results), failed, totalBytes)
+	return failed == 0
+}
@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// batchServer function starts a server of VM archives with given content, HEAD requests report a given size
+// instead of the real one if it is positive. Returned counter counts GET requests.
+func batchServer(t *testing.T, archives map[string]string, headSize int64) (*httptest.Server, *int32) {
+	t.Helper()
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := archives[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodHead && headSize > 0 {
+			w.Header().Set("Content-Length", fmt.Sprint(headSize))
+			return
+		}
+		if r.Method == http.MethodGet {
+			atomic.AddInt32(&downloads, 1)
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, strings.NewReader(content))
+	}))
+	t.Cleanup(server.Close)
+	return server, &downloads
+}
+
+// batchVMs function returns a catalog of VirtualBox VMs for Linux served by a given server.
+func batchVMs(serverURL string, archives map[string]string) AvailableVM {
+	availableVms := make(AvailableVM)
+	for name, content := range archives {
+		spec := Spec{Platform: "Linux", Hypervisor: "VirtualBox", BrowserOs: strings.TrimPrefix(name, "/")}
+		availableVms[spec] = VMImage{FileURL: serverURL + name, Md5: fmt.Sprintf("%X", md5.Sum([]byte(content)))}
+	}
+	return availableVms
+}
+
+func TestDownloadBatch(t *testing.T) {
+	archives := map[string]string{"/IE11.Win7.zip": "win7 archive", "/IE11.Win81.zip": "win81 archive"}
+	server, downloads := batchServer(t, archives, 0)
+	results, err := DownloadBatch(context.Background(), batchVMs(server.URL, archives), "Linux", t.TempDir(), 2)
+	if err != nil {
+		t.Fatalf("DownloadBatch: %s", err)
+	}
+	if len(results) != 2 || *downloads != 2 {
+		t.Fatalf("got %d results and %d downloads, want 2", len(results), *downloads)
+	}
+	for _, result := range results {
+		content, err := ioutil.ReadFile(result.File)
+		if result.Err != nil || err != nil || string(content) != archives["/"+result.BrowserOs] {
+			t.Errorf("%s isn't downloaded: %v, %v", result.BrowserOs, result.Err, err)
+		}
+	}
+}
+
+func TestDownloadBatchChecksWholeBatchSpace(t *testing.T) {
+	archives := map[string]string{"/IE11.Win7.zip": "win7 archive", "/IE11.Win81.zip": "win81 archive"}
+	// NOTE: each archive alone is larger than any disk, so the batch must fail before downloads start.
+	server, downloads := batchServer(t, archives, 1<<60)
+	results, err := DownloadBatch(context.Background(), batchVMs(server.URL, archives), "Linux", t.TempDir(), 2)
+	if err == nil || !strings.Contains(err.Error(), "not enough disk space") {
+		t.Fatalf("error = %v, want not enough disk space", err)
+	}
+	if len(results) != 0 || *downloads != 0 {
+		t.Errorf("%d archives are downloaded", *downloads)
+	}
+}
+
+func TestShowBatchSummaryLogsFailuresAsErrors(t *testing.T) {
+	var out, errOut bytes.Buffer
+	Console, ErrConsole = &out, &errOut
+	defer func() { Console, ErrConsole = ioutil.Discard, ioutil.Discard }()
+	results := []BatchResult{
+		{Spec: Spec{Hypervisor: "VirtualBox", BrowserOs: "IE11 Win7"}, File: "IE11.Win7.zip", Bytes: 10},
+		{Spec: Spec{Hypervisor: "VirtualBox", BrowserOs: "IE11 Win81"}, Err: errors.New("MD5 sum doesn't match")},
+	}
+	if ShowBatchSummary(results) {
+		t.Error("batch with a failed download is reported as succeeded")
+	}
+	if !strings.Contains(errOut.String(), "FAILED VirtualBox IE11 Win81: MD5 sum doesn't match") {
+		t.Errorf("failure isn't logged as an error:\n%s", errOut.String())
+	}
+	if strings.Contains(out.String(), "FAILED") {
+		t.Errorf("failure is logged as info:\n%s", out.String())
+	}
+}
@@ -0,0 +1,60 @@
+// Package utils contains various supplementary functions and data structures.
+// This file cache.go contains functions to store VM catalog locally for offline use.
+package utils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"time"
+)
+
+// Offline var makes DownloadJSON use only locally cached VM catalog.
+var Offline = false
+
+// catalogCache type defines locally cached VM catalog.
+type catalogCache struct {
+	Timestamp time.Time       `json:"timestamp"`
+	URL       string          `json:"url"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// getConfigPath function returns a folder where getIE keeps its own files.
+func getConfigPath() string {
+	if runtime.GOOS == "windows" {
+		return pathJoin(os.Getenv("USERPROFILE"), ".getie")
+	}
+	return pathJoin(os.Getenv("HOME"), ".getie")
+}
+
+// catalogCachePath function returns a path to the cached VM catalog.
+func catalogCachePath() string {
+	return pathJoin(getConfigPath(), "catalog.json")
+}
+
+// saveCatalogCache function stores raw VM catalog JSON with current timestamp.
+func saveCatalogCache(pageURL string, rawData []byte) error {
+	if err := os.MkdirAll(getConfigPath(), 0755); err != nil {
+		return err
+	}
+	cache, err := json.Marshal(catalogCache{Timestamp: time.Now(), URL: pageURL, Data: rawData})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(catalogCachePath(), cache, 0644)
+}
+
+// loadCatalogCache function loads raw VM catalog JSON stored by saveCatalogCache.
+func loadCatalogCache() ([]byte, error) {
+	content, err := ioutil.ReadFile(catalogCachePath())
+	if err != nil {
+		return nil, err
+	}
+	var cache catalogCache
+	if err := json.Unmarshal(content, &cache); err != nil {
+		return nil, err
+	}
+	Log.Infof("Use VM catalog cached at %s from %s", cache.Timestamp.Format(time.RFC1123), cache.URL)
+	return cache.Data, nil
+}
@@ -0,0 +1,336 @@
+// Package utils contains various supplementary functions and data structures.
+// This file checksum.go contains functions related to VM archives checksum verification.
+package utils
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CrossCheckMd5 var enables verification that inline and remote md5 sums provided by the catalog match each other.
+var CrossCheckMd5 = false
+
+// ExpectedMd5 var defines MD5 sum provided by a user for the selected VM archive. When set the sum isn't fetched
+// from the catalog, so downloads could be verified even if Microsoft's checksum URL is unavailable.
+var ExpectedMd5 = ""
+
+// ChecksumWrapper type is used to calculate file's checksum during download.
+type ChecksumWrapper struct {
+	io.Writer
+	hashSum hash.Hash
+}
+
+func (cw *ChecksumWrapper) Write(p []byte) (int, error) {
+	n, err := cw.Writer.Write(p)
+	// Only bytes which were actually written are hashed to keep checksum in sync with the written data.
+	cw.hashSum.Write(p[:n])
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+// newSeededChecksumWrapper function creates ChecksumWrapper whose checksum already includes data read from seed.
+// It lets a resumed download get the same checksum as a download done at once. The number of seed bytes is returned.
+func newSeededChecksumWrapper(dst io.Writer, algo string, seed io.Reader) (*ChecksumWrapper, int64, error) {
+	hashSum := newHash(algo)
+	n, err := io.CopyBuffer(hashSum, seed, make([]byte, CopyBufferSize))
+	if err != nil {
+		return nil, n, err
+	}
+	return &ChecksumWrapper{Writer: dst, hashSum: hashSum}, n, nil
+}
+
+// newHash function creates a hash for a given checksum algorithm. MD5 is used by default.
+func newHash(algo string) hash.Hash {
+	switch algo {
+	case "sha256":
+		return sha256.New()
+	case "sha1":
+		// NOTE: SHA-1 is used only by OVF manifests.
+		return sha1.New()
+	default:
+		return md5.New()
+	}
+}
+
+// algoName function returns checksum algorithm name suitable for messages.
+func algoName(algo string) string {
+	return strings.ToUpper(algo)
+}
+
+// fetchChecksum function downloads checksum value of a given algorithm from a given URL. Checksum files could have
+// a trailing new line, Windows line endings or a file name after the sum like md5sum output, so only the first field
+// is used and it is upper cased like calculated sums. A response which doesn't look like a checksum, e.g. a truncated
+// one or an error page served with 200 status, is requested again with the same backoff as failed requests.
+func fetchChecksum(ctx context.Context, checksumURL, algo string) (string, error) {
+	checksumRe := md5Re
+	if algo == "sha256" {
+		checksumRe = sha256Re
+	}
+	delay := RetryDelay
+	for attempt := 0; ; attempt++ {
+		body, _, err := fetchPage(ctx, checksumURL)
+		if err != nil {
+			return "", err
+		}
+		// NOTE: files saved by Windows tools could start with UTF-8 BOM.
+		fields := strings.Fields(strings.TrimPrefix(string(body), "\ufeff"))
+		if len(fields) > 0 && checksumRe.MatchString(fields[0]) {
+			return strings.ToUpper(fields[0]), nil
+		}
+		err = fmt.Errorf("%s doesn't contain %s sum: %q", checksumURL, algoName(algo), truncateText(string(body), 64))
+		if attempt >= MaxRetries || ctx.Err() != nil {
+			return "", err
+		}
+		Log.Warnf("%s. Retry in %s.", err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// truncateText function shortens a given text to a given number of bytes for messages.
+func truncateText(text string, size int) string {
+	if len(text) <= size {
+		return text
+	}
+	return text[:size] + "..."
+}
+
+// getOrigMd5 function gets MD5 provided by Microsoft for each VM archive.
+func getOrigMd5(ctx context.Context, vm VMImage) (string, error) {
+	return fetchChecksum(ctx, vm.Md5URL, "md5")
+}
+
+// fileChecksum function calculates checksum of a given file. Large files take a while to read, so verification
+// progress could be shown.
+func fileChecksum(filePath, algo string, showProgress bool) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var src io.Reader = file
+	if showProgress {
+		info, err := file.Stat()
+		if err != nil {
+			return "", err
+		}
+		// NOTE: hashing is much faster than downloading so progress is shown for each percent, not each 1Mb.
+		step := info.Size() / 100
+		if step < 1024*1024 {
+			step = 1024 * 1024
+		}
+		progress := &ProgressWrapper{Reader: file, size: info.Size(), step: step, action: "Verification",
+			label: filepath.Base(filePath)}
+		defer progress.close()
+		src = progress
+	}
+
+	fileSum := newHash(algo)
+	if _, err := io.CopyBuffer(fileSum, src, make([]byte, CopyBufferSize)); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%X", fileSum.Sum([]byte{})), nil
+}
+
+// checksumCachePath function returns a path to a sidecar file which keeps cached checksum of a given file.
+func checksumCachePath(filePath, algo string) string {
+	return filePath + "." + algo
+}
+
+// saveChecksumCache function stores checksum of a given file with the file's size and modification time
+// into a sidecar file, so the checksum could be reused while the file is unchanged.
+func saveChecksumCache(filePath, algo, checksum string) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return
+	}
+	content := fmt.Sprintf("%s %d %d\n", checksum, info.Size(), info.ModTime().UnixNano())
+	if err := ioutil.WriteFile(checksumCachePath(filePath, algo), []byte(content), 0644); err != nil {
+		Log.Warnf("Can't cache %s sum of %s: %s", algoName(algo), filePath, err)
+	}
+}
+
+// loadChecksumCache function returns checksum cached by saveChecksumCache.
+// Empty string is returned if the sidecar file is missing or stale.
+func loadChecksumCache(filePath, algo string) string {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return ""
+	}
+	content, err := ioutil.ReadFile(checksumCachePath(filePath, algo))
+	if err != nil {
+		return ""
+	}
+	var checksum string
+	var size, modTime int64
+	if _, err := fmt.Sscanf(string(content), "%s %d %d", &checksum, &size, &modTime); err != nil {
+		return ""
+	}
+	if size != info.Size() || modTime != info.ModTime().UnixNano() {
+		return ""
+	}
+	return checksum
+}
+
+// cachedFileChecksum function returns checksum of a given file. The cached value is used if the file wasn't changed
+// since the checksum was calculated, otherwise the checksum is calculated again and cached.
+func cachedFileChecksum(filePath, algo string, showProgress bool) (string, error) {
+	if checksum := loadChecksumCache(filePath, algo); checksum != "" {
+		Log.Debugf("Use cached %s sum of %s", algoName(algo), filePath)
+		return checksum, nil
+	}
+	checksum, err := fileChecksum(filePath, algo, showProgress)
+	if err != nil {
+		return "", err
+	}
+	saveChecksumCache(filePath, algo, checksum)
+	return checksum, nil
+}
+
+// remoteMd5URL function returns an URL of md5 file of a given VM image. If the catalog provides only inline md5 sum,
+// the URL is derived from the archive URL the way Microsoft names md5 files, e.g. IE11.Win7.VirtualBox.zip.md5.txt.
+func remoteMd5URL(vm VMImage) string {
+	if vm.Md5URL != "" {
+		return vm.Md5URL
+	}
+	return vm.FileURL + ".md5.txt"
+}
+
+// crossCheckMd5 function fetches remote md5 sum of a given VM image and compares it with the inline one.
+// A mismatch could indicate an upstream problem or tampering.
+func crossCheckMd5(ctx context.Context, vm VMImage) error {
+	if vm.Md5 == "" {
+		Log.Warn("Inline MD5 sum isn't available. Cross-check skipped.")
+		return nil
+	}
+	remoteMd5, err := fetchChecksum(ctx, remoteMd5URL(vm), "md5")
+	if err != nil {
+		return fmt.Errorf("Can't fetch remote MD5 sum to cross-check the inline one: %s", err)
+	}
+	if !strings.EqualFold(strings.TrimSpace(vm.Md5), remoteMd5) {
+		return fmt.Errorf("Inline MD5 sum %s doesn't match remote MD5 sum %s, it could be an upstream problem "+
+			"or tampering", vm.Md5, remoteMd5)
+	}
+	Log.Info("Inline and remote MD5 sums match.")
+	return nil
+}
+
+// compareChecksum function compares expected and actual checksums calculated with a given algorithm.
+func compareChecksum(algo, expected, actual string) error {
+	expected, actual = strings.TrimSpace(expected), strings.TrimSpace(actual)
+	if !strings.EqualFold(expected, actual) {
+		return fmt.Errorf("%s sum %s doesn't match expected %s", algoName(algo), actual, expected)
+	}
+	Log.Successf("%s sum matches.", algoName(algo))
+	return nil
+}
+
+// expectedChecksum function returns checksum which a downloaded VM archive should have.
+func expectedChecksum(ctx context.Context, vm VMImage) (string, error) {
+	if vm.hashAlgo() == "sha256" {
+		if sha256Re.MatchString(vm.Sha256) {
+			return vm.Sha256, nil
+		}
+		return fetchChecksum(ctx, vm.Sha256, "sha256")
+	}
+
+	if CrossCheckMd5 {
+		if err := crossCheckMd5(ctx, vm); err != nil {
+			return "", err
+		}
+	}
+	if vm.Md5 != "" {
+		return vm.Md5, nil
+	}
+	return getOrigMd5(ctx, vm)
+}
+
+// getExpectedChecksum function returns checksum which a downloaded VM archive should have and shows it.
+func getExpectedChecksum(ctx context.Context, vm VMImage) (string, error) {
+	if ExpectedMd5 != "" {
+		if vm.hashAlgo() == "md5" {
+			Log.Infof("Expected MD5 sum %s (provided by user)", ExpectedMd5)
+			return ExpectedMd5, nil
+		}
+		Log.Warnf("VM archive is verified with %s sum, provided MD5 sum is ignored.", algoName(vm.hashAlgo()))
+	}
+	origSum, err := expectedChecksum(ctx, vm)
+	if err != nil {
+		return "", err
+	}
+	Log.Infof("Expected %s sum %s", algoName(vm.hashAlgo()), origSum)
+	return origSum, nil
+}
+
+// ReadExpectedMd5 function parses MD5 sum provided by a user. The value is either MD5 sum itself or a path to
+// a local file with it, e.g. a sidecar file created by md5sum utility.
+func ReadExpectedMd5(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if md5Re.MatchString(value) {
+		return strings.ToLower(value), nil
+	}
+	content, err := ioutil.ReadFile(ExpandPath(value))
+	if err != nil {
+		return "", fmt.Errorf("'%s' is neither MD5 sum nor a readable file: %s", value, err)
+	}
+	// NOTE: md5sum output looks like '<sum>  <file name>' so only the first field is used.
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 || !md5Re.MatchString(fields[0]) {
+		return "", fmt.Errorf("file %s doesn't contain MD5 sum", value)
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+// FindArchiveImage function finds a VM archive or a part of a split archive by its file name.
+func FindArchiveImage(availableVms AvailableVM, filePath string) (VMImage, bool) {
+	name := path.Base(filepath.ToSlash(filePath))
+	for _, vm := range availableVms {
+		images := append([]VMImage{vm}, vm.Parts...)
+		for _, image := range images {
+			if path.Base(image.FileURL) == name {
+				return image, true
+			}
+		}
+	}
+	return VMImage{}, false
+}
+
+// VerifyArchive function compares checksum of a local VM archive with the expected one without downloading anything.
+func VerifyArchive(ctx context.Context, vm VMImage, filePath string) error {
+	if len(vm.Parts) > 0 {
+		return fmt.Errorf("VM archive is split into %d parts, verify each part instead", len(vm.Parts))
+	}
+	algo := vm.hashAlgo()
+	origSum, err := getExpectedChecksum(ctx, vm)
+	if err != nil {
+		return err
+	}
+	Log.Infof("Checking %s sum of %s", algoName(algo), filePath)
+	fileSum, err := fileChecksum(filePath, algo, true)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(strings.TrimSpace(fileSum), strings.TrimSpace(origSum)) {
+		return fmt.Errorf("%s sum %s doesn't match expected %s", algoName(algo), fileSum, origSum)
+	}
+	Log.Successf("%s sum %s matches.", algoName(algo), fileSum)
+	return nil
+}
@@ -0,0 +1,182 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCrossCheckMd5(t *testing.T) {
+	const (
+		sum      = "0123456789ABCDEF0123456789ABCDEF"
+		otherSum = "FEDCBA9876543210FEDCBA9876543210"
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/IE11.zip.md5.txt", "/same.md5":
+			fmt.Fprintf(w, "%s\r\n", strings.ToLower(sum))
+		case "/other.md5":
+			fmt.Fprintln(w, otherSum)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		vm      VMImage
+		wantErr string
+	}{
+		{"sums match", VMImage{FileURL: server.URL + "/IE11.zip", Md5: sum, Md5URL: server.URL + "/same.md5"}, ""},
+		{"sums differ", VMImage{FileURL: server.URL + "/IE11.zip", Md5: sum, Md5URL: server.URL + "/other.md5"},
+			"Inline MD5 sum " + sum + " doesn't match remote MD5 sum " + otherSum},
+		{"derived URL", VMImage{FileURL: server.URL + "/IE11.zip", Md5: sum}, ""},
+		{"missed remote sum", VMImage{FileURL: server.URL + "/IE10.zip", Md5: sum}, "Can't fetch remote MD5 sum"},
+		{"no inline sum", VMImage{FileURL: server.URL + "/IE11.zip", Md5URL: server.URL + "/other.md5"}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := crossCheckMd5(context.Background(), test.vm)
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Errorf("unexpected error: %s", err)
+			case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+				t.Errorf("error = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestExpectedChecksumCrossCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "FEDCBA9876543210FEDCBA9876543210")
+	}))
+	defer server.Close()
+	vm := VMImage{FileURL: server.URL + "/IE11.zip", Md5: "0123456789ABCDEF0123456789ABCDEF"}
+
+	if sum, err := expectedChecksum(context.Background(), vm); err != nil || sum != vm.Md5 {
+		t.Errorf("without cross-check got %s, %v, want inline sum", sum, err)
+	}
+	CrossCheckMd5 = true
+	defer func() { CrossCheckMd5 = false }()
+	if _, err := expectedChecksum(context.Background(), vm); err == nil {
+		t.Error("mismatched inline and remote sums were accepted")
+	}
+}
+
+func TestParseJSONKeepsInlineAndRemoteMd5(t *testing.T) {
+	rawData := []byte(`{"softwareList": [{"osList": ["Windows"], "softwareName": "HyperV", "vms": [{"browserName": "IE11",
+		"osVersion": "Win10", "files": [{"url": "https://example.com/IE11.zip", "md5": "0123456789abcdef0123456789abcdef",
+		"md5Url": "https://example.com/IE11.zip.md5.txt"}]}]}]}`)
+	_, _, _, availableVms, err := ParseJSON(&rawData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := availableVms[Spec{Platform: "Windows", Hypervisor: "HyperV", BrowserOs: "IE11 Win10"}]
+	if vm.Md5 != "0123456789abcdef0123456789abcdef" || vm.Md5URL != "https://example.com/IE11.zip.md5.txt" {
+		t.Errorf("got Md5 %q and Md5URL %q, want both", vm.Md5, vm.Md5URL)
+	}
+}
+
+func TestChecksumLineEndings(t *testing.T) {
+	const sum = "0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"unix", sum + "  IE11.zip\n"},
+		{"windows", sum + "  IE11.zip\r\n"},
+		{"windows with BOM", "\ufeff" + sum + "\r\n"},
+		{"no line ending", sum},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, test.content)
+			}))
+			defer server.Close()
+			if got, err := fetchChecksum(context.Background(), server.URL+"/IE11.zip.md5.txt", "md5"); err != nil ||
+				got != strings.ToUpper(sum) {
+				t.Errorf("fetchChecksum = %q, %v, want %q", got, err, strings.ToUpper(sum))
+			}
+
+			md5Path := filepath.Join(t.TempDir(), "IE11.zip.md5")
+			if err := ioutil.WriteFile(md5Path, []byte(strings.TrimPrefix(test.content, "\ufeff")), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := ReadExpectedMd5(md5Path); err != nil || got != sum {
+				t.Errorf("ReadExpectedMd5 = %q, %v, want %q", got, err, sum)
+			}
+		})
+	}
+}
+
+// shortWriter type writes at most limit bytes per call and fails when its capacity is exhausted.
+type shortWriter struct {
+	bytes.Buffer
+	limit    int
+	capacity int
+}
+
+func (sw *shortWriter) Write(p []byte) (int, error) {
+	if sw.capacity == 0 {
+		return 0, errors.New("no space left")
+	}
+	n := len(p)
+	if n > sw.limit {
+		n = sw.limit
+	}
+	if n > sw.capacity {
+		n = sw.capacity
+	}
+	sw.capacity -= n
+	return sw.Buffer.Write(p[:n])
+}
+
+func TestChecksumWrapperShortWrites(t *testing.T) {
+	data := []byte("0123456789")
+	tests := []struct {
+		name     string
+		limit    int
+		capacity int
+		wantN    int
+		wantErr  string
+	}{
+		{"full write", 100, 100, 10, ""},
+		{"short write", 4, 100, 4, io.ErrShortWrite.Error()},
+		{"failed write", 4, 0, 0, "no space left"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dst := &shortWriter{limit: test.limit, capacity: test.capacity}
+			cw := &ChecksumWrapper{Writer: dst, hashSum: newHash("md5")}
+			n, err := cw.Write(data)
+			if n != test.wantN || (err == nil) != (test.wantErr == "") || (err != nil && err.Error() != test.wantErr) {
+				t.Errorf("Write = %d, %v, want %d, %q", n, err, test.wantN, test.wantErr)
+			}
+			if got, want := fmt.Sprintf("%X", cw.hashSum.Sum(nil)), fmt.Sprintf("%X", md5.Sum(dst.Bytes())); got != want {
+				t.Errorf("checksum %s doesn't match written data checksum %s", got, want)
+			}
+		})
+	}
+
+	// io.Copy stops on the first short write, the checksum covers only the data which reached dst.
+	dst := &shortWriter{limit: 3, capacity: 7}
+	cw := &ChecksumWrapper{Writer: dst, hashSum: newHash("md5")}
+	if _, err := io.Copy(cw, bytes.NewReader(data)); err == nil {
+		t.Error("io.Copy into a short writer succeeded")
+	}
+	if got, want := fmt.Sprintf("%X", cw.hashSum.Sum(nil)), fmt.Sprintf("%X", md5.Sum(dst.Bytes())); got != want {
+		t.Errorf("checksum %s doesn't match copied data checksum %s", got, want)
+	}
+}
@@ -4,101 +4,723 @@ package utils
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"regexp"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// Console var defines where all messages of the tool are written.
+var Console io.Writer = os.Stdout
+
+// AssumeYes var makes all confirmations answered with yes without prompting a user.
+var AssumeYes = false
+
+// NonInteractive var makes SelectOption use default options without prompting a user.
+var NonInteractive = false
+
+// PromptTimeout var defines how long a prompt waits for a user's answer before the default one is used.
+// Zero means waiting forever.
+var PromptTimeout time.Duration
+
+var (
+	// stdinLines receives lines typed by a user. It is closed when stdin is closed.
+	stdinLines     chan string
+	stdinLinesOnce sync.Once
+)
+
+// readLine function reads a line typed by a user. Stdin is read by a single goroutine, so a line typed after
+// a prompt timed out isn't lost but answers the next prompt. Empty string is returned on timeout or if stdin
+// is closed, so the default answer is used.
+func readLine() string {
+	stdinLinesOnce.Do(func() {
+		stdinLines = make(chan string)
+		go func() {
+			reader := bufio.NewReader(os.Stdin)
+			for {
+				text, err := reader.ReadString('\n')
+				if text != "" {
+					stdinLines <- text
+				}
+				if err != nil {
+					close(stdinLines)
+					return
+				}
+			}
+		}()
+	})
+	if PromptTimeout <= 0 {
+		return <-stdinLines
+	}
+	select {
+	case text := <-stdinLines:
+		return text
+	case <-time.After(PromptTimeout):
+		fmt.Fprintln(Console)
+		Log.Warnf("No answer in %s, the default one is used.", PromptTimeout)
+		return ""
+	}
+}
+
 // ShowBanner function shows application's greeting banner.
 func ShowBanner(rev string) {
-	fmt.Printf("Get IE tool. Build rev %s.\n", rev)
+	Log.Infof("Get IE tool. Build rev %s.", rev)
+}
+
+// AskYesNo function shows Yes/No question and returns true if a user answered yes. N is default choice.
+func AskYesNo(msg string) bool {
+	if AssumeYes {
+		fmt.Fprintf(Console, "%s [y/N]: y\n", msg)
+		return true
+	}
+	fmt.Fprintf(Console, "%s [y/N]: ", msg)
+	text := readLine()
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(text)), "y")
 }
 
 // YesNoConfirmation function shows Yes/No choice. N is default choice for now.
 func YesNoConfirmation(msg string) {
-	reader := bufio.NewReader(os.Stdin)
-	defer fmt.Println()
-	fmt.Printf("%s [y/N]: ", msg)
-	text, _ := reader.ReadString('\n')
-
-	if strings.HasPrefix(strings.ToLower(strings.TrimSpace(text)), "y") {
-		fmt.Println("Confirmed. Continue operations")
+	defer fmt.Fprintln(Console)
+	if AskYesNo(msg) {
+		Log.Info("Confirmed. Continue operations")
 	} else {
-		fmt.Println("Cancelled. Exiting..")
+		Log.Info("Cancelled. Exiting..")
 		os.Exit(1)
 	}
 }
 
 // EnterToContinue function shows press ENTER confirmation for a give message.
 func EnterToContinue(msg string) {
-	reader := bufio.NewReader(os.Stdin)
+	if AssumeYes {
+		Log.Info(msg)
+		return
+	}
 	if runtime.GOOS == "darwin" {
-		fmt.Printf("%s\nPress ENTER to continue CMD-C to abort.\n", msg)
+		fmt.Fprintf(Console, "%s\nPress ENTER to continue CMD-C to abort.\n", msg)
 	} else {
-		fmt.Printf("%s\nPress ENTER to continue CTRL-C to abort.\n", msg)
+		fmt.Fprintf(Console, "%s\nPress ENTER to continue CTRL-C to abort.\n", msg)
 	}
-	reader.ReadString('\n')
+	readLine()
 }
 
 // SelectOption function shows simple selection 'menu'.
 func SelectOption(choices ChoiceGroups, groupMsg, groupName string, defaultChoiceFunc DefaultChoice) string {
-	reader := bufio.NewReader(os.Stdin)
-	defer fmt.Println()
+	option, _ := selectOption(choices, groupMsg, groupName, defaultChoiceFunc, false)
+	return option
+}
+
+// selectOption function shows available options and asks a user to select one of them. A user could type 'q' to
+// quit and, if canGoBack is true, 'b' to go back to the previous menu, ErrBack is returned then.
+func selectOption(choices ChoiceGroups, groupMsg, groupName string, defaultChoiceFunc DefaultChoice,
+	canGoBack bool) (string, error) {
+	defer fmt.Fprintln(Console)
+
+	if NonInteractive {
+		option := DefaultOption(choices, groupName, defaultChoiceFunc)
+		fmt.Fprintf(Console, "%s: %s\n", groupMsg, option)
+		return option, nil
+	}
 
 	sortedChoices := choices[groupName]
 	sort.Sort(sortedChoices)
-	defaultChoice := defaultChoiceFunc(sortedChoices)
-	for choice, option := range sortedChoices {
-		fmt.Println(choice, option)
+	if len(sortedChoices) == 0 {
+		Log.Warnf("%s: no options available", groupMsg)
+		return "", nil
+	}
+	prompt := fmt.Sprintf("%s (type text to filter%s)", groupMsg, menuKeysHint(canGoBack))
+	selected, err := runMenu(sortedChoices, defaultChoiceFunc, prompt, canGoBack, func(text string) ([]string, error) {
+		idx, err := parseSelection(text, len(sortedChoices))
+		if err != nil || len(idx) != 1 {
+			return nil, fmt.Errorf("'%s' isn't a single option number", text)
+		}
+		return []string{sortedChoices[idx[0]]}, nil
+	})
+	if err != nil {
+		return "", err
 	}
+	return selected[0], nil
+}
+
+// runMenu function shows numbered options and asks a user until an answer is accepted by parse, which returns
+// selected options or an error. An empty answer selects the default option and special keys are handled by
+// menuKey. Options are shown again filtered by a rejected answer.
+func runMenu(options Choice, defaultChoiceFunc DefaultChoice, prompt string, canGoBack bool,
+	parse func(text string) ([]string, error)) ([]string, error) {
+	defaultChoice := defaultChoiceFunc(options)
+	if defaultChoice < 0 || defaultChoice >= len(options) {
+		// NOTE: an invalid default index must not crash the menu, the first option is used instead.
+		defaultChoice = 0
+	}
+	showOptions(options, "")
 	for {
-		fmt.Printf("%s [%d]: ", groupMsg, defaultChoice)
-		text, _ := reader.ReadString('\n')
-		if strings.TrimSpace(text) == "" {
-			return sortedChoices[defaultChoice]
+		fmt.Fprintf(Console, "%s [%d]: ", prompt, defaultChoice)
+		text := strings.TrimSpace(readLine())
+		if text == "" {
+			if len(options) == 0 {
+				continue
+			}
+			return []string{options[defaultChoice]}, nil
 		}
-		selected, err := strconv.Atoi(strings.TrimSpace(text))
+		if err := menuKey(text, canGoBack); err != nil {
+			return nil, err
+		}
+		selected, err := parse(text)
 		if err != nil {
+			Log.Debug(err)
+			showOptions(options, text)
 			continue
 		}
-		if selected < 0 || selected > len(sortedChoices) {
-			continue
+		return selected, nil
+	}
+}
+
+// ErrBack is returned by menus when a user wants to go back to the previous menu.
+var ErrBack = errors.New("back to the previous menu")
+
+// menuKeysHint function returns a hint about special keys of a menu.
+func menuKeysHint(canGoBack bool) string {
+	if canGoBack {
+		return ", 'b' to go back, 'q' to quit"
+	}
+	return ", 'q' to quit"
+}
+
+// menuKey function handles special keys typed in a menu. It exits on 'q' and returns ErrBack on 'b' if a user
+// could go back.
+func menuKey(text string, canGoBack bool) error {
+	switch {
+	case strings.EqualFold(text, "q"):
+		Log.Info("Cancelled. Exiting..")
+		os.Exit(1)
+	case strings.EqualFold(text, "b") && canGoBack:
+		return ErrBack
+	}
+	return nil
+}
+
+// showOptions function shows numbered options which contain a given filter text, case is ignored.
+// Options keep their numbers so any shown number could be selected. All options are shown if nothing matches.
+func showOptions(options Choice, filter string) {
+	var shown int
+	for choice, option := range options {
+		if strings.Contains(strings.ToLower(option), strings.ToLower(filter)) {
+			fmt.Fprintln(Console, choice, option)
+			shown++
+		}
+	}
+	if shown == 0 && filter != "" {
+		fmt.Fprintf(Console, "Nothing matches '%s'.\n", filter)
+		showOptions(options, "")
+	}
+}
+
+// SelectDownloadPath function shows download path selection 'menu'. Besides numbered choices a user could type
+// any folder path, it is expanded and validated with PrepareDownloadPath.
+func SelectDownloadPath(choices ChoiceGroups, defaultChoiceFunc DefaultChoice) string {
+	const groupMsg = "Select download path or type a folder"
+	if NonInteractive {
+		return SelectOption(choices, groupMsg, "All", defaultChoiceFunc)
+	}
+	defer fmt.Fprintln(Console)
+
+	sortedChoices := choices["All"]
+	sort.Sort(sortedChoices)
+	prompt := fmt.Sprintf("%s (%s)", groupMsg, strings.TrimPrefix(menuKeysHint(false), ", "))
+	selected, _ := runMenu(sortedChoices, defaultChoiceFunc, prompt, false, func(text string) ([]string, error) {
+		if idx, err := strconv.Atoi(text); err == nil {
+			if idx < 0 || idx >= len(sortedChoices) {
+				return nil, fmt.Errorf("option %d doesn't exist", idx)
+			}
+			return []string{sortedChoices[idx]}, nil
+		}
+		downloadPath := ExpandPath(text)
+		if err := PrepareDownloadPath(downloadPath); err != nil {
+			Log.Error(err)
+			return nil, err
+		}
+		return []string{downloadPath}, nil
+	})
+	return selected[0]
+}
+
+// ExpandPath function expands leading ~ into user's home folder and environment variables in a given path.
+func ExpandPath(userPath string) string {
+	if userPath == "~" || strings.HasPrefix(userPath, "~/") || strings.HasPrefix(userPath, "~\\") {
+		home := os.Getenv("HOME")
+		if runtime.GOOS == "windows" {
+			home = os.Getenv("USERPROFILE")
+		}
+		userPath = home + userPath[1:]
+	}
+	return filepath.Clean(os.ExpandEnv(userPath))
+}
+
+// ChooseOption function returns a given value if it is available in a given group of choices.
+// If the value is empty SelectOption menu is shown instead.
+func ChooseOption(value string, choices ChoiceGroups, groupMsg, groupName string, defaultChoiceFunc DefaultChoice) (string, error) {
+	return ChooseMenuOption(value, choices, groupMsg, groupName, defaultChoiceFunc, false)
+}
+
+// ChooseMenuOption function works like ChooseOption, but if canGoBack is true a user could type 'b' to go back
+// to the previous menu, ErrBack is returned then.
+func ChooseMenuOption(value string, choices ChoiceGroups, groupMsg, groupName string, defaultChoiceFunc DefaultChoice,
+	canGoBack bool) (string, error) {
+	if value == "" {
+		return selectOption(choices, groupMsg, groupName, defaultChoiceFunc, canGoBack)
+	}
+	return MatchOption(value, choices[groupName])
+}
+
+// optionAliases var maps common short names to words used in options, e.g. 'edge' to 'MSEdge'.
+var optionAliases = map[string]string{
+	"edge":      "MSEdge",
+	"ie":        "IE",
+	"vbox":      "VirtualBox",
+	"hyper-v":   "HyperV",
+	"windows7":  "Win7",
+	"windows8":  "Win8",
+	"windows81": "Win81",
+	"windows10": "Win10",
+	"mac":       "Mac",
+	"macos":     "Mac",
+}
+
+// MatchOption function finds an option given by a user, e.g. with a flag. Exact match is preferred, otherwise
+// the value is matched case-insensitively, as words which all must be found in an option after aliases are
+// expanded, e.g. 'edge win10', and as a regular expression. An error with candidates is returned if nothing or
+// several options match.
+func MatchOption(value string, choices Choice) (string, error) {
+	if choices.Contains(value) {
+		return value, nil
+	}
+	for _, choice := range choices {
+		if strings.EqualFold(choice, value) {
+			return choice, nil
+		}
+	}
+
+	var words []string
+	for _, word := range strings.Fields(strings.ToLower(value)) {
+		if alias, ok := optionAliases[word]; ok {
+			word = strings.ToLower(alias)
 		}
-		return sortedChoices[selected]
+		words = append(words, word)
 	}
+	var candidates Choice
+	for _, choice := range choices {
+		matched := len(words) > 0
+		for _, word := range words {
+			matched = matched && strings.Contains(strings.ToLower(choice), word)
+		}
+		if matched {
+			candidates = append(candidates, choice)
+		}
+	}
+	if len(candidates) == 0 {
+		if re, err := regexp.Compile("(?i)" + value); err == nil {
+			for _, choice := range choices {
+				if re.MatchString(choice) {
+					candidates = append(candidates, choice)
+				}
+			}
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		return "", fmt.Errorf("'%s' isn't available. Available options: %s", value, strings.Join(choices, ", "))
+	case 1:
+		return candidates[0], nil
+	}
+	sort.Sort(candidates)
+	return "", fmt.Errorf("'%s' is ambiguous, it matches: %s", value, strings.Join(candidates, ", "))
+}
+
+// SelectOptions function shows available options like SelectOption but allows to select several of them, e.g.
+// '0,2,5' or 'all'. The default option is the only selected one if nothing is entered.
+func SelectOptions(choices ChoiceGroups, groupMsg, groupName string, defaultChoiceFunc DefaultChoice) []string {
+	options, _ := selectOptions(choices, groupMsg, groupName, defaultChoiceFunc, false)
+	return options
+}
+
+// selectOptions function works like selectOption but allows to select several options.
+func selectOptions(choices ChoiceGroups, groupMsg, groupName string, defaultChoiceFunc DefaultChoice,
+	canGoBack bool) ([]string, error) {
+	defer fmt.Fprintln(Console)
+
+	if NonInteractive {
+		option := DefaultOption(choices, groupName, defaultChoiceFunc)
+		fmt.Fprintf(Console, "%s: %s\n", groupMsg, option)
+		return []string{option}, nil
+	}
+
+	sortedChoices := choices[groupName]
+	sort.Sort(sortedChoices)
+	if len(sortedChoices) == 0 {
+		Log.Warnf("%s: no options available", groupMsg)
+		return nil, nil
+	}
+	prompt := fmt.Sprintf("%s (comma separated numbers, 'all' or text to filter%s)", groupMsg, menuKeysHint(canGoBack))
+	return runMenu(sortedChoices, defaultChoiceFunc, prompt, canGoBack, func(text string) ([]string, error) {
+		if strings.EqualFold(text, "all") {
+			return append([]string(nil), sortedChoices...), nil
+		}
+		selected, err := parseSelection(text, len(sortedChoices))
+		if err != nil {
+			return nil, err
+		}
+		var options []string
+		for _, idx := range selected {
+			options = append(options, sortedChoices[idx])
+		}
+		return options, nil
+	})
 }
 
-// ConfirmUsersChoice shows options selected by a user.
+// parseSelection function parses comma separated option numbers, duplicates are skipped. An error is returned
+// if any of them isn't a valid option number.
+func parseSelection(text string, optionsCount int) ([]int, error) {
+	var selected []int
+	seen := make(map[int]bool)
+	for _, field := range strings.Split(text, ",") {
+		idx, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		if idx < 0 || idx >= optionsCount {
+			return nil, fmt.Errorf("option %d doesn't exist", idx)
+		}
+		if !seen[idx] {
+			seen[idx] = true
+			selected = append(selected, idx)
+		}
+	}
+	return selected, nil
+}
+
+// ChooseOptions function returns options from a comma separated value if it is given or asks a user to select
+// several options with SelectOptions otherwise. An error is returned if any given option isn't available.
+func ChooseOptions(value string, choices ChoiceGroups, groupMsg, groupName string, defaultChoiceFunc DefaultChoice) ([]string, error) {
+	return ChooseMenuOptions(value, choices, groupMsg, groupName, defaultChoiceFunc, false)
+}
+
+// ChooseMenuOptions function works like ChooseOptions, but if canGoBack is true a user could type 'b' to go back
+// to the previous menu, ErrBack is returned then.
+func ChooseMenuOptions(value string, choices ChoiceGroups, groupMsg, groupName string, defaultChoiceFunc DefaultChoice,
+	canGoBack bool) ([]string, error) {
+	if value == "" {
+		return selectOptions(choices, groupMsg, groupName, defaultChoiceFunc, canGoBack)
+	}
+	var options []string
+	for _, option := range strings.Split(value, ",") {
+		option, err := ChooseOption(strings.TrimSpace(option), choices, groupMsg, groupName, defaultChoiceFunc)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, option)
+	}
+	return options, nil
+}
+
+// ConfirmUsersChoices function shows several selected VMs and asks a user to confirm them.
+func ConfirmUsersChoices(userChoices []UserChoice) {
+	for _, userChoice := range userChoices {
+		Log.Infof("%s for %s on %s, download size %s", userChoice.BrowserOs, userChoice.Hypervisor,
+			userChoice.Platform, downloadSizeText(userChoice.VMImage))
+	}
+	if len(userChoices) > 0 {
+		Log.Info("Download path:", userChoices[0].DownloadPath)
+	}
+	YesNoConfirmation(fmt.Sprintf("Confirm your selection of %d VMs", len(userChoices)))
+}
+
+// DefaultOption function returns an option which SelectOption would suggest by default.
+// Empty string is returned if there is no valid default option.
+func DefaultOption(choices ChoiceGroups, groupName string, defaultChoiceFunc DefaultChoice) string {
+	sortedChoices := choices[groupName]
+	sort.Sort(sortedChoices)
+	defaultChoice := defaultChoiceFunc(sortedChoices)
+	if defaultChoice < 0 || defaultChoice >= len(sortedChoices) {
+		return ""
+	}
+	return sortedChoices[defaultChoice]
+}
+
+// ShowDefaults function shows options which would be selected by default.
+func ShowDefaults(userChoice UserChoice) {
+	Log.Info("Default selection:")
+	Log.Info("Platform:", userChoice.Spec.Platform)
+	Log.Info("Hypervisor:", userChoice.Spec.Hypervisor)
+	Log.Info("Browser and OS:", userChoice.Spec.BrowserOs)
+	Log.Info("Download path:", userChoice.DownloadPath)
+}
+
+// PrepareDownloadPath function validates a download path provided by a user. The path must be a writable folder,
+// if it doesn't exist a user is offered to create it.
+func PrepareDownloadPath(downloadPath string) error {
+	info, err := os.Stat(downloadPath)
+	if os.IsNotExist(err) {
+		if !AskYesNo(fmt.Sprintf("Folder '%s' doesn't exist. Create it", downloadPath)) {
+			return fmt.Errorf("folder '%s' doesn't exist", downloadPath)
+		}
+		if err := os.MkdirAll(downloadPath, 0755); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("'%s' isn't a folder", downloadPath)
+	}
+
+	testFile, err := ioutil.TempFile(downloadPath, ".getie-")
+	if err != nil {
+		return fmt.Errorf("folder '%s' isn't writable: %s", downloadPath, err)
+	}
+	testFile.Close()
+	return os.Remove(testFile.Name())
+}
+
+// ConfirmUsersChoice shows options selected by a user and expected download size.
 func ConfirmUsersChoice(userChoice UserChoice) {
-	fmt.Println("Platform:", userChoice.Spec.Platform)
-	fmt.Println("Hypervisor:", userChoice.Spec.Hypervisor)
-	fmt.Println("Browser and OS:", userChoice.Spec.BrowserOs)
-	fmt.Println("Download path:", userChoice.DownloadPath)
+	Log.Info("Platform:", userChoice.Spec.Platform)
+	Log.Info("Hypervisor:", userChoice.Spec.Hypervisor)
+	Log.Info("Browser and OS:", userChoice.Spec.BrowserOs)
+	Log.Info("Download path:", userChoice.DownloadPath)
+	Log.Info("Download size:", downloadSizeText(userChoice.VMImage))
 	YesNoConfirmation("Confirm your selection")
 }
 
-// ShowHypervisorWarning function shows hypervisor specific warnings if any.
-func ShowHypervisorWarning(hypervisor string) {
+// downloadSizeText function returns human readable size of a remote VM archive including all its parts. Some servers
+// don't return Content-Length for HEAD requests, so the size could be unknown.
+func downloadSizeText(vm VMImage) string {
+	images := []VMImage{vm}
+	if len(vm.Parts) > 0 {
+		images = vm.Parts
+	}
+	var total int64
+	for _, image := range images {
+		size, err := remoteSize(context.Background(), image.FileURL)
+		if err != nil {
+			Log.Debugf("Can't get size of %s: %s", image.FileURL, err)
+			return "unknown"
+		}
+		if size < 0 {
+			return "unknown"
+		}
+		total += size
+	}
+	return humanBytes(total)
+}
+
+// ShowSummary function shows a short report about what was done during a run.
+func ShowSummary(summary RunSummary) {
+	Log.Info("Summary:")
+	Log.Infof("VM: %s for %s on %s", summary.BrowserOs, summary.Hypervisor, summary.Platform)
+	if summary.ArchivePath != "" {
+		verified := "checksum not verified"
+		if summary.Verified {
+			verified = "checksum verified"
+		}
+		if archive, err := os.Stat(summary.ArchivePath); err == nil {
+			Log.Infof("Archive: %s (%d bytes, %s)", summary.ArchivePath, archive.Size(), verified)
+		} else {
+			Log.Infof("Archive: %s (%s, deleted)", summary.ArchivePath, verified)
+		}
+	}
+	if summary.Download.Bytes > 0 {
+		Log.Infof("Download: %s", summary.Download)
+	}
+	if summary.VMPath != "" {
+		Log.Infof("Unzipped VM: %s", summary.VMPath)
+	} else {
+		Log.Info("Unzipped VM: not unzipped")
+	}
+	switch {
+	case summary.Installed:
+		Log.Infof("Install: imported into %s", summary.Hypervisor)
+	case summary.AlreadyImported:
+		Log.Infof("Install: already imported into %s, import skipped", summary.Hypervisor)
+	case summary.Err != nil && summary.VMPath != "":
+		Log.Infof("Install: failed, %s", summary.Err)
+	case summary.Err != nil:
+		Log.Infof("Install: skipped, %s", summary.Err)
+	default:
+		Log.Info("Install: not requested")
+	}
+}
+
+// ShowSummaries function shows outcomes of several runs, one line per VM, and returns true if all of them
+// succeeded.
+func ShowSummaries(summaries []RunSummary) bool {
+	Log.Info("Summary:")
+	failed := 0
+	var download DownloadStats
+	for _, summary := range summaries {
+		download.Bytes += summary.Download.Bytes
+		download.Elapsed += summary.Download.Elapsed
+		if summary.Err != nil {
+			failed++
+			Log.Infof("FAILED %s for %s: %s", summary.BrowserOs, summary.Hypervisor, summary.Err)
+		} else if summary.AlreadyImported {
+			Log.Infof("OK %s for %s: %s (already imported)", summary.BrowserOs, summary.Hypervisor, summary.VMPath)
+		} else if summary.VMPath != "" {
+			Log.Infof("OK %s for %s: %s", summary.BrowserOs, summary.Hypervisor, summary.VMPath)
+		} else {
+			Log.Infof("OK %s for %s: %s", summary.BrowserOs, summary.Hypervisor, summary.ArchivePath)
+		}
+	}
+	if download.Bytes > 0 {
+		Log.Infof("Download: %s", download)
+	}
+	Log.Infof("Finished %d of %d VMs, %d failed.", len(summaries)-failed, len(summaries), failed)
+	return failed == 0
+}
+
+// summaryJSON type defines JSON summary written by WriteSummaryJSON.
+type summaryJSON struct {
+	Platform        string  `json:"platform"`
+	Hypervisor      string  `json:"hypervisor"`
+	BrowserOs       string  `json:"browserOs"`
+	FileURL         string  `json:"fileUrl"`
+	DownloadPath    string  `json:"downloadPath"`
+	ArchivePath     string  `json:"archivePath,omitempty"`
+	HashAlgo        string  `json:"hashAlgo"`
+	Checksum        string  `json:"checksum,omitempty"`
+	ChecksumMatched bool    `json:"checksumMatched"`
+	UnzipFolder     string  `json:"unzipFolder,omitempty"`
+	VMPath          string  `json:"vmPath,omitempty"`
+	Installed       bool    `json:"installed"`
+	AlreadyImported bool    `json:"alreadyImported,omitempty"`
+	DownloadedBytes int64   `json:"downloadedBytes,omitempty"`
+	DownloadSeconds float64 `json:"downloadSeconds,omitempty"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// WriteSummaryJSON function writes outcomes of a run as a single JSON object into dst.
+func WriteSummaryJSON(summary RunSummary, dst io.Writer) error {
+	return writeJSON(newSummaryJSON(summary), dst)
+}
+
+// WriteSummariesJSON function writes outcomes of several runs to a given writer as a JSON array.
+func WriteSummariesJSON(summaries []RunSummary, dst io.Writer) error {
+	results := make([]summaryJSON, 0, len(summaries))
+	for _, summary := range summaries {
+		results = append(results, newSummaryJSON(summary))
+	}
+	return writeJSON(results, dst)
+}
+
+// newSummaryJSON function converts outcomes of a run into JSON summary.
+func newSummaryJSON(summary RunSummary) summaryJSON {
+	result := summaryJSON{
+		Platform:        summary.Platform,
+		Hypervisor:      summary.Hypervisor,
+		BrowserOs:       summary.BrowserOs,
+		FileURL:         summary.FileURL,
+		DownloadPath:    summary.DownloadPath,
+		ArchivePath:     summary.ArchivePath,
+		HashAlgo:        summary.VMImage.hashAlgo(),
+		UnzipFolder:     summary.UnzipFolder,
+		VMPath:          summary.VMPath,
+		Installed:       summary.Installed,
+		AlreadyImported: summary.AlreadyImported,
+		DownloadedBytes: summary.Download.Bytes,
+		DownloadSeconds: summary.Download.Elapsed.Seconds(),
+	}
+	// NOTE: checksums of verified archives are cached by DownloadVM.
+	if summary.Verified {
+		result.ChecksumMatched = true
+		result.Checksum = loadChecksumCache(summary.ArchivePath, result.HashAlgo)
+	}
+	if summary.Err != nil {
+		result.Error = summary.Err.Error()
+	}
+	return result
+}
+
+// writeJSON function writes a given value to a writer as indented JSON.
+func writeJSON(value interface{}, dst io.Writer) error {
+	content, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(dst, string(content))
+	return err
+}
+
+// HypervisorWarnings function returns hypervisor specific warnings if any.
+func HypervisorWarnings(hypervisor string) []string {
 	switch hypervisor {
 	case "HyperV":
-		EnterToContinue("WARNING: For HyperV you must run this tool as Administrator.")
+		return []string{"For HyperV you must run this tool as Administrator."}
 	case "VMware":
 		if runtime.GOOS == "darwin" {
-			EnterToContinue("WARNING: At least VMware Fusion must be installed to run this tool correctly.")
-		} else {
-			EnterToContinue("WARNING: At least VMware Workstation must be installed to run this tool correctly.")
-			EnterToContinue("WARNING: VMware hypervisor isn't compatible with Hyper-V hypervisor.")
+			return []string{"At least VMware Fusion must be installed to run this tool correctly."}
 		}
+		return []string{"At least VMware Workstation must be installed to run this tool correctly."}
 	case "Parallels":
-			EnterToContinue("WARNING: Parallels Desktop for Mac Pro or Business Edition must be installed to run this tool correctly.")
-	case "VirtualBox":
-		if runtime.GOOS == "windows" {
-			EnterToContinue("WARNING: VirtualBox could fail to run selected VM if Hyper-V is also installed.")
-		}
+		return []string{"Parallels Desktop for Mac Pro or Business Edition must be installed to run this tool correctly."}
+	case "QEMU":
+		return []string{"QEMU uses VirtualBox images. qemu-img, virt-install and virsh must be installed to run this tool correctly."}
+	case "Proxmox":
+		return []string{"For Proxmox you must run this tool as root on the Proxmox VE node."}
+	case "Xen":
+		return []string{"Xen uses VirtualBox images. You must run this tool as root in dom0, xl and qemu-img must be " +
+			"installed to run this tool correctly."}
+	case "Vagrant":
+		return []string{"Vagrant and a hypervisor supported by the box must be installed to run this tool correctly."}
+	case "WindowsSandbox":
+		return []string{"Windows Sandbox can't boot VM images, the VM disk is only mapped into a sandbox read-only.",
+			"Windows 10 Pro or Enterprise with Windows Sandbox optional feature enabled is required."}
 	case "VPC":
-		EnterToContinue("WARNING: VPC (Virtual-PC) is obsolete.")
+		return []string{"VPC (Virtual-PC) is obsolete."}
+	}
+	return nil
+}
+
+// HypervisorConflict function checks if a given hypervisor conflicts with Hyper-V enabled on Windows and
+// returns a description of the conflict. Empty string is returned if there is no conflict.
+func HypervisorConflict(hypervisor string) string {
+	if hypervisor != "VirtualBox" && hypervisor != "VMware" {
+		return ""
+	}
+	enabled, err := hypervEnabled()
+	if err != nil {
+		// NOTE: the conflict isn't reported if it can't be confirmed.
+		Log.Debugf("Can't check if Hyper-V is enabled: %s", err)
+		return ""
+	}
+	if !enabled {
+		return ""
+	}
+	return fmt.Sprintf("Hyper-V is enabled on this machine, %s could fail to run VMs or run them very slowly. "+
+		"Disable it with 'bcdedit /set hypervisorlaunchtype off' as Administrator and reboot.", hypervisor)
+}
+
+// ShowHypervisorWarning function shows hypervisor specific warnings if any. In interactive mode each warning waits
+// for a user to continue, otherwise warnings are only logged. A user must confirm to continue if the hypervisor
+// conflicts with Hyper-V.
+func ShowHypervisorWarning(hypervisor string) {
+	for _, warning := range HypervisorWarnings(hypervisor) {
+		if NonInteractive {
+			Log.Warn(warning)
+		} else {
+			EnterToContinue(colorize(Console, colorYellow, "WARNING: "+warning))
+		}
+	}
+	if conflict := HypervisorConflict(hypervisor); conflict != "" {
+		Log.Warn(conflict)
+		YesNoConfirmation("Continue anyway")
 	}
 }
@@ -0,0 +1,180 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// typeLines function makes readLine return given lines as if a user typed them, an empty line is returned after
+// all of them like on closed stdin.
+func typeLines(lines ...string) {
+	stdinLinesOnce.Do(func() {})
+	typed := make(chan string, len(lines))
+	for _, line := range lines {
+		typed <- line + "\n"
+	}
+	close(typed)
+	stdinLines = typed
+}
+
+// captureConsole function redirects Console into a buffer until the test ends.
+func captureConsole(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	Console = &buf
+	t.Cleanup(func() { Console = ioutil.Discard })
+	return &buf
+}
+
+func TestShowSummary(t *testing.T) {
+	spec := Spec{Platform: "Linux", Hypervisor: "VirtualBox", BrowserOs: "IE11 Win7"}
+	archivePath := "IE11.Win7.VirtualBox.zip"
+	vmPath := "IE11 - Win7.ova"
+	tests := []struct {
+		name        string
+		summary     RunSummary
+		wantArchive string
+		wantInstall string
+	}{
+		{
+			name:        "download only",
+			summary:     RunSummary{ArchivePath: archivePath, Verified: true},
+			wantArchive: "checksum verified",
+			wantInstall: "Install: not requested",
+		},
+		{
+			name:        "installed",
+			summary:     RunSummary{ArchivePath: archivePath, Verified: true, VMPath: vmPath, Installed: true},
+			wantArchive: "checksum verified",
+			wantInstall: "Install: imported into VirtualBox",
+		},
+		{
+			name:        "install from file",
+			summary:     RunSummary{ArchivePath: archivePath, VMPath: vmPath, Installed: true},
+			wantArchive: "checksum not verified",
+			wantInstall: "Install: imported into VirtualBox",
+		},
+		{
+			name:        "already imported",
+			summary:     RunSummary{ArchivePath: archivePath, Verified: true, VMPath: vmPath, AlreadyImported: true},
+			wantArchive: "checksum verified",
+			wantInstall: "Install: already imported into VirtualBox, import skipped",
+		},
+		{
+			name:        "import failed",
+			summary:     RunSummary{ArchivePath: archivePath, Verified: true, VMPath: vmPath, Err: errors.New("exit status 1")},
+			wantArchive: "checksum verified",
+			wantInstall: "Install: failed, exit status 1",
+		},
+		{
+			name:        "download failed",
+			summary:     RunSummary{Err: errors.New("connection reset")},
+			wantInstall: "Install: skipped, connection reset",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := captureConsole(t)
+			test.summary.UserChoice = UserChoice{Spec: spec}
+			ShowSummary(test.summary)
+			if test.wantArchive != "" && !strings.Contains(out.String(), "Archive: "+archivePath+" ("+test.wantArchive+",") {
+				t.Errorf("archive line with %q is missed:\n%s", test.wantArchive, out)
+			}
+			if !strings.Contains(out.String(), test.wantInstall+"\n") {
+				t.Errorf("line %q is missed:\n%s", test.wantInstall, out)
+			}
+			result := newSummaryJSON(test.summary)
+			if result.ChecksumMatched != test.summary.Verified || result.Installed != test.summary.Installed ||
+				result.AlreadyImported != test.summary.AlreadyImported {
+				t.Errorf("JSON summary %+v doesn't match %+v", result, test.summary)
+			}
+		})
+	}
+}
+
+func TestMenus(t *testing.T) {
+	choices := ChoiceGroups{"All": Choice{"IE11 Win7", "IE11 Win81", "MSEdge Win10"}}
+	folder := filepath.Join(t.TempDir(), "downloads")
+	second := func(Choice) int { return 1 }
+	single := func() []string { return []string{SelectOption(choices, "Select VM", "All", second)} }
+	multi := func() []string { return SelectOptions(choices, "Select VMs", "All", second) }
+	downloadPath := func() []string { return []string{SelectDownloadPath(choices, second)} }
+	tests := []struct {
+		name    string
+		menu    func() []string
+		answers []string
+		want    []string
+	}{
+		{"single default", single, []string{""}, []string{"IE11 Win81"}},
+		{"single number", single, []string{"2"}, []string{"MSEdge Win10"}},
+		{"single after filter", single, []string{"edge", "7", "0"}, []string{"IE11 Win7"}},
+		{"single rejects several", single, []string{"0,2", "2"}, []string{"MSEdge Win10"}},
+		{"multi default", multi, []string{""}, []string{"IE11 Win81"}},
+		{"multi numbers", multi, []string{"5", "2, 0"}, []string{"MSEdge Win10", "IE11 Win7"}},
+		{"multi all", multi, []string{"ALL"}, []string{"IE11 Win7", "IE11 Win81", "MSEdge Win10"}},
+		{"path number", downloadPath, []string{"9", "0"}, []string{"IE11 Win7"}},
+		{"path folder", downloadPath, []string{folder}, []string{folder}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			typeLines(test.answers...)
+			if got := test.menu(); strings.Join(got, "|") != strings.Join(test.want, "|") {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSelectOptionBounds(t *testing.T) {
+	choices := ChoiceGroups{"All": Choice{"IE11 Win7", "IE11 Win81", "MSEdge Win10"}}
+	index := func(idx int) DefaultChoice { return func(Choice) int { return idx } }
+	tests := []struct {
+		name       string
+		defaultIdx int
+		answers    []string
+		want       string
+	}{
+		{"last option", 0, []string{"2"}, "MSEdge Win10"},
+		{"one past the end", 0, []string{"3", "1"}, "IE11 Win81"},
+		{"negative number", 0, []string{"-1", "0"}, "IE11 Win7"},
+		{"default past the end", 3, []string{""}, "IE11 Win7"},
+		{"negative default", -1, []string{""}, "IE11 Win7"},
+		{"default past the end with answer", 3, []string{"2"}, "MSEdge Win10"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			typeLines(test.answers...)
+			if got := SelectOption(choices, "Select VM", "All", index(test.defaultIdx)); got != test.want {
+				t.Errorf("SelectOption = %q, want %q", got, test.want)
+			}
+		})
+	}
+
+	// NOTE: a non-interactive run has nobody to ask, so an invalid default selects nothing.
+	for _, idx := range []int{-1, 3} {
+		if got := DefaultOption(choices, "All", index(idx)); got != "" {
+			t.Errorf("DefaultOption with default %d = %q, want no option", idx, got)
+		}
+	}
+}
+
+func TestGetDefaultDownloadPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		choices Choice
+		want    int
+	}{
+		{"downloads folder", Choice{"/tmp", "/home/user/Downloads", "/home/user"}, 1},
+		{"no downloads folder", Choice{"/tmp", "/home/user"}, 0},
+		{"no choices", Choice{}, 0},
+	}
+	for _, test := range tests {
+		if got := GetDefaultDownloadPath(test.choices); got != test.want {
+			t.Errorf("%s: GetDefaultDownloadPath = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
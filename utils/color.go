@@ -0,0 +1,61 @@
+// Package utils contains various supplementary functions and data structures.
+// This file color.go contains functions to color terminal output.
+package utils
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// NoColor var disables colored output. Colors are used only for terminals anyway, so piped output isn't colored.
+var NoColor = os.Getenv("NO_COLOR") != ""
+
+// ANSI escape sequences of used colors.
+const (
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorReset  = "\x1b[0m"
+)
+
+var (
+	// colorTerminals caches which outputs support ANSI escape sequences, so terminals are checked only once.
+	colorTerminals      = make(map[uintptr]bool)
+	colorTerminalsMutex sync.Mutex
+)
+
+// useColor function checks if colors should be used for a given output. Only terminals support colors.
+func useColor(out io.Writer) bool {
+	return !NoColor && ansiTerminal(out)
+}
+
+// ansiTerminal function checks if a given output is a terminal which supports ANSI escape sequences, e.g. colors
+// and cursor movement.
+func ansiTerminal(out io.Writer) bool {
+	file, ok := out.(*os.File)
+	if !ok {
+		return false
+	}
+	colorTerminalsMutex.Lock()
+	defer colorTerminalsMutex.Unlock()
+	supported, checked := colorTerminals[file.Fd()]
+	if !checked {
+		info, err := file.Stat()
+		supported = err == nil && info.Mode()&os.ModeCharDevice != 0 && enableTerminalColors(file)
+		colorTerminals[file.Fd()] = supported
+	}
+	return supported
+}
+
+// colorize function wraps a given text with a color if the output supports colors.
+// Trailing new line is kept outside of the colored text.
+func colorize(out io.Writer, color, text string) string {
+	if !useColor(out) || text == "" {
+		return text
+	}
+	if text[len(text)-1] == '\n' {
+		return color + text[:len(text)-1] + colorReset + "\n"
+	}
+	return color + text + colorReset
+}
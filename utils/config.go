@@ -0,0 +1,64 @@
+// Package utils contains various supplementary functions and data structures.
+// This file config.go contains functions to load user's default preferences.
+package utils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Config type defines user's default preferences stored in the config file. Empty values are ignored.
+type Config struct {
+	Platform   string `json:"platform"`
+	Hypervisor string `json:"hypervisor"`
+	// Browser is a case insensitive part of browser and OS option, e.g. 'win10'.
+	Browser      string `json:"browser"`
+	DownloadPath string `json:"downloadPath"`
+	LogLevel     string `json:"logLevel"`
+	Proxy        string `json:"proxy"`
+	// Mirrors are base URLs of mirrors tried before the original download host.
+	Mirrors []string `json:"mirrors"`
+}
+
+// ConfigPath function returns a path to the config file.
+func ConfigPath() string {
+	return pathJoin(getConfigPath(), "config.json")
+}
+
+// LoadConfig function loads user's preferences from a given config file. Empty config is returned if the file
+// doesn't exist.
+func LoadConfig(configPath string) (Config, error) {
+	var config Config
+	content, err := ioutil.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(content, &config)
+	return config, err
+}
+
+// PreferredChoice function returns a default choice function which prefers an option containing a given value,
+// case is ignored. If no option matches or the value is empty a given fallback function is used.
+func PreferredChoice(value string, fallback DefaultChoice) DefaultChoice {
+	return func(choices Choice) int {
+		if value == "" {
+			return fallback(choices)
+		}
+		for idx, choice := range choices {
+			if strings.EqualFold(choice, value) {
+				return idx
+			}
+		}
+		for idx, choice := range choices {
+			if strings.Contains(strings.ToLower(choice), strings.ToLower(value)) {
+				return idx
+			}
+		}
+		return fallback(choices)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+// Package utils contains various supplementary functions and data structures.
+// This file console_other.go contains console functions for non-Windows platforms.
+package utils
+
+import "os"
+
+// EnableUTF8Console function does nothing because non-Windows consoles use UTF-8 already.
+func EnableUTF8Console() {}
+
+// enableTerminalColors function reports that non-Windows terminals support ANSI colors.
+func enableTerminalColors(file *os.File) bool {
+	return true
+}
@@ -0,0 +1,35 @@
+// Package utils contains various supplementary functions and data structures.
+// This file console_windows.go contains Windows specific console functions.
+package utils
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// utf8CodePage defines UTF-8 code page identifier for Windows console.
+const utf8CodePage = 65001
+
+// enableVirtualTerminalProcessing defines console mode flag which makes Windows console handle ANSI sequences.
+const enableVirtualTerminalProcessing = 0x0004
+
+// EnableUTF8Console function switches Windows console into UTF-8 mode so non-ASCII VM names and paths
+// are shown correctly.
+func EnableUTF8Console() {
+	kernel32 := syscall.NewLazyDLL("kernel32.dll")
+	kernel32.NewProc("SetConsoleOutputCP").Call(uintptr(utf8CodePage))
+	kernel32.NewProc("SetConsoleCP").Call(uintptr(utf8CodePage))
+}
+
+// enableTerminalColors function switches Windows console into a mode which handles ANSI colors. Old Windows
+// versions don't support it, so false is returned if the mode can't be set.
+func enableTerminalColors(file *os.File) bool {
+	kernel32 := syscall.NewLazyDLL("kernel32.dll")
+	var mode uint32
+	if ret, _, _ := kernel32.NewProc("GetConsoleMode").Call(file.Fd(), uintptr(unsafe.Pointer(&mode))); ret == 0 {
+		return false
+	}
+	ret, _, _ := kernel32.NewProc("SetConsoleMode").Call(file.Fd(), uintptr(mode|enableVirtualTerminalProcessing))
+	return ret != 0
+}
@@ -0,0 +1,197 @@
+// Package utils contains various supplementary functions and data structures.
+// This file convert.go contains functions to convert VM disks of one hypervisor into a format of another one.
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ConvertDisks var allows to install a VM unzipped for another hypervisor. If a VM folder doesn't have a VM file of
+// the selected hypervisor, a disk of the VM is converted into the hypervisor format and a new VM is created for it.
+var ConvertDisks = false
+
+// diskExtensions var defines extensions of VM disks which could be converted, in order of preference.
+var diskExtensions = []string{".vmdk", ".vhdx", ".vhd", ".vdi", ".qcow2"}
+
+// nativeDiskFormats var maps hypervisors which need a VM created for a converted disk to their disk formats.
+// QEMU, Proxmox and Xen aren't listed because they convert any disk themselves.
+var nativeDiskFormats = map[string]string{
+	"VirtualBox": "vdi",
+	"VMware":     "vmdk",
+	"HyperV":     "vhdx",
+}
+
+// qemuImgFormats var maps disk formats to qemu-img format names, qemu-img calls VHD format vpc.
+var qemuImgFormats = map[string]string{"vdi": "vdi", "vmdk": "vmdk", "vhdx": "vhdx", "vhd": "vpc", "qcow2": "qcow2"}
+
+// needsConversion function checks if a given path is a disk of a VM unzipped for another hypervisor rather than
+// a VM file of a given hypervisor.
+func needsConversion(hypervisor, vmPath string) bool {
+	if nativeDiskFormats[hypervisor] == "" {
+		return false
+	}
+	for _, ext := range vmFileExtensions(hypervisor) {
+		if strings.HasSuffix(vmPath, ext) {
+			return false
+		}
+	}
+	return true
+}
+
+// findForeignDisk function finds a disk of a VM unzipped for another hypervisor. VirtualBox .ova file is used if
+// there are no other disks, the disk is extracted from it before conversion.
+func findForeignDisk(collectedPaths []string) (string, error) {
+	for _, ext := range append(diskExtensions, ".ova") {
+		for _, diskPath := range collectedPaths {
+			if strings.EqualFold(filepath.Ext(diskPath), ext) {
+				return diskPath, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("Didn't find a disk to convert, expected one of: %s, .ova", strings.Join(diskExtensions, ", "))
+}
+
+// selectVMFile function finds a VM file for a given hypervisor among unzipped files. A disk of another hypervisor
+// is returned instead if ConvertDisks is set and the hypervisor supports converted disks.
+func selectVMFile(hypervisor string, collectedPaths []string) (string, error) {
+	vmPath, err := vmFilePath(hypervisor, collectedPaths)
+	if err == nil || !ConvertDisks || nativeDiskFormats[hypervisor] == "" {
+		return vmPath, err
+	}
+	if vmPath, err = findForeignDisk(collectedPaths); err != nil {
+		return "", err
+	}
+	Log.Infof("There is no %s VM file, disk %s will be converted.", hypervisor, vmPath)
+	return vmPath, nil
+}
+
+// convertDisk function converts a disk into a given format next to the original one and returns a path to the
+// converted disk. qemu-img is used if it is installed, otherwise vboxmanage which doesn't support VHDX format.
+func convertDisk(diskPath, format string) (string, error) {
+	if strings.EqualFold(filepath.Ext(diskPath), "."+format) {
+		return diskPath, nil
+	}
+	convertedPath := strings.TrimSuffix(diskPath, filepath.Ext(diskPath)) + "." + format
+	if _, err := os.Stat(convertedPath); err == nil {
+		Log.Infof("Converted disk %s already exists.", convertedPath)
+		return convertedPath, nil
+	}
+	Log.Infof("Convert %s to %s. Please wait.", diskPath, convertedPath)
+	cmdName, cmdArgs := "qemu-img", []string{"convert", "-O", qemuImgFormats[format], diskPath, convertedPath}
+	if _, err := execCommand("qemu-img", "--version").Output(); err != nil {
+		if format == "vhdx" {
+			return "", fmt.Errorf("qemu-img is required to convert disks into VHDX format")
+		}
+		cmdName = findVBoxManage()
+		cmdArgs = []string{"clonemedium", "disk", diskPath, convertedPath, "--format", strings.ToUpper(format)}
+	}
+	if result, err := execCommand(cmdName, cmdArgs...).CombinedOutput(); err != nil {
+		Log.Error(string(result))
+		os.Remove(convertedPath)
+		return "", err
+	}
+	return convertedPath, nil
+}
+
+// importConvertedVM function converts a disk of another hypervisor and creates a new VM for it. It returns a path
+// which identifies the VM like a VM file does, e.g. .vmx file for VMware. errAlreadyImported is returned with
+// the path if a VM with the same name exists.
+func importConvertedVM(hypervisor, vmPath, name string) (string, error) {
+	var err error
+	switch hypervisor {
+	case "VirtualBox":
+		_, err = checkVirtualBox(Log)
+	case "VMware":
+		_, err = checkVmware(Log)
+	case "HyperV":
+		_, err = checkHyperv(Log)
+	}
+	if err != nil {
+		return "", err
+	}
+	diskPath := vmPath
+	if strings.HasSuffix(vmPath, ".ova") {
+		if diskPath, err = extractOvaDisk(vmPath); err != nil {
+			return "", err
+		}
+	}
+	if diskPath, err = convertDisk(diskPath, nativeDiskFormats[hypervisor]); err != nil {
+		return "", err
+	}
+
+	switch hypervisor {
+	case "VirtualBox":
+		if alreadyImported(hypervisor, name, virtualBoxVMs) {
+			return diskPath, errAlreadyImported
+		}
+		return diskPath, createVirtualBoxVM(diskPath, name)
+	case "VMware":
+		vmxPath := strings.TrimSuffix(diskPath, filepath.Ext(diskPath)) + ".vmx"
+		if err := writeVmx(vmxPath, diskPath, name); err != nil {
+			return "", err
+		}
+		fixVmwareNetwork(vmxPath)
+		return vmxPath, importVmwareVM(vmxPath)
+	case "HyperV":
+		if alreadyImported(hypervisor, name, hypervVMs) {
+			return diskPath, errAlreadyImported
+		}
+		script := fmt.Sprintf("New-VM -Name %s -MemoryStartupBytes 2GB -Generation 1 -VHDPath %s",
+			psQuote(name), psQuote(diskPath))
+		if result, err := execCommand("powershell", "-NoProfile", "-NonInteractive", "-Command", script).CombinedOutput(); err != nil {
+			Log.Error(string(result))
+			return "", err
+		}
+		return diskPath, nil
+	}
+	return "", fmt.Errorf("Hypervisor %s doesn't support converted disks", hypervisor)
+}
+
+// createVirtualBoxVM function creates VirtualBox VM with a given disk attached to SATA controller.
+func createVirtualBoxVM(diskPath, name string) error {
+	Log.Infof("Create VirtualBox VM %s for %s.", name, diskPath)
+	createArgs := []string{"createvm", "--name", name, "--ostype", "Windows7", "--register"}
+	if VMGroup != "" {
+		createArgs = append(createArgs, "--groups", VMGroup)
+	}
+	commands := [][]string{
+		createArgs,
+		{"modifyvm", name, "--memory", "2048", "--vram", "128", "--nic1", "nat"},
+		{"storagectl", name, "--name", "SATA", "--add", "sata", "--controller", "IntelAhci"},
+		{"storageattach", name, "--storagectl", "SATA", "--port", "0", "--device", "0", "--type", "hdd",
+			"--medium", diskPath},
+	}
+	for _, cmdArgs := range commands {
+		if result, err := execCommand(vboxManageCmd, cmdArgs...).CombinedOutput(); err != nil {
+			Log.Error(string(result))
+			return err
+		}
+	}
+	return nil
+}
+
+// writeVmx function writes a minimal VMware .vmx file for a given disk. Network settings are added by
+// fixVmwareNetwork.
+func writeVmx(vmxPath, diskPath, name string) error {
+	settings := [][2]string{
+		{".encoding", "UTF-8"},
+		{"config.version", "8"},
+		{"virtualHW.version", "11"},
+		{"displayName", name},
+		{"guestOS", "windows7"},
+		{"memsize", "2048"},
+		{"numvcpus", "2"},
+		{"sata0.present", "TRUE"},
+		{"sata0:0.present", "TRUE"},
+		{"sata0:0.fileName", filepath.Base(diskPath)},
+	}
+	var content string
+	for _, setting := range settings {
+		content += fmt.Sprintf("%s = \"%s\"\n", setting[0], setting[1])
+	}
+	return ioutil.WriteFile(vmxPath, []byte(content), 0644)
+}
@@ -3,14 +3,21 @@
 package utils
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // JSONData represents data obtained by DownloadJson function.
@@ -29,6 +36,9 @@ type JSONData struct {
 				Name string `json:"name"`
 				URL  string `json:"url"`
 				Md5  string `json:"md5,omitempty"`
+				// Md5URL is an URL of md5 file which some catalogs provide in addition to inline md5 value.
+				Md5URL string `json:"md5Url,omitempty"`
+				Sha256 string `json:"sha256,omitempty"`
 			} `json:"files"`
 			OsVersion string `json:"osVersion"`
 			Version   string `json:"version"`
@@ -56,6 +66,16 @@ type VMImage struct {
 	FileURL string
 	// Instead of actual md5 sum value Microsoft provides an URL to a file which contains md5 value.
 	Md5URL string
+	// Md5 is set only if the catalog provides md5 sum value inline. Md5URL could be set too if the catalog provides
+	// both, see CrossCheckMd5.
+	Md5 string
+	// HashAlgo defines checksum algorithm used to verify the archive. MD5 is used if it is empty.
+	HashAlgo string
+	// Sha256 is sha256 sum value or an URL to a file which contains it.
+	Sha256 string
+	// Parts are set if VM archive is split into several files which are joined in order before unzip.
+	// In this case other fields describe the first part.
+	Parts []VMImage
 }
 
 // AvailableVM type represents VMs available for a given Spec.
@@ -68,77 +88,372 @@ type UserChoice struct {
 	DownloadPath string
 }
 
+// RunSummary type defines outcomes of a single run which are shown to a user at the end.
+type RunSummary struct {
+	UserChoice
+	// ArchivePath is a path to the downloaded VM archive or to an archive given by a user.
+	ArchivePath string
+	// Verified is true if a checksum of the archive was verified, archives given by a user aren't verified.
+	Verified bool
+	// UnzipFolder is a folder the archive was unzipped into, it is empty if the run didn't unzip anything.
+	UnzipFolder string
+	// VMPath is a path to the hypervisor specific VM file found after unzip.
+	VMPath string
+	// Installed is true if the VM was imported into the hypervisor or installed by an external installer.
+	Installed bool
+	// AlreadyImported is true if a VM with the same name existed in the hypervisor, so the import was skipped.
+	AlreadyImported bool
+	// Download is statistics of the download, all parts are summed up for split archives. It is empty if
+	// nothing was downloaded.
+	Download DownloadStats
+	// Err describes why a run didn't finish.
+	Err error
+}
+
 // DefaultChoice type defines a function type which is used to calculate default option index.
 type DefaultChoice func(choices Choice) int
 
+// archiveName method returns VM archive file name. For split archives it is the name of joined parts.
+func (vm VMImage) archiveName() string {
+	name := path.Base(vm.FileURL)
+	if len(vm.Parts) > 0 {
+		return partSuffixRe.ReplaceAllString(name, "")
+	}
+	return name
+}
+
+// hashAlgo method returns checksum algorithm used to verify VM archive.
+func (vm VMImage) hashAlgo() string {
+	if vm.HashAlgo == "" {
+		return "md5"
+	}
+	return vm.HashAlgo
+}
+
 // Implement Sort interface to make list of choices sortable.
 func (ch Choice) Len() int           { return len(ch) }
 func (ch Choice) Less(i, j int) bool { return ch[i] < ch[j] }
 func (ch Choice) Swap(i, j int)      { ch[i], ch[j] = ch[j], ch[i] }
 
-// DownloadJSON function downloads given page and extract JSON structure from it.
-func DownloadJSON(pageURL string) []byte {
-	fmt.Printf("Download JSON data from %s\n\n", pageURL)
-	resp, err := http.Get(pageURL)
+// Contains method checks if a given option is present in the list of choices.
+func (ch Choice) Contains(option string) bool {
+	for _, choice := range ch {
+		if choice == option {
+			return true
+		}
+	}
+	return false
+}
+
+// md5Re and sha256Re match checksum values provided inline in the catalog.
+var (
+	md5Re    = regexp.MustCompile("^[0-9a-fA-F]{32}$")
+	sha256Re = regexp.MustCompile("^[0-9a-fA-F]{64}$")
+)
+
+// partSuffixRe matches suffixes of split archive parts, e.g. .001 or .part1.
+var partSuffixRe = regexp.MustCompile(`\.(\d{3}|part\d+)$`)
+
+// vmsRe matches an assignment of VM catalog JSON embedded into a page. Spaces around = are optional because page
+// layout changes. The JSON itself is decoded, a regexp can't tell where it ends, e.g. strings in it could contain ';'.
+var vmsRe = regexp.MustCompile(`\bvms\s*=\s*`)
+
+// embeddedCatalog function returns VM catalog JSON object assigned to vms variable in a page. False is returned if
+// there is no such assignment or the assigned value isn't a JSON object.
+func embeddedCatalog(body []byte) ([]byte, bool) {
+	for _, loc := range vmsRe.FindAllIndex(body, -1) {
+		value := body[loc[1]:]
+		if !bytes.HasPrefix(value, []byte("{")) {
+			continue
+		}
+		var catalog json.RawMessage
+		if err := json.NewDecoder(bytes.NewReader(value)).Decode(&catalog); err != nil {
+			continue
+		}
+		return catalog, true
+	}
+	return nil, false
+}
+
+// fetchPage function downloads a whole page and returns its body and URL after redirects. httpGet retries failed
+// requests only, so the page is requested again with the same exponential backoff if reading its body fails,
+// e.g. when a connection is reset or stalls.
+func fetchPage(ctx context.Context, pageURL string) ([]byte, string, error) {
+	delay := RetryDelay
+	for attempt := 0; ; attempt++ {
+		resp, err := httpGet(ctx, pageURL)
+		if err != nil {
+			return nil, "", err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			return body, resp.Request.URL.String(), nil
+		}
+		if attempt >= MaxRetries || ctx.Err() != nil {
+			return nil, "", err
+		}
+		Log.Warnf("Reading %s failed: %s. Retry in %s.", pageURL, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// fetchJSON function downloads given page and extract JSON structure from it.
+func fetchJSON(pageURL string) ([]byte, error) {
+	body, finalURL, err := fetchPage(context.Background(), pageURL)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if err := checkSecureURL(finalURL); err != nil {
+		return nil, fmt.Errorf("%s redirected to insecure URL: %s", pageURL, err)
+	}
+
+	// NOTE: a mirror could serve the catalog as a plain JSON document instead of a page with embedded JSON.
+	if trimmed := bytes.TrimSpace(body); bytes.HasPrefix(trimmed, []byte("{")) {
+		return trimmed, nil
+	}
+	catalog, found := embeddedCatalog(body)
+	if !found {
+		return nil, catalogPageError(finalURL, body)
+	}
+	return catalog, nil
+}
+
+var (
+	// pageTitleRe matches HTML page title.
+	pageTitleRe = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	// consentTitleRe matches titles of pages which ask for a consent, a sign in or a captcha instead of showing
+	// content. Only titles are matched because ordinary pages have sign in links and cookie banners too.
+	consentTitleRe = regexp.MustCompile(`(?i)\b(consent|cookies|sign in|log ?in|captcha|access denied|attention required)\b`)
+	// consentFormRe matches forms and widgets which block a page until a user consents, signs in or solves
+	// a captcha.
+	consentFormRe = regexp.MustCompile(`(?i)<form[^>]+action="[^"]*(consent|login|signin|oauth2|captcha)[^"]*"|` +
+		`class="[^"]*\b(g-recaptcha|h-captcha|cf-challenge)\b`)
+)
+
+// catalogPageError function describes why VM catalog isn't found in a downloaded page. A page could be
+// replaced with a consent, sign in or error page, in this case its title is reported.
+func catalogPageError(pageURL string, body []byte) error {
+	title := ""
+	if match := pageTitleRe.FindSubmatch(body); len(match) > 1 {
+		title = strings.Join(strings.Fields(string(match[1])), " ")
+	}
+	if consentTitleRe.MatchString(title) || consentFormRe.Match(body) {
+		return fmt.Errorf("page %s asks for a consent or a sign in instead of VM catalog (title '%s'), "+
+			"open it in a browser or use -source-url with a mirror", pageURL, title)
 	}
-	defer resp.Body.Close()
+	if title != "" {
+		return fmt.Errorf("could not locate VM catalog in page %s (title '%s')", pageURL, title)
+	}
+	return fmt.Errorf("could not locate VM catalog in page %s", pageURL)
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
+// Insecure var allows to download VM catalog over plain HTTP, only HTTPS is allowed by default.
+var Insecure bool
+
+// CatalogSha256 var defines known-good SHA256 sum of VM catalog JSON, the catalog is rejected if its sum
+// differs. The sum isn't checked if it is empty.
+var CatalogSha256 string
+
+// checkSecureURL function checks that a given URL uses HTTPS unless Insecure is set.
+func checkSecureURL(rawURL string) error {
+	parsedURL, err := url.Parse(rawURL)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if !Insecure && !strings.EqualFold(parsedURL.Scheme, "https") {
+		return fmt.Errorf("%s isn't secure, use HTTPS URL or -insecure flag", rawURL)
+	}
+	return nil
+}
+
+// verifyCatalog function compares SHA256 sum of VM catalog JSON with CatalogSha256 if it is set.
+func verifyCatalog(rawData []byte) error {
+	if CatalogSha256 == "" {
+		return nil
+	}
+	sum := fmt.Sprintf("%x", sha256.Sum256(rawData))
+	if !strings.EqualFold(sum, CatalogSha256) {
+		return fmt.Errorf("VM catalog SHA256 sum %s doesn't match expected %s, it could be tampered with", sum, CatalogSha256)
+	}
+	Log.Debugf("VM catalog SHA256 sum %s matches", sum)
+	return nil
+}
+
+// DownloadJSON function downloads given page and extract JSON structure from it.
+// The page could be the Microsoft VMs page, a mirror of it or a plain JSON catalog.
+// Successfully downloaded JSON is cached locally unless DryRun is set, the cache is used if the page isn't available.
+func DownloadJSON(pageURL string) ([]byte, error) {
+	if Offline {
+		return loadCatalogCache()
 	}
 
-	re := regexp.MustCompile("vms = (.*?);")
-	return re.FindSubmatch(body)[1]
+	if err := checkSecureURL(pageURL); err != nil {
+		return nil, err
+	}
+	Log.Infof("Download JSON data from %s", pageURL)
+	rawData, err := fetchJSON(pageURL)
+	if err != nil {
+		Log.Warnf("Download failed: %s. Trying cached data.", err)
+		cachedData, cacheErr := loadCatalogCache()
+		if cacheErr != nil {
+			return nil, err
+		}
+		return cachedData, nil
+	}
+	// NOTE: a tampered catalog isn't replaced with cached data, it must be noticed.
+	if err := verifyCatalog(rawData); err != nil {
+		return nil, err
+	}
+	if DryRun {
+		return rawData, nil
+	}
+	if err := saveCatalogCache(pageURL, rawData); err != nil {
+		Log.Warnf("Can't cache VM catalog: %s", err)
+	}
+	return rawData, nil
 }
 
-// ParseJSON function parses extracted JSON into more convenient data structures.
+// ParseJSON function parses extracted JSON into more convenient data structures. An error is returned if
+// the JSON is malformed, e.g. a mirror serves a broken catalog.
 func ParseJSON(rawData *[]byte) (
-	platforms, hypervisors, browsers ChoiceGroups, availableVms AvailableVM) {
+	platforms, hypervisors, browsers ChoiceGroups, availableVms AvailableVM, err error) {
 	var data JSONData
 	if err := json.Unmarshal(*rawData, &data); err != nil {
-		panic(err)
+		return nil, nil, nil, nil, fmt.Errorf("VM catalog is malformed: %s", err)
 	}
 
 	seenPlatforms := make(map[string]bool)
+	// NOTE: the same hypervisor or browser could be listed several times, e.g. for different OSes, but each of
+	// them must be shown once in a menu. Keys are a group name and an option.
+	seenHypervisors := make(map[[2]string]bool)
+	seenBrowsers := make(map[[2]string]bool)
 	platforms = make(ChoiceGroups)
 	hypervisors = make(ChoiceGroups)
 	browsers = make(ChoiceGroups)
 	availableVms = make(AvailableVM)
 
 	for _, software := range data.SoftwareList {
+		// NOTE: Vagrant isn't a hypervisor but it is handled as one, its boxes are added with vagrant tool.
 		hypervisor := software.SoftwareName
-		if hypervisor == "Vagrant" {
-			// skip Vagrant because it isn't a hypervisor
-			continue
-		}
 
 		for _, platform := range software.OsList {
 			if !seenPlatforms[platform] {
 				seenPlatforms[platform] = true
 				platforms["All"] = append(platforms["All"], platform)
 			}
-			hypervisors[platform] = append(hypervisors[platform], hypervisor)
+			if key := [2]string{platform, hypervisor}; !seenHypervisors[key] {
+				seenHypervisors[key] = true
+				hypervisors[platform] = append(hypervisors[platform], hypervisor)
+			}
 		}
 
 		for _, browser := range software.Vms {
 			browserOs := strings.Join([]string{browser.BrowserName, browser.OsVersion}, " ")
-			browsers[hypervisor] = append(browsers[hypervisor], browserOs)
+			if key := [2]string{hypervisor, browserOs}; !seenBrowsers[key] {
+				seenBrowsers[key] = true
+				browsers[hypervisor] = append(browsers[hypervisor], browserOs)
+			}
+			var files []VMImage
 			for _, file := range browser.Files {
-				if file.Md5 != "" {
+				if file.Md5 != "" || file.Sha256 != "" {
 					vm := VMImage{FileURL: file.URL, Md5URL: file.Md5}
-					for _, p := range software.OsList {
-						spec := Spec{Platform: p, Hypervisor: hypervisor, BrowserOs: browserOs}
-						availableVms[spec] = vm
+					if md5Re.MatchString(file.Md5) {
+						vm = VMImage{FileURL: file.URL, Md5: file.Md5, Md5URL: file.Md5URL}
 					}
+					if file.Sha256 != "" {
+						// SHA-256 is preferred over MD5 when the catalog provides it.
+						vm.HashAlgo = "sha256"
+						vm.Sha256 = file.Sha256
+					}
+					files = append(files, vm)
 				}
 			}
+			if len(files) == 0 {
+				continue
+			}
+			vm := joinParts(files)
+			for _, p := range software.OsList {
+				spec := Spec{Platform: p, Hypervisor: hypervisor, BrowserOs: browserOs}
+				availableVms[spec] = vm
+			}
 		}
 	}
+	addDiskBasedChoices(hypervisors, browsers, availableVms)
+	for _, groups := range []ChoiceGroups{platforms, hypervisors, browsers} {
+		for _, choices := range groups {
+			sort.Sort(choices)
+		}
+	}
+
+	return platforms, hypervisors, browsers, availableVms, nil
+}
+
+// joinParts function returns a single VM image for files of the same VM. If all files are parts of a split archive
+// they are kept as parts of the image sorted by name, otherwise the last file is used.
+func joinParts(files []VMImage) VMImage {
+	if len(files) == 1 {
+		return files[0]
+	}
+	for _, file := range files {
+		if !partSuffixRe.MatchString(file.FileURL) {
+			return files[len(files)-1]
+		}
+	}
+	sort.Sort(vmParts(files))
+	vm := files[0]
+	vm.Parts = files
+	return vm
+}
+
+// vmParts type makes archive parts sortable by their numbers, so .001 goes before .002 and .part2 goes before
+// .part10.
+type vmParts []VMImage
+
+func (parts vmParts) Len() int { return len(parts) }
+func (parts vmParts) Less(i, j int) bool {
+	numI, numJ := partNumber(parts[i].FileURL), partNumber(parts[j].FileURL)
+	if numI != numJ {
+		return numI < numJ
+	}
+	return parts[i].FileURL < parts[j].FileURL
+}
+func (parts vmParts) Swap(i, j int) { parts[i], parts[j] = parts[j], parts[i] }
 
-	return platforms, hypervisors, browsers, availableVms
+// partNumber function returns a number of a split archive part from its suffix, e.g. 10 for .part10 or 1 for .001.
+func partNumber(fileURL string) int {
+	suffix := partSuffixRe.FindString(fileURL)
+	number, _ := strconv.Atoi(strings.TrimLeft(suffix, ".part"))
+	return number
+}
+
+// addDiskBasedChoices function offers QEMU, Proxmox and Xen hypervisors on Linux and Windows Sandbox on Windows.
+// Microsoft doesn't provide images for them but they could use disks from VirtualBox and Hyper-V images.
+func addDiskBasedChoices(hypervisors, browsers ChoiceGroups, availableVms AvailableVM) {
+	for _, hypervisor := range []string{"QEMU", "Proxmox", "Xen"} {
+		addDiskBasedChoice(hypervisors, browsers, availableVms, "Linux", "VirtualBox", hypervisor)
+	}
+	addDiskBasedChoice(hypervisors, browsers, availableVms, "Windows", "HyperV", "WindowsSandbox")
+}
+
+// addDiskBasedChoice function adds a hypervisor which uses VM images of a source hypervisor on a given platform.
+// If the catalog lists the hypervisor already, its own VMs aren't replaced.
+func addDiskBasedChoice(hypervisors, browsers ChoiceGroups, availableVms AvailableVM, platform, source, hypervisor string) {
+	if !hypervisors[platform].Contains(source) || hypervisors[platform].Contains(hypervisor) {
+		return
+	}
+	hypervisors[platform] = append(hypervisors[platform], hypervisor)
+	browsers[hypervisor] = append(Choice{}, browsers[source]...)
+	for spec, vm := range availableVms {
+		if spec.Platform == platform && spec.Hypervisor == source {
+			availableVms[Spec{Platform: platform, Hypervisor: hypervisor, BrowserOs: spec.BrowserOs}] = vm
+		}
+	}
 }
 
 // getDownloadPath function constructs default download path based on OS.
@@ -155,11 +470,12 @@ func getDownloadPath() string {
 	}
 }
 
-// getWorkingPath function returns current working path.
+// getWorkingPath function returns current working path or empty string if it can't be found, e.g. it was deleted.
 func getWorkingPath() string {
 	workingPath, err := os.Getwd()
 	if err != nil {
-		panic(err)
+		Log.Debugf("Can't get working path: %s", err)
+		return ""
 	}
 	return workingPath
 }
@@ -191,15 +507,51 @@ func GetDefaultPlatform(choices Choice) int {
 	return 0
 }
 
+// preferredHypervisors var defines hypervisors preferred on each platform in order of preference.
+// VirtualBox is available on all platforms so it is the fallback.
+var preferredHypervisors = map[string][]string{
+	"windows": {"HyperV", "VirtualBox"},
+	"darwin":  {"Parallels", "VirtualBox"},
+	"linux":   {"VirtualBox", "QEMU"},
+}
+
+// platformOS var maps platforms of the VM catalog to operating systems they are run on.
+var platformOS = map[string]string{
+	"Windows": "windows",
+	"Mac":     "darwin",
+	"Linux":   "linux",
+}
+
 // GetDefaultHypervisor function returns an index for default hypervisor from the hypervisors choices list.
-// VirtualBox is now default selection for all platforms but it could be platform specific in the future.
+// The default depends on the current platform and only offered hypervisors are considered. VirtualBox is used
+// if none of preferred hypervisors is offered, and the first choice if VirtualBox isn't offered too.
 func GetDefaultHypervisor(choices Choice) int {
-	for idx, hypervisor := range choices {
-		if hypervisor == "VirtualBox" {
-			return idx
+	return defaultHypervisor(runtime.GOOS, choices)
+}
+
+// DefaultHypervisorFor function returns a default choice function which works like GetDefaultHypervisor for
+// a given platform instead of the current one, e.g. to show defaults for another machine.
+func DefaultHypervisorFor(platform string) DefaultChoice {
+	goos, ok := platformOS[platform]
+	if !ok {
+		goos = runtime.GOOS
+	}
+	return func(choices Choice) int {
+		return defaultHypervisor(goos, choices)
+	}
+}
+
+// defaultHypervisor function returns an index of a hypervisor preferred on a given operating system.
+func defaultHypervisor(goos string, choices Choice) int {
+	preferred := append(preferredHypervisors[goos], "VirtualBox")
+	for _, hypervisor := range preferred {
+		for idx, choice := range choices {
+			if choice == hypervisor {
+				return idx
+			}
 		}
 	}
-	return 1
+	return 0
 }
 
 // GetDefaultBrowser function returns an index for default browser.
@@ -209,12 +561,13 @@ func GetDefaultBrowser(choices Choice) int {
 }
 
 // GetDefaultDownloadPath function returns an index for default download folder.
-// User's specific download folder is considered default for now.
+// User's specific download folder is considered default for now. The first folder is used if there is no
+// Downloads folder.
 func GetDefaultDownloadPath(choices Choice) int {
 	for idx, downloadPath := range choices {
 		if strings.Contains(downloadPath, "Downloads") {
 			return idx
 		}
 	}
-	return len(choices)
+	return 0
 }
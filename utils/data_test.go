@@ -0,0 +1,194 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestJoinPartsSortsByPartNumber(t *testing.T) {
+	tests := []struct {
+		name   string
+		suffix string
+	}{
+		{"part suffix", ".part%d"},
+		{"numeric suffix", ".%03d"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var files []VMImage
+			for _, number := range []int{10, 2, 1, 11, 3, 9, 4, 5, 6, 7, 8} {
+				files = append(files, VMImage{FileURL: fmt.Sprintf("https://example.com/IE11.zip"+test.suffix, number)})
+			}
+			vm := joinParts(files)
+			if len(vm.Parts) != len(files) {
+				t.Fatalf("got %d parts, want %d", len(vm.Parts), len(files))
+			}
+			for idx, part := range vm.Parts {
+				if want := fmt.Sprintf("https://example.com/IE11.zip"+test.suffix, idx+1); part.FileURL != want {
+					t.Errorf("part %d is %s, want %s", idx+1, part.FileURL, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCatalogPageError(t *testing.T) {
+	const chrome = `<header><a href="/signin">Sign in</a></header><div id="wcpConsentBanner">We use cookies. ` +
+		`<button>Accept all cookies</button></div>`
+	tests := []struct {
+		name        string
+		page        string
+		wantConsent bool
+	}{
+		{"ordinary page", `<html><head><title>Virtual Machines - Microsoft Edge Developer</title></head><body>` +
+			chrome + `<p>Access denied? Contact support.</p></body></html>`, false},
+		{"consent title", `<html><head><title>Before you continue</title></head><body><form ` +
+			`action="https://consent.example.com/save" method="post"></form></body></html>`, true},
+		{"sign in title", `<html><head><title>Sign in to your account</title></head><body></body></html>`, true},
+		{"login form", `<html><head><title>Microsoft</title></head><body><form method="post" ` +
+			`action="https://login.microsoftonline.com/common/oauth2/authorize"></form></body></html>`, true},
+		{"captcha", `<html><head><title>Just a moment...</title></head><body><div class="cf-challenge running">` +
+			`</div></body></html>`, true},
+		{"access denied title", `<html><head><title>Access Denied</title></head><body></body></html>`, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := catalogPageError("https://example.com/vms/", []byte(test.page))
+			if consent := strings.Contains(err.Error(), "asks for a consent"); consent != test.wantConsent {
+				t.Errorf("consent page %t, want %t: %s", consent, test.wantConsent, err)
+			}
+		})
+	}
+}
+
+func TestFetchJSONPageLayouts(t *testing.T) {
+	const catalog = `{"softwareList": [{"osList": ["Linux"], "softwareName": "VirtualBox", "vms": []}]}`
+	const catalogWithSemicolons = `{"softwareList": [{"osList": ["Linux"], "softwareName": "VirtualBox; 6.1", "vms": []}]}`
+	tests := []struct {
+		name    string
+		page    string
+		wantErr bool
+	}{
+		{"script variable", "<html><body><script>var vms = " + catalog + ";</script></body></html>", false},
+		{"no spaces", "<script>vms=" + catalog + ";</script>", false},
+		{"object property", "<script>window.vms =\n\t" + catalog + "\n;</script>", false},
+		{"several scripts", "<script>var lang = 'en';</script><script>var vms  =  " + catalog + "; init(vms);</script>", false},
+		{"plain JSON", catalog, false},
+		{"plain JSON with spaces", "\r\n  " + catalog + "\r\n", false},
+		{"other assignments first", "<script>numvms = 3; vms = loadVms(); var vms = " + catalog + ";</script>", false},
+		{"semicolons in strings", "<script>var vms = " + catalogWithSemicolons + "; init(vms);</script>", false},
+		{"no catalog", "<html><head><title>Virtual Machines</title></head><body></body></html>", true},
+		{"truncated catalog", "<html><head><title>Virtual Machines</title></head><script>var vms = {\"softwareList\": [", true},
+		{"not an object", "<script>var vms = loadVms();</script>", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, test.page)
+			}))
+			defer server.Close()
+			Insecure = true
+			defer func() { Insecure = false }()
+
+			got, err := fetchJSON(server.URL + "/vms/")
+			if (err != nil) != test.wantErr {
+				t.Fatalf("fetchJSON error = %v, want error %t", err, test.wantErr)
+			}
+			want := catalog
+			if strings.Contains(test.page, catalogWithSemicolons) {
+				want = catalogWithSemicolons
+			}
+			if !test.wantErr && string(got) != want {
+				t.Errorf("fetchJSON = %q, want %q", got, want)
+			}
+			if test.wantErr && !strings.Contains(err.Error(), "could not locate VM catalog") {
+				t.Errorf("fetchJSON error = %q, want missing catalog error", err)
+			}
+		})
+	}
+}
+
+func TestParseJSONInlineMd5(t *testing.T) {
+	rawData := []byte(`{"softwareList": [{"osList": ["Windows"], "softwareName": "HyperV", "vms": [
+		{"browserName": "IE11", "osVersion": "Win10", "files": [{"url": "https://example.com/IE11.zip",
+			"md5": "0123456789abcdef0123456789abcdef"}]},
+		{"browserName": "IE11", "osVersion": "Win81", "files": [{"url": "https://example.com/IE11.Win81.zip",
+			"md5": "https://example.com/IE11.Win81.zip.md5.txt"}]}]}]}`)
+	_, _, _, availableVms, err := ParseJSON(&rawData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		browserOs  string
+		wantMd5    string
+		wantMd5URL string
+	}{
+		{"IE11 Win10", "0123456789abcdef0123456789abcdef", ""},
+		{"IE11 Win81", "", "https://example.com/IE11.Win81.zip.md5.txt"},
+	}
+	for _, test := range tests {
+		vm := availableVms[Spec{Platform: "Windows", Hypervisor: "HyperV", BrowserOs: test.browserOs}]
+		if vm.Md5 != test.wantMd5 || vm.Md5URL != test.wantMd5URL {
+			t.Errorf("%s: got Md5 %q and Md5URL %q, want %q and %q", test.browserOs, vm.Md5, vm.Md5URL,
+				test.wantMd5, test.wantMd5URL)
+		}
+	}
+}
+
+func TestParseJSONDeduplicatesChoices(t *testing.T) {
+	const vm = `{"browserName": "%s", "osVersion": "%s", "files": [{"url": "https://example.com/%[1]s.zip",
+		"md5": "0123456789abcdef0123456789abcdef"}]}`
+	ie11, edge := fmt.Sprintf(vm, "IE11", "Win7"), fmt.Sprintf(vm, "MSEdge", "Win10")
+	rawData := []byte(`{"softwareList": [
+		{"osList": ["Windows", "Linux"], "softwareName": "VirtualBox", "vms": [` + ie11 + `, ` + edge + `, ` + ie11 + `]},
+		{"osList": ["Linux", "Mac", "Linux"], "softwareName": "VirtualBox", "vms": [` + edge + `]},
+		{"osList": ["Windows"], "softwareName": "HyperV", "vms": [` + edge + `]},
+		{"osList": ["Windows"], "softwareName": "HyperV", "vms": [` + edge + `]}]}`)
+	platforms, hypervisors, browsers, _, err := ParseJSON(&rawData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// NOTE: hypervisors which use disks of listed ones, e.g. QEMU, are added too and must be unique as well.
+	tests := []struct {
+		name   string
+		groups ChoiceGroups
+		group  string
+		want   Choice
+	}{
+		{"platforms", platforms, "All", Choice{"Linux", "Mac", "Windows"}},
+		{"Windows hypervisors", hypervisors, "Windows", Choice{"HyperV", "VirtualBox", "WindowsSandbox"}},
+		{"Linux hypervisors", hypervisors, "Linux", Choice{"Proxmox", "QEMU", "VirtualBox", "Xen"}},
+		{"VirtualBox browsers", browsers, "VirtualBox", Choice{"IE11 Win7", "MSEdge Win10"}},
+		{"HyperV browsers", browsers, "HyperV", Choice{"MSEdge Win10"}},
+	}
+	for _, test := range tests {
+		got := test.groups[test.group]
+		sort.Sort(got)
+		if strings.Join(got, "|") != strings.Join(test.want, "|") {
+			t.Errorf("%s = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDefaultHypervisorFor(t *testing.T) {
+	choices := Choice{"HyperV", "Parallels", "QEMU", "VirtualBox"}
+	tests := []struct {
+		platform string
+		want     string
+	}{
+		{"Windows", "HyperV"},
+		{"Mac", "Parallels"},
+		{"Linux", "VirtualBox"},
+	}
+	for _, test := range tests {
+		t.Run(test.platform, func(t *testing.T) {
+			if got := choices[DefaultHypervisorFor(test.platform)(choices)]; got != test.want {
+				t.Errorf("default hypervisor = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+// Package utils contains various supplementary functions and data structures.
+// This file disk_other.go contains disk functions for non-Windows platforms.
+package utils
+
+import "syscall"
+
+// freeSpace function returns free space in bytes available for a user on a filesystem of a given path.
+func freeSpace(diskPath string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(diskPath, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
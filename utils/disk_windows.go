@@ -0,0 +1,28 @@
+// Package utils contains various supplementary functions and data structures.
+// This file disk_windows.go contains Windows specific disk functions.
+package utils
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// freeSpace function returns free space in bytes available for a user on a disk of a given path.
+func freeSpace(diskPath string) (int64, error) {
+	pathPtr, err := syscall.UTF16PtrFromString(diskPath)
+	if err != nil {
+		return 0, err
+	}
+	var freeBytes, totalBytes, totalFreeBytes int64
+	getDiskFreeSpaceEx := syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+	result, _, err := getDiskFreeSpaceEx.Call(
+		uintptr(unsafe.Pointer(pathPtr)),
+		uintptr(unsafe.Pointer(&freeBytes)),
+		uintptr(unsafe.Pointer(&totalBytes)),
+		uintptr(unsafe.Pointer(&totalFreeBytes)),
+	)
+	if result == 0 {
+		return 0, err
+	}
+	return freeBytes, nil
+}
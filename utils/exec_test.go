@@ -0,0 +1,464 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeCommand type defines output and exit code of a simulated hypervisor tool.
+type fakeCommand struct {
+	output   string
+	exitCode int
+}
+
+// commandLine function formats a command as it is matched by stubCommands, the command name is used without
+// folder and extension, e.g. vboxmanage for C:\Program Files\Oracle\VirtualBox\VBoxManage.exe.
+func commandLine(name string, args ...string) string {
+	base := strings.ToLower(filepath.Base(name))
+	return strings.Join(append([]string{strings.TrimSuffix(base, ".exe")}, args...), " ")
+}
+
+// stubCommands function replaces execCommand with simulated tools until the test ends. A command gets a result
+// of the longest matching command line prefix, commands without a match fail with exit code 127. Command lines of
+// all run commands are returned in order.
+func stubCommands(t *testing.T, commands map[string]fakeCommand) func() []string {
+	t.Helper()
+	var mutex sync.Mutex
+	var calls []string
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		line := commandLine(name, args...)
+		mutex.Lock()
+		calls = append(calls, line)
+		mutex.Unlock()
+
+		result, matched := fakeCommand{output: line + ": command not found", exitCode: 127}, ""
+		for prefix, command := range commands {
+			if strings.HasPrefix(line, prefix) && len(prefix) >= len(matched) {
+				result, matched = command, prefix
+			}
+		}
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$")
+		cmd.Env = append(os.Environ(), "GETIE_HELPER_PROCESS=1", "GETIE_HELPER_OUTPUT="+result.output,
+			"GETIE_HELPER_EXIT="+strconv.Itoa(result.exitCode))
+		return cmd
+	}
+	t.Cleanup(func() { execCommand = exec.Command })
+	return func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string(nil), calls...)
+	}
+}
+
+// TestHelperProcess isn't a real test, it is run by commands stubbed with stubCommands and prints the simulated
+// output. Environment variables in the output are expanded, e.g. $GETIE_VM_PATH.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GETIE_HELPER_PROCESS") != "1" {
+		return
+	}
+	fmt.Fprint(os.Stdout, os.ExpandEnv(os.Getenv("GETIE_HELPER_OUTPUT")))
+	code, _ := strconv.Atoi(os.Getenv("GETIE_HELPER_EXIT"))
+	os.Exit(code)
+}
+
+func TestCheckVirtualBox(t *testing.T) {
+	tests := []struct {
+		name        string
+		command     fakeCommand
+		wantVersion string
+		wantErr     bool
+	}{
+		{"installed", fakeCommand{output: "7.0.10r158379\n"}, "7.0.10r158379", false},
+		{"broken", fakeCommand{output: "VBoxManage: error: kernel driver not installed", exitCode: 1}, "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stubCommands(t, map[string]fakeCommand{"vboxmanage --version": test.command})
+			version, err := checkVirtualBox(Log)
+			if version != test.wantVersion || (err != nil) != test.wantErr {
+				t.Errorf("got %q, %v, want %q, error %t", version, err, test.wantVersion, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestImportVMVirtualBox(t *testing.T) {
+	vmPath := filepath.Join("downloads", "IE11 - Win7", "IE11 - Win7.ova")
+	importLine := commandLine("vboxmanage", "import", vmPath, "--vsys", "0", "--vmname", "IE11-Win7-VBox")
+	tests := []struct {
+		name      string
+		commands  map[string]fakeCommand
+		wantErr   error
+		wantCalls []string
+	}{
+		{
+			name: "imported",
+			commands: map[string]fakeCommand{
+				"vboxmanage --version": {output: "7.0.10"},
+				"vboxmanage list vms":  {output: "\"Other VM\" {0ba5d6e1-0000-0000-0000-000000000000}\n"},
+				"vboxmanage import":    {output: "Successfully imported the appliance."},
+			},
+			wantCalls: []string{"vboxmanage --version", "vboxmanage list vms", importLine},
+		},
+		{
+			name: "already imported",
+			commands: map[string]fakeCommand{
+				"vboxmanage --version": {output: "7.0.10"},
+				"vboxmanage list vms":  {output: "\"IE11-Win7-VBox\" {0ba5d6e1-0000-0000-0000-000000000000}\n"},
+			},
+			wantErr:   errAlreadyImported,
+			wantCalls: []string{"vboxmanage --version", "vboxmanage list vms"},
+		},
+		{
+			name:      "not installed",
+			commands:  map[string]fakeCommand{},
+			wantErr:   fmt.Errorf("exit status 127"),
+			wantCalls: []string{"vboxmanage --version"},
+		},
+		{
+			name: "import failed",
+			commands: map[string]fakeCommand{
+				"vboxmanage --version": {output: "7.0.10"},
+				"vboxmanage list vms":  {},
+				"vboxmanage import":    {output: "VBoxManage: error: Appliance read failed", exitCode: 1},
+			},
+			wantErr:   fmt.Errorf("exit status 1"),
+			wantCalls: []string{"vboxmanage --version", "vboxmanage list vms", importLine},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := stubCommands(t, test.commands)
+			err := importVM("VirtualBox", vmPath, "IE11-Win7-VBox")
+			if fmt.Sprint(err) != fmt.Sprint(test.wantErr) {
+				t.Errorf("error = %v, want %v", err, test.wantErr)
+			}
+			if got := calls(); strings.Join(got, "\n") != strings.Join(test.wantCalls, "\n") {
+				t.Errorf("commands:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(test.wantCalls, "\n"))
+			}
+		})
+	}
+}
+
+func TestImportProxmoxVMAttachesImportedVolume(t *testing.T) {
+	diskPath := filepath.Join("downloads", "IE11 - Win7", "IE11 - Win7-disk1.vmdk")
+	tests := []struct {
+		name       string
+		output     string
+		wantVolume string
+	}{
+		{"lvm storage", "Successfully imported disk as 'unused0:local-lvm:vm-105-disk-0'\n", "local-lvm:vm-105-disk-0"},
+		{"directory storage", "transferred 40.0 GiB of 40.0 GiB (100.00%)\nSuccessfully imported disk as " +
+			"'unused0:local:105/vm-105-disk-0.raw'\n", "local:105/vm-105-disk-0.raw"},
+		{"newer output", "unused0: successfully imported disk 'nfs:105/vm-105-disk-1.qcow2'\n", "nfs:105/vm-105-disk-1.qcow2"},
+		{"unknown output", "done\n", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := stubCommands(t, map[string]fakeCommand{
+				"pvesh get /cluster/nextid": {output: "\"105\"\n"},
+				"qm create":                 {},
+				"qm importdisk":             {output: test.output},
+				"qm set":                    {},
+			})
+			err := importProxmoxVM(diskPath, "IE11 - Win7")
+			if test.wantVolume == "" {
+				if err == nil {
+					t.Error("unknown qm importdisk output is accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("importProxmoxVM: %s", err)
+			}
+			got := calls()
+			want := commandLine("qm", "set", "105", "--sata0", test.wantVolume, "--boot", "order=sata0")
+			if last := got[len(got)-1]; last != want {
+				t.Errorf("last command is %q, want %q", last, want)
+			}
+		})
+	}
+}
+
+func TestImportXenVM(t *testing.T) {
+	folder := t.TempDir()
+	defer func(configPath string) { XenConfigPath = configPath }(XenConfigPath)
+	XenConfigPath = t.TempDir()
+	diskPath := filepath.Join(folder, "IE11 - Win7-disk1.vmdk")
+	qcowPath := filepath.Join(folder, "IE11 - Win7-disk1.qcow2")
+	calls := stubCommands(t, map[string]fakeCommand{
+		"xl info":              {output: "host : dom0\nxen_version : 4.17.3\nxen_caps : hvm-3.0-x86_64\n"},
+		"qemu-img --version":   {output: "qemu-img version 8.2.0\n"},
+		"qemu-img convert":     {},
+		"xl destroy ie11-win7": {output: "invalid domain identifier", exitCode: 1},
+	})
+
+	if version, err := checkXen(Log); err != nil || version != "Xen 4.17.3" {
+		t.Fatalf("checkXen = %q, %v, want Xen 4.17.3", version, err)
+	}
+	if err := importVM("Xen", diskPath, "IE11 - Win7"); err != nil {
+		t.Fatalf("importVM: %s", err)
+	}
+	if got := calls(); got[len(got)-1] != commandLine("qemu-img", "convert", "-O", "qcow2", diskPath, qcowPath) {
+		t.Errorf("disk isn't converted, commands: %q", got)
+	}
+	configPath := filepath.Join(XenConfigPath, "ie11-win7.cfg")
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"name = \"ie11-win7\"", "type = \"hvm\"", "target=" + qcowPath + "\""} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("config doesn't contain %q:\n%s", want, content)
+		}
+	}
+	if err := importVM("Xen", diskPath, "IE11 - Win7"); err != errAlreadyImported {
+		t.Errorf("second import error = %v, want %v", err, errAlreadyImported)
+	}
+
+	vm := ImportedVM{Hypervisor: "Xen", Name: "IE11 - Win7", Path: diskPath}
+	if exists, err := vmExists(vm); !exists || err != nil {
+		t.Errorf("vmExists = %t, %v, want true", exists, err)
+	}
+	if err := ioutil.WriteFile(qcowPath, []byte("qcow"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeVM(vm); err != nil {
+		t.Fatalf("removeVM: %s", err)
+	}
+	for _, removed := range []string{configPath, qcowPath} {
+		if _, err := os.Stat(removed); !os.IsNotExist(err) {
+			t.Errorf("%s isn't removed", removed)
+		}
+	}
+}
+
+func TestHypervLaunched(t *testing.T) {
+	const (
+		bcdedit  = "bcdedit /enum {current}"
+		feature  = "powershell -NoProfile -NonInteractive -Command (Get-WindowsOptionalFeature"
+		present  = "powershell -NoProfile -NonInteractive -Command (Get-CimInstance"
+		denied   = "The boot configuration data store could not be opened.\nAccess is denied."
+		bootData = "Windows Boot Loader\n-------------------\nidentifier              {current}\n"
+	)
+	tests := []struct {
+		name     string
+		commands map[string]fakeCommand
+		want     bool
+		wantErr  bool
+	}{
+		{
+			name: "launch type auto",
+			commands: map[string]fakeCommand{bcdedit: {output: bootData + "hypervisorlaunchtype    Auto\n"},
+				present: {output: "False\n"}},
+			want: true,
+		},
+		{
+			name: "launch type off in a guest",
+			commands: map[string]fakeCommand{bcdedit: {output: bootData + "hypervisorlaunchtype    Off\n"},
+				present: {output: "True\n"}},
+			want: false,
+		},
+		{
+			name:     "no launch type",
+			commands: map[string]fakeCommand{bcdedit: {output: bootData}, present: {output: "True\n"}},
+			want:     false,
+		},
+		{
+			name: "feature enabled",
+			commands: map[string]fakeCommand{bcdedit: {output: denied, exitCode: 1}, feature: {output: "Enabled\n"},
+				present: {output: "False\n"}},
+			want: true,
+		},
+		{
+			name: "feature disabled in a guest",
+			commands: map[string]fakeCommand{bcdedit: {output: denied, exitCode: 1}, feature: {output: "Disabled\n"},
+				present: {output: "True\n"}},
+			want: false,
+		},
+		{
+			name: "hypervisor present fallback",
+			commands: map[string]fakeCommand{bcdedit: {output: denied, exitCode: 1}, feature: {exitCode: 1},
+				present: {output: "True\n"}},
+			want: true,
+		},
+		{
+			name:     "nothing works",
+			commands: map[string]fakeCommand{},
+			wantErr:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stubCommands(t, test.commands)
+			got, err := hypervLaunched()
+			if got != test.want || (err != nil) != test.wantErr {
+				t.Errorf("got %t, %v, want %t, error %t", got, err, test.want, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckHypervisorsIsQuiet(t *testing.T) {
+	stubCommands(t, map[string]fakeCommand{"vboxmanage --version": {output: "7.0.10r158379\n"}})
+	var out bytes.Buffer
+	Console, ErrConsole = &out, &out
+	defer func() { Console, ErrConsole = ioutil.Discard, ioutil.Discard }()
+
+	statuses := CheckHypervisors()
+	if out.Len() > 0 {
+		t.Errorf("checks wrote messages:\n%s", out.String())
+	}
+	if Log.Level != LevelInfo {
+		t.Errorf("log level is changed to %d", Log.Level)
+	}
+	for _, status := range statuses {
+		if status.Hypervisor == "VirtualBox" && (status.Err != nil || status.Version != "7.0.10r158379") {
+			t.Errorf("VirtualBox status is %+v", status)
+		}
+	}
+	Log.Info("message")
+	if out.Len() == 0 {
+		t.Error("messages aren't written after the checks")
+	}
+}
+
+func TestCheckHyperv(t *testing.T) {
+	const version = "powershell -NoProfile -NonInteractive -Command (Get-Item"
+	tests := []struct {
+		name        string
+		commands    map[string]fakeCommand
+		wantVersion string
+	}{
+		{
+			name: "installed",
+			commands: map[string]fakeCommand{"powershell -Command Get-Host": {}, "powershell -Command Get-Command": {},
+				version: {output: "10.0.19041.3636\r\n"}},
+			wantVersion: "Hyper-V 10.0.19041.3636",
+		},
+		{
+			name: "service missing",
+			commands: map[string]fakeCommand{"powershell -Command Get-Host": {}, "powershell -Command Get-Command": {},
+				version: {output: "Get-Item : Cannot find path", exitCode: 1}},
+		},
+		{
+			name:     "cmdlets missing",
+			commands: map[string]fakeCommand{"powershell -Command Get-Host": {}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stubCommands(t, test.commands)
+			got, err := checkHyperv(quietLog)
+			if got != test.wantVersion || (err != nil) != (test.wantVersion == "") {
+				t.Errorf("got %q, %v, want %q", got, err, test.wantVersion)
+			}
+		})
+	}
+}
+
+func TestRunInstaller(t *testing.T) {
+	uc := UserChoice{Spec: Spec{Platform: "Linux", Hypervisor: "VirtualBox", BrowserOs: "IE11 Win7"}}
+	vmPath := filepath.Join("downloads", "IE11", "IE11.ova")
+	tests := []struct {
+		name       string
+		template   string
+		wantCall   string
+		wantOutput string
+		wantErr    bool
+	}{
+		{"placeholders", "packer build -var vm={path} -var type={hypervisor} -var name={name} ie.json",
+			"packer build -var vm=" + vmPath + " -var type=VirtualBox -var name=IE11 Win7 ie.json", "packer done", false},
+		{"environment", "provision-vm", "provision-vm", vmPath + "|VirtualBox|IE11 Win7", false},
+		{"failed installer", "broken-installer {path}", "broken-installer " + vmPath, "can't provision", true},
+		{"empty template", "  ", "", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := stubCommands(t, map[string]fakeCommand{
+				"packer":           {output: "packer done"},
+				"provision-vm":     {output: "$GETIE_VM_PATH|$GETIE_HYPERVISOR|$GETIE_VM_NAME"},
+				"broken-installer": {output: "can't provision", exitCode: 1},
+			})
+			console := captureConsole(t)
+			err := RunInstaller(test.template, uc, vmPath)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("RunInstaller error = %v, want error %t", err, test.wantErr)
+			}
+			var wantCalls []string
+			if test.wantCall != "" {
+				wantCalls = []string{test.wantCall}
+			}
+			if got := calls(); strings.Join(got, "\n") != strings.Join(wantCalls, "\n") {
+				t.Errorf("calls = %q, want %q", got, wantCalls)
+			}
+			if !strings.Contains(console.String(), test.wantOutput) {
+				t.Errorf("installer output %q doesn't contain %q", console.String(), test.wantOutput)
+			}
+		})
+	}
+}
+
+func TestImportHypervVMPathWithSpaces(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "My Downloads", "IE11 - Win10 (Bob's)")
+	configPath := filepath.Join(root, "Virtual Machines", "ABC $x.xml")
+	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(configPath, []byte("<configuration/>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wantCall := "powershell -NoProfile -NonInteractive -Command Import-VM -Path '" +
+		strings.Replace(configPath, "'", "''", -1) + "' | Rename-VM -NewName 'IE11 Win10'"
+	tests := []struct {
+		name     string
+		vmPath   string
+		wantCall string
+		wantErr  bool
+	}{
+		{"export folder", root, wantCall, false},
+		{"config file", configPath, wantCall, false},
+		{"folder without config", t.TempDir(), "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := stubCommands(t, map[string]fakeCommand{"powershell": {}})
+			err := importHypervVM(test.vmPath, "IE11 Win10")
+			if (err != nil) != test.wantErr {
+				t.Fatalf("importHypervVM error = %v, want error %t", err, test.wantErr)
+			}
+			var wantCalls []string
+			if test.wantCall != "" {
+				wantCalls = []string{test.wantCall}
+			}
+			if got := calls(); strings.Join(got, "\n") != strings.Join(wantCalls, "\n") {
+				t.Errorf("calls = %q, want %q", got, wantCalls)
+			}
+		})
+	}
+}
+
+func TestPsQuote(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{`C:\Users\Bob\Downloads\IE11`, `'C:\Users\Bob\Downloads\IE11'`},
+		{`C:\My Downloads\IE11 - Win10`, `'C:\My Downloads\IE11 - Win10'`},
+		{`C:\Bob's VMs`, `'C:\Bob''s VMs'`},
+		{"C:\\$env:TEMP\\`n", "'C:\\$env:TEMP\\`n'"},
+	}
+	for _, test := range tests {
+		if got := psQuote(test.value); got != test.want {
+			t.Errorf("psQuote(%q) = %s, want %s", test.value, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Package utils contains various supplementary functions and data structures.
+// This file extract.go contains functions to select VM archive entries required by a hypervisor.
+package utils
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// MinimalExtract var makes UnzipVM unpack only files required to import a VM into a selected hypervisor.
+var MinimalExtract = false
+
+// ovfReferences function returns names of files referenced by a given .ovf archive entry.
+func ovfReferences(ovf *zip.File) ([]string, error) {
+	reader, err := ovf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	envelope, err := parseOvf(content)
+	if err != nil {
+		return nil, err
+	}
+	var references []string
+	for _, file := range envelope.Files {
+		references = append(references, file.Href)
+	}
+	return references, nil
+}
+
+// requiredFiles function selects archive entries required by a given hypervisor: the VM entry point file and files
+// it depends on. All entries are returned for hypervisors which need a whole exported folder.
+func requiredFiles(hypervisor string, files []*zip.File) ([]*zip.File, error) {
+	var entry *zip.File
+	for _, extension := range vmFileExtensions(hypervisor) {
+		for _, file := range files {
+			if strings.HasSuffix(file.Name, extension) {
+				entry = file
+				break
+			}
+		}
+		if entry != nil {
+			break
+		}
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("Didn't find VM file for %s in the archive", hypervisor)
+	}
+
+	required := map[string]bool{entry.Name: true}
+	switch hypervisor {
+	case "VMware":
+		// NOTE: .ovf descriptor references disks and other files, .mf manifest is kept to verify them.
+		references, err := ovfReferences(entry)
+		if err != nil {
+			return nil, err
+		}
+		folder := path.Dir(entry.Name)
+		for _, reference := range references {
+			required[path.Join(folder, reference)] = true
+		}
+		required[strings.TrimSuffix(entry.Name, ".ovf")+".mf"] = true
+	case "HyperV", "Parallels":
+		// Hyper-V export and Parallels .pvm bundle are folders which are imported as a whole.
+		return files, nil
+	}
+
+	var selected []*zip.File
+	for _, file := range files {
+		if required[file.Name] {
+			selected = append(selected, file)
+		} else {
+			Log.Debugf("Skip '%s' which isn't required for %s", file.Name, hypervisor)
+		}
+	}
+	return selected, nil
+}
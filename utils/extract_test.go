@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestRequiredFilesVMware(t *testing.T) {
+	const ovf = `<?xml version="1.0" encoding="UTF-8"?>
+<Envelope xmlns="http://schemas.dmtf.org/ovf/envelope/1" xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/1">
+  <References>
+    <File ovf:href="IE11 - Win7-disk1.vmdk" ovf:id="file1" ovf:size="4"/>
+  </References>
+  <AnnotationSection>
+    <Info>See <a href="readme.txt">readme</a> for details.</Info>
+  </AnnotationSection>
+</Envelope>`
+	archive := newTestZip(t, map[string]string{
+		"IE11 - Win7/IE11 - Win7.ovf":        ovf,
+		"IE11 - Win7/IE11 - Win7.mf":         "SHA1(IE11 - Win7-disk1.vmdk)= 00",
+		"IE11 - Win7/IE11 - Win7-disk1.vmdk": "disk",
+		"IE11 - Win7/readme.txt":             "readme",
+		"IE11 - Win7/IE11 - Win7.ova":        "ova",
+	})
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := requiredFiles("VMware", reader.File)
+	if err != nil {
+		t.Fatalf("requiredFiles: %s", err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	sort.Strings(names)
+	want := []string{"IE11 - Win7/IE11 - Win7-disk1.vmdk", "IE11 - Win7/IE11 - Win7.mf", "IE11 - Win7/IE11 - Win7.ovf"}
+	if strings.Join(names, "|") != strings.Join(want, "|") {
+		t.Errorf("got %q, want %q", names, want)
+	}
+}
@@ -0,0 +1,140 @@
+// Package utils contains various supplementary functions and data structures.
+// This file history.go contains functions to keep a log of all downloads and installs.
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// HistoryEntry type defines an outcome of a single download or install stored in the history manifest.
+type HistoryEntry struct {
+	Time        time.Time `json:"time"`
+	Platform    string    `json:"platform"`
+	Hypervisor  string    `json:"hypervisor"`
+	BrowserOs   string    `json:"browserOs"`
+	ArchivePath string    `json:"archivePath,omitempty"`
+	HashAlgo    string    `json:"hashAlgo,omitempty"`
+	Checksum    string    `json:"checksum,omitempty"`
+	UnzipFolder string    `json:"unzipFolder,omitempty"`
+	VMName      string    `json:"vmName,omitempty"`
+	// Status is downloaded, installed or failed.
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// historyMutex guards the history manifest, batch downloads record their outcomes concurrently.
+var historyMutex sync.Mutex
+
+// historyPath function returns a path to the history manifest.
+func historyPath() string {
+	return pathJoin(getConfigPath(), "history.json")
+}
+
+// LoadHistory function loads all history entries, the oldest one goes first. Empty history is returned if
+// nothing was recorded yet.
+func LoadHistory() ([]HistoryEntry, error) {
+	var entries []HistoryEntry
+	content, err := ioutil.ReadFile(historyPath())
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(content, &entries)
+	return entries, err
+}
+
+// addHistory function appends an entry to the history manifest. Failures are only logged, because the history
+// must not break downloads and installs.
+func addHistory(entry HistoryEntry) {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	entries, err := LoadHistory()
+	if err != nil {
+		Log.Warnf("Can't load history %s: %s", historyPath(), err)
+		return
+	}
+	entries = append(entries, entry)
+	if err := os.MkdirAll(getConfigPath(), 0755); err != nil {
+		Log.Warnf("Can't save history: %s", err)
+		return
+	}
+	content, err := json.MarshalIndent(entries, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(historyPath(), content, 0644)
+	}
+	if err != nil {
+		Log.Warnf("Can't save history: %s", err)
+	}
+}
+
+// recordRun function adds outcomes of a run to the history manifest.
+func recordRun(summary RunSummary, vmName string) {
+	result := newSummaryJSON(summary)
+	entry := HistoryEntry{
+		Time:        time.Now(),
+		Platform:    summary.Platform,
+		Hypervisor:  summary.Hypervisor,
+		BrowserOs:   summary.BrowserOs,
+		ArchivePath: summary.ArchivePath,
+		HashAlgo:    result.HashAlgo,
+		Checksum:    result.Checksum,
+		UnzipFolder: result.UnzipFolder,
+		VMName:      vmName,
+		Status:      "installed",
+	}
+	switch {
+	case summary.Err != nil:
+		entry.Status, entry.Error = "failed", summary.Err.Error()
+	case !summary.Installed && !summary.AlreadyImported:
+		entry.Status = "downloaded"
+	}
+	addHistory(entry)
+}
+
+// recordBatchResult function adds an outcome of a batch download to the history manifest.
+func recordBatchResult(result BatchResult, algo string) {
+	entry := HistoryEntry{
+		Time:        time.Now(),
+		Platform:    result.Platform,
+		Hypervisor:  result.Hypervisor,
+		BrowserOs:   result.BrowserOs,
+		ArchivePath: result.File,
+		HashAlgo:    algo,
+		Status:      "downloaded",
+	}
+	if result.Err != nil {
+		entry.Status, entry.Error = "failed", result.Err.Error()
+	} else {
+		entry.Checksum = loadChecksumCache(result.File, algo)
+	}
+	addHistory(entry)
+}
+
+// ShowHistory function prints all recorded downloads and installs as a table.
+func ShowHistory(entries []HistoryEntry, dst io.Writer) {
+	if len(entries) == 0 {
+		fmt.Fprintln(dst, "Nothing was downloaded or installed yet.")
+		return
+	}
+	writer := tabwriter.NewWriter(dst, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "TIME\tSTATUS\tPLATFORM\tHYPERVISOR\tBROWSER AND OS\tVM NAME\tARCHIVE")
+	for _, entry := range entries {
+		vmName := entry.VMName
+		if vmName == "" {
+			vmName = "-"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", entry.Time.Format("2006-01-02 15:04"), entry.Status,
+			entry.Platform, entry.Hypervisor, entry.BrowserOs, vmName, entry.ArchivePath)
+	}
+	writer.Flush()
+}
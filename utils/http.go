@@ -0,0 +1,263 @@
+// Package utils contains various supplementary functions and data structures.
+// This file http.go contains HTTP client shared by all outbound requests.
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptrace"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timeout var defines how long a connection could stall before a request fails. It limits connecting, waiting for
+// response headers and every single read of a response body, so large downloads aren't limited as a whole.
+// Zero means no timeout. It must be set before the first request.
+var Timeout = 30 * time.Second
+
+// MaxRetries var defines how many times a failed request is retried. Only connection errors and 5xx responses
+// are retried, other HTTP errors like 404 are fatal.
+var MaxRetries = 3
+
+// RetryDelay var defines delay before the first retry. Each next retry waits twice longer.
+var RetryDelay = time.Second
+
+// UserAgent var defines User-Agent header sent with all requests. It names the tool, see ToolUserAgent, a browser
+// one could be set if a server rejects it.
+var UserAgent = ToolUserAgent("")
+
+// ToolUserAgent function returns User-Agent which names the tool, its build revision and its home page.
+func ToolUserAgent(rev string) string {
+	if rev == "" {
+		return "getIE (+https://github.com/artemdevel/getIE)"
+	}
+	return fmt.Sprintf("getIE/%s (+https://github.com/artemdevel/getIE)", rev)
+}
+
+// ExtraHeaders var defines headers added to all requests, e.g. required by a corporate proxy.
+var ExtraHeaders = make(map[string]string)
+
+// ParseHeader function parses a header given as 'Name: value'.
+func ParseHeader(header string) (string, string, error) {
+	parts := strings.SplitN(header, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return "", "", fmt.Errorf("header '%s' must be in 'Name: value' form", header)
+	}
+	name := strings.TrimSpace(parts[0])
+	if strings.ContainsAny(name, " \t") {
+		return "", "", fmt.Errorf("header name '%s' must not contain spaces", name)
+	}
+	return http.CanonicalHeaderKey(name), strings.TrimSpace(parts[1]), nil
+}
+
+// Trace var enables logging of DNS, connect, TLS handshake and first byte timings of every request together with
+// response headers. Messages are logged at debug level.
+var Trace bool
+
+// maxRedirects const defines how many redirects a single request could follow.
+const maxRedirects = 10
+
+var (
+	sharedClient     *http.Client
+	sharedClientOnce sync.Once
+	// proxyFunc uses environment proxy settings like HTTP_PROXY unless SetProxy is called.
+	proxyFunc = http.ProxyFromEnvironment
+)
+
+// SetProxy function configures a proxy server used for all outbound requests. It must be called before the
+// first request.
+func SetProxy(proxyURL string) error {
+	parsedURL, err := url.Parse(proxyURL)
+	if err != nil {
+		return err
+	}
+	if parsedURL.Scheme == "" || parsedURL.Host == "" {
+		return fmt.Errorf("proxy URL '%s' must contain scheme and host, e.g. http://proxy:3128", proxyURL)
+	}
+	proxyFunc = http.ProxyURL(parsedURL)
+	return nil
+}
+
+// checkRedirect function follows up to maxRedirects redirects and keeps User-Agent header of the original request.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	Log.Debugf("Redirect from %s to %s", via[len(via)-1].URL, req.URL)
+	req.Header.Set("User-Agent", via[0].Header.Get("User-Agent"))
+	return nil
+}
+
+// httpClient function returns HTTP client shared by all requests. Cookies are kept between requests, because
+// some pages set a cookie and redirect back to themselves.
+func httpClient() *http.Client {
+	sharedClientOnce.Do(func() {
+		dialer := &net.Dialer{Timeout: Timeout, KeepAlive: 30 * time.Second}
+		// NOTE: cookiejar.New never fails without options.
+		jar, _ := cookiejar.New(nil)
+		sharedClient = &http.Client{
+			CheckRedirect: checkRedirect,
+			Jar:           jar,
+			Transport: &http.Transport{
+				Proxy:                 proxyFunc,
+				Dial:                  dialer.Dial,
+				TLSHandshakeTimeout:   Timeout,
+				ResponseHeaderTimeout: Timeout,
+			},
+		}
+	})
+	return sharedClient
+}
+
+// timeoutBody type closes response body if a single read takes longer than a given timeout.
+type timeoutBody struct {
+	io.ReadCloser
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (tb *timeoutBody) Read(p []byte) (int, error) {
+	tb.timer.Reset(tb.timeout)
+	n, err := tb.ReadCloser.Read(p)
+	tb.timer.Stop()
+	return n, err
+}
+
+func (tb *timeoutBody) Close() error {
+	tb.timer.Stop()
+	return tb.ReadCloser.Close()
+}
+
+// traceRequest function returns a context which logs timings of a request to a given URL if Trace is set.
+func traceRequest(ctx context.Context, reqURL string) context.Context {
+	if !Trace {
+		return ctx
+	}
+	start := time.Now()
+	since := func() time.Duration {
+		return time.Since(start).Round(time.Millisecond)
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			Log.Debugf("Trace %s: DNS lookup of %s started at %s", reqURL, info.Host, since())
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			Log.Debugf("Trace %s: DNS lookup done at %s, addresses %v, error %v", reqURL, since(), info.Addrs, info.Err)
+		},
+		ConnectStart: func(network, addr string) {
+			Log.Debugf("Trace %s: connecting to %s %s at %s", reqURL, network, addr, since())
+		},
+		ConnectDone: func(network, addr string, err error) {
+			Log.Debugf("Trace %s: connected to %s %s at %s, error %v", reqURL, network, addr, since(), err)
+		},
+		TLSHandshakeStart: func() {
+			Log.Debugf("Trace %s: TLS handshake started at %s", reqURL, since())
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			Log.Debugf("Trace %s: TLS handshake done at %s, server %s, error %v", reqURL, since(), state.ServerName, err)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			Log.Debugf("Trace %s: got connection to %s at %s, reused %t", reqURL, info.Conn.RemoteAddr(), since(), info.Reused)
+		},
+		GotFirstResponseByte: func() {
+			Log.Debugf("Trace %s: first response byte at %s", reqURL, since())
+		},
+	})
+}
+
+// traceResponse function logs status and headers of a response if Trace is set.
+func traceResponse(resp *http.Response) {
+	if !Trace {
+		return
+	}
+	Log.Debugf("Trace %s: %s %s", resp.Request.URL, resp.Proto, resp.Status)
+	names := make([]string, 0, len(resp.Header))
+	for name := range resp.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		Log.Debugf("Trace %s: %s: %s", resp.Request.URL, name, strings.Join(resp.Header[name], ", "))
+	}
+}
+
+// isRetryableStatus function checks if a request with a given response status code should be retried.
+func isRetryableStatus(statusCode int) bool {
+	return statusCode >= 500
+}
+
+// httpRequest function sends a request and retries it with exponential backoff on transient failures.
+// Responses with status codes 400 and above are returned as errors. The request and retries are stopped when ctx
+// is cancelled.
+func httpRequest(ctx context.Context, method, reqURL string, headers map[string]string) (*http.Response, error) {
+	delay := RetryDelay
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(traceRequest(ctx, reqURL), method, reqURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", UserAgent)
+		for name, value := range ExtraHeaders {
+			req.Header.Set(name, value)
+		}
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+
+		Log.Debugf("%s %s", method, reqURL)
+		retry := true
+		resp, err := httpClient().Do(req)
+		if err == nil {
+			Log.Debugf("%s %s: %s, content length %d", method, reqURL, resp.Status, resp.ContentLength)
+			traceResponse(resp)
+			if resp.StatusCode < 400 {
+				if Timeout > 0 {
+					body := resp.Body
+					resp.Body = &timeoutBody{
+						ReadCloser: body,
+						timer:      time.AfterFunc(Timeout, func() { body.Close() }),
+						timeout:    Timeout,
+					}
+				}
+				return resp, nil
+			}
+			resp.Body.Close()
+			retry = isRetryableStatus(resp.StatusCode)
+			err = fmt.Errorf("%s %s: %s", method, reqURL, resp.Status)
+		}
+
+		if !retry || attempt >= MaxRetries || ctx.Err() != nil {
+			return nil, err
+		}
+		Log.Warnf("Request failed: %s. Retry in %s.", err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// httpGet function sends GET request with retries.
+func httpGet(ctx context.Context, reqURL string) (*http.Response, error) {
+	return httpRequest(ctx, "GET", reqURL, nil)
+}
+
+// httpHead function sends HEAD request with retries.
+func httpHead(ctx context.Context, reqURL string) (*http.Response, error) {
+	return httpRequest(ctx, "HEAD", reqURL, nil)
+}
+
+// httpGetRange function sends GET request for a given inclusive bytes range with retries.
+func httpGetRange(ctx context.Context, reqURL string, start, end int64) (*http.Response, error) {
+	return httpRequest(ctx, "GET", reqURL, map[string]string{"Range": fmt.Sprintf("bytes=%d-%d", start, end)})
+}
@@ -0,0 +1,336 @@
+// Package utils contains various supplementary functions and data structures.
+// This file imported.go contains functions to check, track and remove imported VMs.
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ImportedVM type defines a VM imported into a hypervisor by getIE.
+type ImportedVM struct {
+	Name       string    `json:"name"`
+	Hypervisor string    `json:"hypervisor"`
+	Path       string    `json:"path"`
+	ImportedAt time.Time `json:"importedAt"`
+}
+
+// importedManifestPath function returns a path to the list of imported VMs.
+func importedManifestPath() string {
+	return pathJoin(getConfigPath(), "imported.json")
+}
+
+// loadImportedVMs function loads the list of imported VMs. Empty list is returned if nothing was imported yet.
+func loadImportedVMs() ([]ImportedVM, error) {
+	var vms []ImportedVM
+	content, err := ioutil.ReadFile(importedManifestPath())
+	if os.IsNotExist(err) {
+		return vms, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(content, &vms)
+	return vms, err
+}
+
+// saveImportedVMs function stores the list of imported VMs.
+func saveImportedVMs(vms []ImportedVM) error {
+	if err := os.MkdirAll(getConfigPath(), 0755); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(vms, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(importedManifestPath(), content, 0644)
+}
+
+// recordImport function adds an imported VM to the list. A VM which is already listed keeps its original import
+// date, because the VM expires counting from it.
+func recordImport(hypervisor, vmPath, name string) {
+	vms, err := loadImportedVMs()
+	if err != nil {
+		Log.Warnf("Can't load list of imported VMs: %s", err)
+		return
+	}
+	for _, vm := range vms {
+		if vm.Hypervisor == hypervisor && vm.Name == name {
+			return
+		}
+	}
+	vms = append(vms, ImportedVM{Name: name, Hypervisor: hypervisor, Path: vmPath, ImportedAt: time.Now()})
+	if err := saveImportedVMs(vms); err != nil {
+		Log.Warnf("Can't save list of imported VMs: %s", err)
+	}
+}
+
+// expired method checks if a VM is older than VMLifetimeDays.
+func (vm ImportedVM) expired(now time.Time) bool {
+	return now.Sub(vm.ImportedAt) > VMLifetimeDays*24*time.Hour
+}
+
+// vboxInfoRe matches UUID and VMState lines of vboxmanage showvminfo machine readable output.
+var vboxInfoRe = regexp.MustCompile(`(?m)^(UUID|VMState)="([^"]*)"`)
+
+// verifyImported function checks that a VM with a given name is registered in a hypervisor after import and
+// returns its ID, e.g. UUID. An error is returned if the VM isn't found or it is in a broken state.
+func verifyImported(hypervisor, vmPath, name string) (string, error) {
+	switch hypervisor {
+	case "VirtualBox":
+		result, err := execCommand(vboxManageCmd, "showvminfo", name, "--machinereadable").Output()
+		if err != nil {
+			return "", err
+		}
+		info := make(map[string]string)
+		for _, match := range vboxInfoRe.FindAllStringSubmatch(string(result), -1) {
+			info[match[1]] = match[2]
+		}
+		if info["VMState"] == "inaccessible" || info["VMState"] == "aborted" {
+			return "", fmt.Errorf("VM state is %s", info["VMState"])
+		}
+		return info["UUID"], nil
+	case "VMware":
+		// NOTE: VMware doesn't have VM registry, the VM is its .vmx file.
+		vmxPath := strings.Replace(vmPath, ".ovf", ".vmx", 1)
+		if _, err := os.Stat(vmxPath); err != nil {
+			return "", err
+		}
+		return vmxPath, nil
+	case "HyperV":
+		script := fmt.Sprintf("Get-VM -Name %s | ForEach-Object { \"$($_.Id) $($_.State)\" }", psQuote(name))
+		result, err := execCommand("powershell", "-NoProfile", "-NonInteractive", "-Command", script).Output()
+		if err != nil {
+			return "", err
+		}
+		fields := strings.Fields(string(result))
+		if len(fields) < 1 {
+			return "", fmt.Errorf("VM not found")
+		}
+		return fields[0], nil
+	case "Parallels":
+		result, err := execCommand("prlctl", "list", "--all", "--no-header", "-o", "uuid,status,name").Output()
+		if err != nil {
+			return "", err
+		}
+		for _, line := range strings.Split(string(result), "\n") {
+			if fields := strings.Fields(line); len(fields) > 2 && strings.Join(fields[2:], " ") == name {
+				return fields[0], nil
+			}
+		}
+		return "", fmt.Errorf("VM not found")
+	case "QEMU":
+		result, err := execCommand("virsh", "domuuid", name).Output()
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(result)), nil
+	case "Proxmox":
+		return proxmoxVMID(slugName(name))
+	case "Xen":
+		// NOTE: xl doesn't keep stopped domains, the VM is its domain config.
+		configPath := xenConfigFile(name)
+		if _, err := os.Stat(configPath); err != nil {
+			return "", err
+		}
+		return configPath, nil
+	case "Vagrant":
+		boxes, err := vagrantBoxes()
+		if err != nil {
+			return "", err
+		}
+		boxName := vagrantBoxName(name)
+		for _, box := range boxes {
+			if box == boxName {
+				return boxName, nil
+			}
+		}
+		return "", fmt.Errorf("box not found")
+	case "WindowsSandbox":
+		configPath := sandboxConfigPath(vmPath, name)
+		if _, err := os.Stat(configPath); err != nil {
+			return "", err
+		}
+		return configPath, nil
+	}
+	return "", fmt.Errorf("Hypervisor %s isn't supported", hypervisor)
+}
+
+// proxmoxVMID function finds ID of a Proxmox VM by its name.
+func proxmoxVMID(name string) (string, error) {
+	result, err := execCommand("qm", "list").Output()
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(result), "\n")[1:] {
+		if fields := strings.Fields(line); len(fields) > 1 && fields[1] == name {
+			return fields[0], nil
+		}
+	}
+	return "", fmt.Errorf("Proxmox VM %s not found", name)
+}
+
+// removeVM function unregisters a VM from a hypervisor and deletes its files managed by the hypervisor.
+func removeVM(vm ImportedVM) error {
+	var cmdName string
+	var cmdArgs []string
+	switch vm.Hypervisor {
+	case "VirtualBox":
+		cmdName, cmdArgs = findVBoxManage(), []string{"unregistervm", vm.Name, "--delete"}
+	case "VMware":
+		cmdName, cmdArgs = "vmrun", []string{"deleteVM", strings.Replace(vm.Path, ".ovf", ".vmx", 1)}
+	case "HyperV":
+		cmdName, cmdArgs = "powershell", []string{"-NoProfile", "-NonInteractive", "-Command",
+			fmt.Sprintf("Remove-VM -Name %s -Force", psQuote(vm.Name))}
+	case "Parallels":
+		cmdName, cmdArgs = "prlctl", []string{"delete", vm.Name}
+	case "QEMU":
+		return removeQemuVM(vm.Name)
+	case "Xen":
+		return removeXenVM(vm.Name)
+	case "Proxmox":
+		vmID, err := proxmoxVMID(slugName(vm.Name))
+		if err != nil {
+			return err
+		}
+		cmdName, cmdArgs = "qm", []string{"destroy", vmID}
+	case "Vagrant":
+		cmdName, cmdArgs = "vagrant", []string{"box", "remove", vagrantBoxName(vm.Name)}
+	case "WindowsSandbox":
+		return os.Remove(sandboxConfigPath(vm.Path, vm.Name))
+	default:
+		return fmt.Errorf("Hypervisor %s isn't supported", vm.Hypervisor)
+	}
+	result, err := execCommand(cmdName, cmdArgs...).CombinedOutput()
+	if err != nil {
+		Log.Error(string(result))
+		return err
+	}
+	return nil
+}
+
+// qemuDomainDisks function returns paths of disk files attached to a given libvirt domain.
+func qemuDomainDisks(name string) ([]string, error) {
+	// NOTE: virsh lists disks as a table with Type, Device, Target and Source columns, the source could
+	// contain spaces.
+	result, err := execCommand("virsh", "domblklist", name, "--details").Output()
+	if err != nil {
+		return nil, err
+	}
+	var disks []string
+	for _, line := range strings.Split(string(result), "\n") {
+		if fields := strings.Fields(line); len(fields) > 3 && fields[0] == "file" && fields[1] == "disk" {
+			disks = append(disks, strings.Join(fields[3:], " "))
+		}
+	}
+	return disks, nil
+}
+
+// removeQemuVM function undefines a libvirt domain and deletes its disks. The disks are converted by importQemuVM
+// and they aren't managed by a libvirt storage pool, so virsh doesn't delete them.
+func removeQemuVM(name string) error {
+	disks, err := qemuDomainDisks(name)
+	if err != nil {
+		return err
+	}
+	if result, err := execCommand("virsh", "undefine", name).CombinedOutput(); err != nil {
+		Log.Error(string(result))
+		return err
+	}
+	for _, disk := range disks {
+		if err := os.Remove(disk); err != nil && !os.IsNotExist(err) {
+			Log.Warnf("Can't delete disk %s of VM '%s': %s", disk, name, err)
+		}
+	}
+	return nil
+}
+
+// vmExists function checks if an imported VM is still present in its hypervisor, e.g. a user could remove it
+// manually. An error is returned if it can't be checked, e.g. the hypervisor tools aren't available.
+func vmExists(vm ImportedVM) (bool, error) {
+	var names []string
+	var err error
+	name := vm.Name
+	switch vm.Hypervisor {
+	case "VirtualBox":
+		vboxManageCmd = findVBoxManage()
+		names, err = virtualBoxVMs()
+	case "VMware":
+		// NOTE: VMware doesn't have VM registry, the VM is its .vmx file.
+		_, err = os.Stat(strings.Replace(vm.Path, ".ovf", ".vmx", 1))
+		return err == nil, nil
+	case "HyperV":
+		names, err = hypervVMs()
+	case "Parallels":
+		names, err = parallelsVMs()
+	case "QEMU":
+		names, err = qemuVMs()
+	case "Proxmox":
+		name = slugName(vm.Name)
+		names, err = proxmoxVMs()
+	case "Vagrant":
+		name = vagrantBoxName(vm.Name)
+		names, err = vagrantBoxes()
+	case "Xen":
+		_, err = os.Stat(xenConfigFile(vm.Name))
+		return err == nil, nil
+	case "WindowsSandbox":
+		_, err = os.Stat(sandboxConfigPath(vm.Path, vm.Name))
+		return err == nil, nil
+	default:
+		return false, fmt.Errorf("Hypervisor %s isn't supported", vm.Hypervisor)
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, existing := range names {
+		if strings.TrimSpace(existing) == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// CleanupExpired function offers to remove imported VMs which are older than VMLifetimeDays. Removed VMs and VMs
+// which don't exist anymore are dropped from the list of imported VMs.
+func CleanupExpired() error {
+	vms, err := loadImportedVMs()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var kept []ImportedVM
+	for _, vm := range vms {
+		// NOTE: a VM which can't be checked is kept, e.g. its hypervisor tools could be missing temporarily.
+		if exists, err := vmExists(vm); err == nil && !exists {
+			Log.Infof("%s VM '%s' doesn't exist anymore, it is dropped from the list.", vm.Hypervisor, vm.Name)
+			continue
+		}
+		if !vm.expired(now) {
+			kept = append(kept, vm)
+			continue
+		}
+		msg := fmt.Sprintf("%s VM '%s' was imported on %s and expired. Remove it",
+			vm.Hypervisor, vm.Name, vm.ImportedAt.Format("2006-01-02"))
+		if !AskYesNo(msg) {
+			kept = append(kept, vm)
+			continue
+		}
+		if err := removeVM(vm); err != nil {
+			Log.Errorf("Can't remove %s VM '%s': %s", vm.Hypervisor, vm.Name, err)
+			kept = append(kept, vm)
+			continue
+		}
+		Log.Infof("%s VM '%s' removed.", vm.Hypervisor, vm.Name)
+	}
+	if len(kept) == len(vms) {
+		Log.Info("No expired or missing VMs removed.")
+		return nil
+	}
+	return saveImportedVMs(kept)
+}
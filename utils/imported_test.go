@@ -0,0 +1,152 @@
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withImportedVMs function replaces the list of imported VMs until the test ends.
+func withImportedVMs(t *testing.T, vms []ImportedVM) {
+	t.Helper()
+	original, err := ioutil.ReadFile(importedManifestPath())
+	if err := saveImportedVMs(vms); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err != nil {
+			os.Remove(importedManifestPath())
+			return
+		}
+		ioutil.WriteFile(importedManifestPath(), original, 0644)
+	})
+}
+
+func TestInstallVMRecordsOnlyRealImports(t *testing.T) {
+	withImportedVMs(t, nil)
+	vmPath := filepath.Join(t.TempDir(), "IE11 - Win7.vmdk")
+	stubCommands(t, map[string]fakeCommand{
+		"qemu-img --version":     {output: "qemu-img version 8.2.0"},
+		"virt-install --version": {output: "4.1.0"},
+		"virsh --version":        {output: "10.0.0"},
+		"virsh list":             {output: "IE11-Win7-QEMU\n"},
+		"virsh domuuid":          {output: "0ba5d6e1-0000-0000-0000-000000000000\n"},
+	})
+
+	if err := InstallVM("QEMU", vmPath, "IE11-Win7-QEMU"); err != nil {
+		t.Fatal(err)
+	}
+	vms, err := loadImportedVMs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vms) != 0 {
+		t.Errorf("VM which already existed is recorded as imported: %+v", vms)
+	}
+}
+
+func TestCleanupExpired(t *testing.T) {
+	folder := t.TempDir()
+	disk := filepath.Join(folder, "IE8 - WinXP.qcow2")
+	if err := ioutil.WriteFile(disk, []byte("disk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-(VMLifetimeDays + 1) * 24 * time.Hour)
+	withImportedVMs(t, []ImportedVM{
+		{Name: "IE8-WinXP-QEMU", Hypervisor: "QEMU", Path: filepath.Join(folder, "IE8 - WinXP.vmdk"), ImportedAt: old},
+		{Name: "IE11-Win7-QEMU", Hypervisor: "QEMU", ImportedAt: time.Now()},
+		{Name: "IE9-Win7-QEMU", Hypervisor: "QEMU", ImportedAt: time.Now()},
+		{Name: "IE10-Win7-VBox", Hypervisor: "VirtualBox", ImportedAt: old},
+	})
+	calls := stubCommands(t, map[string]fakeCommand{
+		"virsh list --all --name": {output: "IE8-WinXP-QEMU\nIE11-Win7-QEMU\n"},
+		"virsh domblklist IE8-WinXP-QEMU --details": {output: " Type   Device   Target   Source\n" +
+			"-----------------------------------------\n" +
+			" file   disk     vda      " + disk + "\n" +
+			" file   cdrom    hdb      -\n"},
+		"virsh undefine IE8-WinXP-QEMU": {output: "Domain 'IE8-WinXP-QEMU' has been undefined"},
+		// NOTE: VirtualBox isn't installed, so its VM can't be checked or removed and it is kept.
+	})
+
+	if err := CleanupExpired(); err != nil {
+		t.Fatal(err)
+	}
+	vms, err := loadImportedVMs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, vm := range vms {
+		names = append(names, vm.Name)
+	}
+	if got := strings.Join(names, ","); got != "IE11-Win7-QEMU,IE10-Win7-VBox" {
+		t.Errorf("kept VMs %s, want IE11-Win7-QEMU,IE10-Win7-VBox", got)
+	}
+	if _, err := os.Stat(disk); !os.IsNotExist(err) {
+		t.Errorf("disk of removed QEMU VM is left: %v", err)
+	}
+	undefined := false
+	for _, call := range calls() {
+		undefined = undefined || call == "virsh undefine IE8-WinXP-QEMU"
+	}
+	if !undefined {
+		t.Errorf("expired QEMU VM isn't undefined, commands %q", calls())
+	}
+}
+
+func TestInstallVMUniqueRunConcurrently(t *testing.T) {
+	UniqueRun = true
+	defer func() { UniqueRun = false }()
+	withImportedVMs(t, nil)
+	calls := stubCommands(t, map[string]fakeCommand{
+		"qemu-img --version":     {output: "qemu-img version 8.2.0"},
+		"qemu-img convert":       {},
+		"virt-install --version": {output: "4.1.0"},
+		"virt-install":           {output: "<domain/>"},
+		"virsh --version":        {output: "10.0.0"},
+		"virsh list":             {},
+		"virsh define":           {},
+		"virsh domuuid":          {output: "0ba5d6e1-0000-0000-0000-000000000000\n"},
+	})
+	uc := UserChoice{Spec: Spec{Platform: "Linux", Hypervisor: "QEMU", BrowserOs: "IE11 Win7"}}
+
+	const runs = 2
+	names := make(chan string, runs)
+	errs := make(chan error, runs)
+	for i := 0; i < runs; i++ {
+		go func() {
+			name := DefaultVMName(uc)
+			vmPath := filepath.Join(t.TempDir(), "IE11 - Win7.vmdk")
+			_, err := installVM(context.Background(), "QEMU", vmPath, name)
+			names <- name
+			errs <- err
+		}()
+	}
+	imported := map[string]bool{}
+	for i := 0; i < runs; i++ {
+		name := <-names
+		if err := <-errs; err != nil {
+			t.Fatalf("installVM: %s", err)
+		}
+		if !strings.HasPrefix(name, "IE11-Win7-QEMU-") {
+			t.Errorf("VM name %s has no per-run suffix", name)
+		}
+		imported[name] = true
+	}
+	if len(imported) != runs {
+		t.Errorf("concurrent runs share VM names %v", imported)
+	}
+	defined := 0
+	for _, call := range calls() {
+		if strings.HasPrefix(call, "virsh define") {
+			defined++
+		}
+	}
+	if defined != runs {
+		t.Errorf("%d VMs were defined, want %d: %v", defined, runs, calls())
+	}
+}
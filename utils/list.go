@@ -0,0 +1,88 @@
+// Package utils contains various supplementary functions and data structures.
+// This file list.go contains functions to list available VMs in machine-readable form.
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ListFormats var defines formats supported by ListVMs function.
+var ListFormats = Choice{"json", "tsv"}
+
+// vmEntry type defines a single available VM in ListVMs output.
+type vmEntry struct {
+	Platform    string `json:"platform"`
+	Hypervisor  string `json:"hypervisor"`
+	BrowserOs   string `json:"browserOs"`
+	FileURL     string `json:"fileUrl"`
+	HashAlgo    string `json:"hashAlgo"`
+	ChecksumURL string `json:"checksumUrl,omitempty"`
+	Checksum    string `json:"checksum,omitempty"`
+	// Parts are URLs of split archive parts.
+	Parts []string `json:"parts,omitempty"`
+}
+
+// newVMEntry function builds a list entry for a given VM. Checksum is set if the catalog provides it inline and
+// ChecksumURL is set if it provides an URL of a checksum file, some catalogs provide both.
+func newVMEntry(spec Spec, vm VMImage) vmEntry {
+	entry := vmEntry{
+		Platform:   spec.Platform,
+		Hypervisor: spec.Hypervisor,
+		BrowserOs:  spec.BrowserOs,
+		FileURL:    vm.FileURL,
+		HashAlgo:   vm.hashAlgo(),
+	}
+	for _, part := range vm.Parts {
+		entry.Parts = append(entry.Parts, part.FileURL)
+	}
+	switch {
+	case entry.HashAlgo == "sha256" && sha256Re.MatchString(vm.Sha256):
+		entry.Checksum = vm.Sha256
+	case entry.HashAlgo == "sha256":
+		entry.ChecksumURL = vm.Sha256
+	default:
+		// NOTE: the catalog could provide both inline md5 sum and md5 file URL.
+		entry.Checksum, entry.ChecksumURL = vm.Md5, vm.Md5URL
+	}
+	return entry
+}
+
+// ListVMs function writes all available VMs sorted by platform, hypervisor and browser into dst
+// in json or tsv format.
+func ListVMs(availableVms AvailableVM, format string, dst io.Writer) error {
+	entries := make([]vmEntry, 0, len(availableVms))
+	keys := make([]string, 0, len(availableVms))
+	byKey := make(map[string]vmEntry)
+	for spec, vm := range availableVms {
+		key := strings.Join([]string{spec.Platform, spec.Hypervisor, spec.BrowserOs}, "\t")
+		keys = append(keys, key)
+		byKey[key] = newVMEntry(spec, vm)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		entries = append(entries, byKey[key])
+	}
+
+	switch format {
+	case "json":
+		content, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(dst, string(content))
+		return err
+	case "tsv":
+		fmt.Fprintln(dst, "platform\thypervisor\tbrowserOs\tfileUrl\thashAlgo\tchecksumUrl\tchecksum")
+		for _, e := range entries {
+			fmt.Fprintf(dst, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				e.Platform, e.Hypervisor, e.BrowserOs, e.FileURL, e.HashAlgo, e.ChecksumURL, e.Checksum)
+		}
+		return nil
+	default:
+		return fmt.Errorf("list format %s isn't supported, use one of: %s", format, strings.Join(ListFormats, ", "))
+	}
+}
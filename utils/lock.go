@@ -0,0 +1,123 @@
+// Package utils contains various supplementary functions and data structures.
+// This file lock.go contains functions for advisory file locks used to serialize hypervisor operations.
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LockTimeout var defines how long to wait for another import into the same hypervisor to finish. Zero means
+// waiting forever.
+var LockTimeout = 30 * time.Minute
+
+// lockPollInterval defines how often an existing lock is checked while waiting for it.
+var lockPollInterval = time.Second
+
+// lockPath function returns path to a lock file for a given hypervisor.
+func lockPath(hypervisor string) string {
+	return pathJoin(os.TempDir(), fmt.Sprintf("getIE-%s.lock", hypervisor))
+}
+
+// lockOwner function returns PID of a process which holds a given lock file. Zero is returned if the file
+// doesn't contain PID, e.g. it is being written.
+func lockOwner(lockFile string) (int, error) {
+	content, err := ioutil.ReadFile(lockFile)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0, nil
+	}
+	return pid, nil
+}
+
+// removeStaleLock function removes a lock file left by a process which doesn't run anymore, e.g. it crashed or
+// exited without releasing the lock. True is returned if the lock was stale.
+func removeStaleLock(lockFile string) bool {
+	pid, err := lockOwner(lockFile)
+	if err != nil || pid == 0 || processAlive(pid) {
+		return false
+	}
+	// NOTE: another waiting instance could remove the stale lock and take it in the meantime, so the lock is
+	// atomically moved away first and removed only if the moved file still belongs to the dead process.
+	movedFile := fmt.Sprintf("%s.%d-%d.stale", lockFile, os.Getpid(), time.Now().UnixNano())
+	if err := os.Rename(lockFile, movedFile); err != nil {
+		return false
+	}
+	if current, err := lockOwner(movedFile); err != nil || current != pid {
+		// NOTE: the lock of a running instance is put back only if nobody has taken the lock since then.
+		if err := os.Link(movedFile, lockFile); err != nil {
+			Log.Warnf("Can't restore lock '%s': %s", lockFile, err)
+		}
+		os.Remove(movedFile)
+		return false
+	}
+	Log.Warnf("Removing stale lock '%s' of process %d which isn't running.", lockFile, pid)
+	return os.Remove(movedFile) == nil
+}
+
+// lockHypervisor function acquires an advisory lock for a given hypervisor and waits if the lock is held by
+// another getIE instance. The lock file keeps PID of its owner, so a lock left by a crashed or killed instance is
+// removed. An error is returned if the lock isn't released within LockTimeout or ctx is cancelled. Returned function
+// releases the lock, the lock is released when ctx is cancelled too.
+func lockHypervisor(ctx context.Context, hypervisor string) (func(), error) {
+	lockFile := lockPath(hypervisor)
+	started := time.Now()
+	waiting := false
+	for {
+		file, err := os.OpenFile(lockFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			fmt.Fprintf(file, "%d\n", os.Getpid())
+			file.Close()
+			return releaseOnCancel(ctx, lockFile), nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if removeStaleLock(lockFile) {
+			continue
+		}
+		if LockTimeout > 0 && time.Since(started) >= LockTimeout {
+			return nil, fmt.Errorf("another import into %s didn't finish in %s, remove '%s' if no other getIE "+
+				"is running", hypervisor, LockTimeout, lockFile)
+		}
+		if !waiting {
+			Log.Infof("Waiting for another import to finish. Remove '%s' if no other getIE is running.", lockFile)
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// releaseOnCancel function removes a given lock file if ctx is cancelled while the lock is held, e.g. the tool is
+// interrupted, and returns a function which releases the lock normally. The returned function must be called once.
+func releaseOnCancel(ctx context.Context, lockFile string) func() {
+	var once sync.Once
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			once.Do(func() {
+				os.Remove(lockFile)
+				Log.Warnf("Import is cancelled, lock '%s' released.", lockFile)
+			})
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		once.Do(func() { os.Remove(lockFile) })
+	}
+}
@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testHypervisor function returns a hypervisor name unique for a test, so its lock doesn't clash with real ones.
+func testHypervisor(t *testing.T) string {
+	name := fmt.Sprintf("Test%d-%d", os.Getpid(), time.Now().UnixNano())
+	t.Cleanup(func() { os.Remove(lockPath(name)) })
+	return name
+}
+
+// lockConcurrently function takes a lock for a given hypervisor from several goroutines at once, each of them
+// holds it for a while. The largest number of simultaneous holders and the number of finished ones are returned.
+func lockConcurrently(t *testing.T, hypervisor string, count int) (int, int) {
+	var mutex sync.Mutex
+	holders, maxHolders, finished := 0, 0, 0
+	var wg sync.WaitGroup
+	for idx := 0; idx < count; idx++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := lockHypervisor(context.Background(), hypervisor)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mutex.Lock()
+			holders++
+			if holders > maxHolders {
+				maxHolders = holders
+			}
+			mutex.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mutex.Lock()
+			holders--
+			finished++
+			mutex.Unlock()
+			unlock()
+		}()
+	}
+	wg.Wait()
+	return maxHolders, finished
+}
+
+// writeStaleLock function writes a lock file for a given hypervisor owned by a process which doesn't run.
+func writeStaleLock(t *testing.T, hypervisor string) {
+	// NOTE: the test binary without tests to run exits at once, so its PID belongs to a finished process.
+	finished := exec.Command(os.Args[0], "-test.run=^$")
+	if err := finished.Run(); err != nil {
+		t.Fatal(err)
+	}
+	content := fmt.Sprintf("%d\n", finished.Process.Pid)
+	if err := ioutil.WriteFile(lockPath(hypervisor), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockHypervisorSerializes(t *testing.T) {
+	defer func(interval time.Duration) { lockPollInterval = interval }(lockPollInterval)
+	lockPollInterval = time.Millisecond
+	hypervisor := testHypervisor(t)
+
+	if maxHolders, finished := lockConcurrently(t, hypervisor, 8); maxHolders != 1 || finished != 8 {
+		t.Errorf("%d imports held the lock at once and %d finished, want 1 and 8", maxHolders, finished)
+	}
+	if _, err := os.Stat(lockPath(hypervisor)); !os.IsNotExist(err) {
+		t.Errorf("lock file is left after all imports: %v", err)
+	}
+}
+
+func TestLockHypervisorRemovesStaleLock(t *testing.T) {
+	hypervisor := testHypervisor(t)
+	writeStaleLock(t, hypervisor)
+
+	unlock, err := lockHypervisor(context.Background(), hypervisor)
+	if err != nil {
+		t.Fatalf("stale lock isn't taken over: %s", err)
+	}
+	unlock()
+}
+
+func TestLockHypervisorStaleLockTakenOverOnce(t *testing.T) {
+	defer func(interval time.Duration) { lockPollInterval = interval }(lockPollInterval)
+	lockPollInterval = time.Millisecond
+	for run := 0; run < 20; run++ {
+		hypervisor := testHypervisor(t)
+		writeStaleLock(t, hypervisor)
+
+		if maxHolders, finished := lockConcurrently(t, hypervisor, 8); maxHolders != 1 || finished != 8 {
+			t.Fatalf("%d imports held the lock at once and %d finished, want 1 and 8", maxHolders, finished)
+		}
+		moved, err := filepath.Glob(lockPath(hypervisor) + ".*")
+		if err != nil || len(moved) > 0 {
+			t.Fatalf("moved lock files are left: %v %v", moved, err)
+		}
+	}
+}
+
+func TestLockHypervisorTimeout(t *testing.T) {
+	defer func(timeout, interval time.Duration) {
+		LockTimeout, lockPollInterval = timeout, interval
+	}(LockTimeout, lockPollInterval)
+	LockTimeout, lockPollInterval = 20*time.Millisecond, time.Millisecond
+	hypervisor := testHypervisor(t)
+
+	unlock, err := lockHypervisor(context.Background(), hypervisor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	if _, err := lockHypervisor(context.Background(), hypervisor); err == nil {
+		t.Fatal("lock held by a running process was taken")
+	}
+}
+
+func TestLockHypervisorReleasedOnCancel(t *testing.T) {
+	defer func(interval time.Duration) { lockPollInterval = interval }(lockPollInterval)
+	lockPollInterval = time.Millisecond
+	hypervisor := testHypervisor(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	unlock, err := lockHypervisor(ctx, hypervisor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	waitCtx, stopWaiting := context.WithCancel(context.Background())
+	stopWaiting()
+	if _, err := lockHypervisor(waitCtx, hypervisor); err != context.Canceled {
+		t.Fatalf("waiting for a held lock returned %v, want %v", err, context.Canceled)
+	}
+
+	cancel()
+	other, err := lockHypervisor(context.Background(), hypervisor)
+	if err != nil {
+		t.Fatalf("lock isn't released on cancel: %s", err)
+	}
+	other()
+}
@@ -0,0 +1,135 @@
+// Package utils contains various supplementary functions and data structures.
+// This file log.go contains a simple leveled logger used for all messages of the tool.
+package utils
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// LogLevel type defines importance of a log message.
+type LogLevel int
+
+// Log levels from the most verbose to the least verbose one.
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// logLevelNames maps log levels to their names used in the command line and message prefixes.
+var logLevelNames = map[LogLevel]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+// ErrConsole var defines where warnings and errors are written.
+var ErrConsole io.Writer = os.Stderr
+
+// Logger type writes messages of a given level and above. Debug and info messages are written to Console,
+// warnings and errors are written to ErrConsole.
+type Logger struct {
+	Level LogLevel
+}
+
+// Log var is the logger used by the whole tool.
+var Log = &Logger{Level: LevelInfo}
+
+// levelOff defines a log level above all levels, a logger with it doesn't write any message.
+const levelOff = LevelError + 1
+
+// quietLog var is a logger which doesn't write any message, it is passed to functions whose messages aren't
+// needed, e.g. hypervisor checks.
+var quietLog = &Logger{Level: levelOff}
+
+// ParseLogLevel function converts log level name into LogLevel.
+func ParseLogLevel(name string) (LogLevel, error) {
+	for level, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level '%s', use debug, info, warn or error", name)
+}
+
+// write method writes a message if its level is enabled. A new line is added if the message doesn't have it.
+func (l *Logger) write(level LogLevel, msg string) {
+	l.writeColored(level, "", msg)
+}
+
+// writeColored method writes a message like write method does, but the message is colored with a given color.
+// Warnings and errors have their own colors which are used if no color is given.
+func (l *Logger) writeColored(level LogLevel, color, msg string) {
+	if level < l.Level {
+		return
+	}
+	out := Console
+	prefix := ""
+	switch level {
+	case LevelDebug:
+		prefix = "DEBUG: "
+	case LevelWarn:
+		out, prefix = ErrConsole, "WARNING: "
+		if color == "" {
+			color = colorYellow
+		}
+	case LevelError:
+		out, prefix = ErrConsole, "ERROR: "
+		if color == "" {
+			color = colorRed
+		}
+	}
+	if !strings.HasSuffix(msg, "\n") {
+		msg += "\n"
+	}
+	// NOTE: progress lines are erased and drawn again below the message, so they aren't garbled.
+	defer display.suspend()()
+	if color != "" {
+		fmt.Fprint(out, colorize(out, color, prefix+msg))
+		return
+	}
+	fmt.Fprint(out, prefix+msg)
+}
+
+// Debugf method writes formatted debug message.
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.write(LevelDebug, fmt.Sprintf(format, args...))
+}
+
+// Infof method writes formatted informational message.
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.write(LevelInfo, fmt.Sprintf(format, args...))
+}
+
+// Successf method writes formatted informational message about a successfully finished action.
+// It is shown in green in terminals.
+func (l *Logger) Successf(format string, args ...interface{}) {
+	l.writeColored(LevelInfo, colorGreen, fmt.Sprintf(format, args...))
+}
+
+// Warnf method writes formatted warning message.
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.write(LevelWarn, fmt.Sprintf(format, args...))
+}
+
+// Errorf method writes formatted error message.
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.write(LevelError, fmt.Sprintf(format, args...))
+}
+
+// Info method writes informational message with its arguments separated by spaces.
+func (l *Logger) Info(args ...interface{}) { l.write(LevelInfo, fmt.Sprintln(args...)) }
+
+// Debug method writes debug message with its arguments separated by spaces.
+func (l *Logger) Debug(args ...interface{}) { l.write(LevelDebug, fmt.Sprintln(args...)) }
+
+// Warn method writes warning message with its arguments separated by spaces.
+func (l *Logger) Warn(args ...interface{}) { l.write(LevelWarn, fmt.Sprintln(args...)) }
+
+// Error method writes error message with its arguments separated by spaces.
+func (l *Logger) Error(args ...interface{}) { l.write(LevelError, fmt.Sprintln(args...)) }
@@ -0,0 +1,80 @@
+// Package utils contains various supplementary functions and data structures.
+// This file mirror.go contains functions to download VM archives from mirrors.
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Mirrors var defines base URLs of mirrors which are tried in order before the original download host.
+// A mirror must keep the original paths of VM archives, e.g. https://mirror.example.com/ms serves
+// https://az792536.vo.msecnd.net/vms/VMBuild_20150916/VirtualBox/IE11/IE11.Win7.VirtualBox.zip as
+// https://mirror.example.com/ms/vms/VMBuild_20150916/VirtualBox/IE11/IE11.Win7.VirtualBox.zip.
+var Mirrors []string
+
+// ValidateMirror function checks that a given mirror base URL contains scheme and host.
+func ValidateMirror(mirror string) error {
+	parsedURL, err := url.Parse(mirror)
+	if err != nil {
+		return err
+	}
+	if parsedURL.Scheme == "" || parsedURL.Host == "" {
+		return fmt.Errorf("mirror URL '%s' must contain scheme and host, e.g. https://mirror.example.com", mirror)
+	}
+	return nil
+}
+
+// mirrorURL function replaces scheme and host of a given file URL with a mirror base URL.
+func mirrorURL(fileURL, mirror string) (string, error) {
+	parsedURL, err := url.Parse(fileURL)
+	if err != nil {
+		return "", err
+	}
+	mirrored := strings.TrimSuffix(mirror, "/") + parsedURL.EscapedPath()
+	if parsedURL.RawQuery != "" {
+		mirrored += "?" + parsedURL.RawQuery
+	}
+	return mirrored, nil
+}
+
+// mirrorURLs function returns URLs to download a given file from, mirrors go first and the original URL is the last.
+func mirrorURLs(fileURL string) []string {
+	var urls []string
+	for _, mirror := range Mirrors {
+		mirrored, err := mirrorURL(fileURL, mirror)
+		if err != nil {
+			Log.Warnf("Can't use mirror %s for %s: %s", mirror, fileURL, err)
+			continue
+		}
+		urls = append(urls, mirrored)
+	}
+	return append(urls, fileURL)
+}
+
+// downloadMirrors function downloads VM archive trying given URLs in order. The next URL is tried if the download
+// fails or the downloaded file has wrong checksum. Checksum of the file downloaded from the last URL is returned
+// as-is, so a caller could handle a corrupted download. The file is overwritten by each next download.
+func downloadMirrors(ctx context.Context, urls []string, vmFile, algo, origSum string, opts *DownloadOptions) (string, error) {
+	for idx, fileURL := range urls {
+		vmSum, err := downloadArchive(ctx, fileURL, vmFile, algo, opts)
+		last := idx == len(urls)-1
+		if err == nil && (strings.EqualFold(vmSum, origSum) || last) {
+			if len(urls) > 1 {
+				Log.Infof("Downloaded from %s", fileURL)
+			}
+			return vmSum, nil
+		}
+		if last || ctx.Err() != nil {
+			return "", err
+		}
+		if err == nil {
+			err = fmt.Errorf("%s sum %s doesn't match expected %s", algoName(algo), vmSum, origSum)
+		}
+		Log.Warnf("Download from %s failed: %s. Try the next one.", fileURL, err)
+	}
+	return "", errors.New("no URLs to download from")
+}
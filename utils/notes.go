@@ -0,0 +1,85 @@
+// Package utils contains various supplementary functions and data structures.
+// This file notes.go contains functions to show release notes of VM catalog.
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// VMLifetimeDays const defines how long Microsoft VMs work after the first start.
+const VMLifetimeDays = 90
+
+var (
+	// htmlTagRe matches HTML tags which release notes could contain.
+	htmlTagRe = regexp.MustCompile(`<[^>]*>`)
+	// sentenceEndRe matches ends of sentences to split notes into readable lines.
+	sentenceEndRe = regexp.MustCompile(`([.!?])\s+`)
+	// expiryRe matches sentences about VM expiration.
+	expiryRe = regexp.MustCompile(`(?i)expir|\b\d+\s+days\b`)
+)
+
+// ParseReleaseNotes function returns release notes of VM catalog. Empty string is returned if there are no notes.
+func ParseReleaseNotes(rawData *[]byte) string {
+	var data JSONData
+	if err := json.Unmarshal(*rawData, &data); err != nil {
+		Log.Debugf("Can't parse release notes: %s", err)
+		return ""
+	}
+	return strings.TrimSpace(data.ReleaseNotes)
+}
+
+// formatReleaseNotes function converts release notes into plain text lines, one sentence per line.
+// Notes could be HTML, so tags are removed and entities are unescaped.
+func formatReleaseNotes(notes string) []string {
+	text := html.UnescapeString(htmlTagRe.ReplaceAllString(notes, " "))
+	text = strings.Join(strings.Fields(text), " ")
+	var lines []string
+	for _, line := range strings.Split(sentenceEndRe.ReplaceAllString(text, "$1\n"), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// expiryNotes function returns lines of release notes which mention VM expiration.
+func expiryNotes(lines []string) []string {
+	var found []string
+	for _, line := range lines {
+		if expiryRe.MatchString(line) {
+			found = append(found, line)
+		}
+	}
+	return found
+}
+
+// ShowReleaseNotes function shows release notes of VM catalog. Lines about VM expiration are highlighted.
+// Release notes could be just a link to a document, in this case the link is shown.
+func ShowReleaseNotes(notes string) {
+	if notes == "" {
+		fmt.Fprintln(Console, "VM catalog doesn't have release notes.")
+	} else {
+		fmt.Fprintln(Console, "Release notes:")
+		for _, line := range formatReleaseNotes(notes) {
+			if expiryRe.MatchString(line) {
+				line = "!!! " + line
+			}
+			fmt.Fprintln(Console, " ", line)
+		}
+	}
+	ShowExpiryWarning(notes)
+}
+
+// ShowExpiryWarning function reminds that VMs stop working after a while. Expiration details from release notes
+// are shown if there are any.
+func ShowExpiryWarning(notes string) {
+	for _, line := range expiryNotes(formatReleaseNotes(notes)) {
+		Log.Warn(line)
+	}
+	Log.Warnf("Microsoft VMs expire %d days after the first start. Take a snapshot right after import to be able to "+
+		"revert to it.", VMLifetimeDays)
+}
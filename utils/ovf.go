@@ -0,0 +1,158 @@
+// Package utils contains various supplementary functions and data structures.
+// This file ovf.go contains functions to check that OVF/OVA VM files are complete before import.
+package utils
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ovfEnvelope type defines a part of .ovf descriptor which lists files the VM consists of.
+type ovfEnvelope struct {
+	Files []struct {
+		Href string `xml:"href,attr"`
+		Size int64  `xml:"size,attr"`
+	} `xml:"References>File"`
+}
+
+// mfLineRe matches .mf manifest lines like 'SHA1(disk.vmdk)= 0123abcd'.
+var mfLineRe = regexp.MustCompile(`^(\w+)\((.+)\)\s*=\s*([0-9a-fA-F]+)$`)
+
+// parseOvf function parses .ovf descriptor content.
+func parseOvf(content []byte) (ovfEnvelope, error) {
+	var envelope ovfEnvelope
+	if err := xml.Unmarshal(content, &envelope); err != nil {
+		return envelope, fmt.Errorf("can't parse OVF descriptor: %s", err)
+	}
+	return envelope, nil
+}
+
+// verifyOvf function checks that all files referenced by .ovf descriptor exist next to it and have expected sizes.
+// If .mf manifest is present checksums of the files are verified as well.
+func verifyOvf(ovfPath string) error {
+	content, err := ioutil.ReadFile(ovfPath)
+	if err != nil {
+		return err
+	}
+	envelope, err := parseOvf(content)
+	if err != nil {
+		return err
+	}
+	folder := filepath.Dir(ovfPath)
+	for _, file := range envelope.Files {
+		info, err := os.Stat(filepath.Join(folder, file.Href))
+		if err != nil {
+			return fmt.Errorf("file %s referenced by %s is missing", file.Href, ovfPath)
+		}
+		if file.Size > 0 && info.Size() != file.Size {
+			return fmt.Errorf("file %s has size %d but %s expects %d", file.Href, info.Size(), ovfPath, file.Size)
+		}
+	}
+	return verifyManifest(strings.TrimSuffix(ovfPath, filepath.Ext(ovfPath)) + ".mf")
+}
+
+// verifyManifest function checks checksums of files listed in .mf manifest. Missing manifest isn't an error
+// because it is optional.
+func verifyManifest(mfPath string) error {
+	mfFile, err := os.Open(mfPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer mfFile.Close()
+
+	folder := filepath.Dir(mfPath)
+	scanner := bufio.NewScanner(mfFile)
+	for scanner.Scan() {
+		match := mfLineRe.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if match == nil {
+			continue
+		}
+		algo, name, expected := strings.ToLower(match[1]), match[2], match[3]
+		if algo != "sha1" && algo != "sha256" && algo != "md5" {
+			Log.Warnf("Unknown checksum algorithm %s in %s, skip %s.", match[1], mfPath, name)
+			continue
+		}
+		Log.Infof("Checking %s sum of %s", algoName(algo), name)
+		actual, err := fileChecksum(filepath.Join(folder, name), algo, true)
+		if err != nil {
+			return fmt.Errorf("file %s listed in %s can't be checked: %s", name, mfPath, err)
+		}
+		if !strings.EqualFold(actual, expected) {
+			return fmt.Errorf("file %s has %s sum %s but %s expects %s", name, algoName(algo), actual, mfPath, expected)
+		}
+	}
+	return scanner.Err()
+}
+
+// verifyOva function checks that .ova archive contains .ovf descriptor and all files it references
+// with expected sizes.
+func verifyOva(ovaPath string) error {
+	ovaFile, err := os.Open(ovaPath)
+	if err != nil {
+		return err
+	}
+	defer ovaFile.Close()
+
+	sizes := make(map[string]int64)
+	var envelope *ovfEnvelope
+	ovaReader := tar.NewReader(ovaFile)
+	for {
+		header, err := ovaReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s is damaged: %s", ovaPath, err)
+		}
+		sizes[header.Name] = header.Size
+		if strings.HasSuffix(header.Name, ".ovf") {
+			content, err := ioutil.ReadAll(ovaReader)
+			if err != nil {
+				return err
+			}
+			parsed, err := parseOvf(content)
+			if err != nil {
+				return err
+			}
+			envelope = &parsed
+		}
+	}
+	if envelope == nil {
+		return fmt.Errorf("OVF descriptor is missing in %s", ovaPath)
+	}
+	for _, file := range envelope.Files {
+		size, ok := sizes[file.Href]
+		if !ok {
+			return fmt.Errorf("file %s is missing in %s", file.Href, ovaPath)
+		}
+		if file.Size > 0 && size != file.Size {
+			return fmt.Errorf("file %s in %s has size %d but %d is expected", file.Href, ovaPath, size, file.Size)
+		}
+	}
+	return nil
+}
+
+// verifyVMFiles function checks that a VM entry file and its companion files are complete before import.
+// Only OVF and OVA files are checked, other formats don't have descriptors to check against.
+func verifyVMFiles(vmPath string) error {
+	switch strings.ToLower(filepath.Ext(vmPath)) {
+	case ".ovf":
+		Log.Infof("Checking files referenced by %s", vmPath)
+		return verifyOvf(vmPath)
+	case ".ova":
+		Log.Infof("Checking files inside %s", vmPath)
+		return verifyOva(vmPath)
+	}
+	return nil
+}
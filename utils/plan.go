@@ -0,0 +1,125 @@
+// Package utils contains various supplementary functions and data structures.
+// This file plan.go contains functions to show what would be done for a user's choice without doing it.
+package utils
+
+import (
+	"context"
+	"path"
+	"strings"
+)
+
+// DryRun var makes the tool only show what would be done, nothing is written to disk, e.g. the VM catalog isn't
+// cached.
+var DryRun = false
+
+// showImagePlan function shows URL, size and expected checksum of a single VM archive file.
+func showImagePlan(vm VMImage) error {
+	Log.Info("URL:", vm.FileURL)
+	size, err := remoteSize(context.Background(), vm.FileURL)
+	if err != nil {
+		return err
+	}
+	if size > 0 {
+		Log.Infof("Size: %s (%d bytes)", humanBytes(size), size)
+	} else {
+		Log.Info("Size: unknown")
+	}
+
+	algo := vm.hashAlgo()
+	origSum, err := expectedChecksum(context.Background(), vm)
+	if err != nil {
+		return err
+	}
+	Log.Infof("Expected %s sum: %s", algoName(algo), origSum)
+	return nil
+}
+
+// showSpec function shows a platform, a hypervisor and a browser of a user's choice.
+func showSpec(uc UserChoice) {
+	Log.Info("Platform:", uc.Spec.Platform)
+	Log.Info("Hypervisor:", uc.Spec.Hypervisor)
+	if uc.Spec.BrowserOs != "" {
+		Log.Info("Browser and OS:", uc.Spec.BrowserOs)
+	}
+}
+
+// showInstallCommands function shows commands which would be run to install a VM file. If installer is set it is
+// shown instead of the built-in hypervisor commands. See Options.VMName for an empty name.
+func showInstallCommands(uc UserChoice, vmPath, installer, name string) {
+	if installer != "" {
+		replacer := strings.NewReplacer("{path}", vmPath, "{hypervisor}", uc.Hypervisor, "{name}", uc.BrowserOs)
+		Log.Info("Installer command:", replacer.Replace(installer))
+		return
+	}
+	commands := installCommands(uc.Hypervisor, vmPath, importName(uc, vmPath, name))
+	if len(commands) == 0 {
+		Log.Infof("Hypervisor %s isn't supported, nothing would be installed.", uc.Hypervisor)
+		return
+	}
+	Log.Info("Install commands:")
+	for _, command := range commands {
+		Log.Info("  " + command)
+	}
+}
+
+// ShowPlan function shows resolved VM archive URL, its size and checksum, target path and commands which would be
+// run to install the VM. Nothing is written to disk and no commands are run. If installer is set it is shown
+// instead of the built-in hypervisor commands. DefaultVMName is used if name is empty.
+func ShowPlan(uc UserChoice, installer, name string) error {
+	Log.Info("Dry run, nothing will be downloaded or installed.")
+	showSpec(uc)
+	images := []VMImage{uc.VMImage}
+	if len(uc.VMImage.Parts) > 0 {
+		Log.Infof("Archive is split into %d parts.", len(uc.VMImage.Parts))
+		images = uc.VMImage.Parts
+	}
+	for _, image := range images {
+		if err := showImagePlan(image); err != nil {
+			return err
+		}
+	}
+
+	Log.Info("Archive path:", archivePath(uc))
+	// NOTE: exact VM file name is known only after unzip, so only its folder is shown.
+	unzipFolder := unzipFolderPath(uc)
+	Log.Info("Unzip path:", unzipFolder)
+	showInstallCommands(uc, pathJoin(unzipFolder, "<VM file>"), installer, name)
+	return nil
+}
+
+// ShowArchivePlan function shows where an already downloaded VM archive would be unzipped and commands which would
+// be run to install the VM. Nothing is written to disk and no commands are run. UserChoice.DownloadPath must be
+// the archive folder, see Options.ArchivePath.
+func ShowArchivePlan(uc UserChoice, installer, name string) {
+	Log.Info("Dry run, nothing will be unzipped or installed.")
+	showSpec(uc)
+	Log.Info("Archive path:", archivePath(uc))
+	unzipFolder := unzipFolderPath(uc)
+	Log.Info("Unzip path:", unzipFolder)
+	showInstallCommands(uc, pathJoin(unzipFolder, "<VM file>"), installer, name)
+}
+
+// ShowInstallPlan function shows commands which would be run to install a VM file found in an already unzipped
+// folder. No commands are run. See FindVMFile.
+func ShowInstallPlan(uc UserChoice, vmPath, installer, name string) {
+	Log.Info("Dry run, nothing will be installed.")
+	showSpec(uc)
+	Log.Info("VM path:", vmPath)
+	showInstallCommands(uc, vmPath, installer, name)
+}
+
+// ShowBatchPlan function shows VM archives which DownloadBatch would download for a given platform and paths they
+// would be saved to. Nothing is written to disk.
+func ShowBatchPlan(availableVms AvailableVM, platform, downloadPath string) error {
+	Log.Info("Dry run, nothing will be downloaded.")
+	jobs := batchJobs(availableVms, platform)
+	Log.Infof("%d VM archives would be downloaded.", len(jobs))
+	for _, job := range jobs {
+		Log.Infof("%s, %s, %s", job.Platform, job.Hypervisor, job.BrowserOs)
+		if err := showImagePlan(job.VMImage); err != nil {
+			return err
+		}
+		Log.Info("Archive path:", pathJoin(pathJoin(downloadPath, job.Hypervisor), path.Base(job.FileURL)))
+	}
+	return nil
+}
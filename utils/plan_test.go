@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestInstallCommands(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("commands are quoted for Windows shell")
+	}
+	defer func(group string) { VMGroup = group }(VMGroup)
+	VMGroup = "/getIE"
+	tests := []struct {
+		hypervisor string
+		vmPath     string
+		want       []string
+	}{
+		{"VirtualBox", "/vms/IE11 - Win7/IE11 - Win7.ova", []string{
+			"vboxmanage import '/vms/IE11 - Win7/IE11 - Win7.ova' --vsys 0 --vmname 'IE11 - Win7' --group /getIE"}},
+		{"VMware", "/vms/IE11 - Win7/IE11 - Win7.ovf", []string{
+			"ovftool '--name=IE11 - Win7' '/vms/IE11 - Win7/IE11 - Win7.ovf' '/vms/IE11 - Win7/IE11 - Win7.vmx'",
+			"vmrun start '/vms/IE11 - Win7/IE11 - Win7.vmx'",
+			"vmrun stop '/vms/IE11 - Win7/IE11 - Win7.vmx'"}},
+		{"Vagrant", "/vms/IE11 - Win7/IE11 - Win7.box", []string{
+			"vagrant box add --name getie/ie11-win7 '/vms/IE11 - Win7/IE11 - Win7.box'"}},
+		{"Proxmox", "/vms/IE11 - Win7/IE11 - Win7.ova", []string{
+			"pvesh get /cluster/nextid",
+			"qm create <next id> --name ie11-win7 --memory 2048 --cores 2 --ostype win7 --net0 e1000,bridge=vmbr0",
+			"qm importdisk <next id> '<disk>.vmdk' " + ProxmoxStorage,
+			"qm set <next id> --sata0 <imported volume> --boot order=sata0"}},
+		{"QEMU", "/vms/IE11/IE11-disk1.vmdk", []string{
+			"qemu-img convert -O qcow2 /vms/IE11/IE11-disk1.vmdk /vms/IE11/IE11-disk1.qcow2",
+			"virt-install --import --print-xml --name 'IE11 - Win7' --memory 2048 --vcpus 2 --disk " +
+				"path=/vms/IE11/IE11-disk1.qcow2,format=qcow2 --os-variant win7 --noautoconsole > /vms/IE11/IE11-disk1.xml",
+			"virsh define /vms/IE11/IE11-disk1.xml"}},
+		{"Unknown", "/vms/IE11/IE11.ova", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.hypervisor, func(t *testing.T) {
+			got := installCommands(test.hypervisor, test.vmPath, "IE11 - Win7")
+			if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestQuoteArg(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("arguments are quoted for Windows shell")
+	}
+	tests := []struct {
+		arg  string
+		want string
+	}{
+		{"/vms/IE11.ova", "/vms/IE11.ova"},
+		{"IE11 - Win7", "'IE11 - Win7'"},
+		{"it's", `'it'\''s'`},
+		{"$HOME", "'$HOME'"},
+		{"<next id>", "<next id>"},
+		{"/vms/<VM file>", "'/vms/<VM file>'"},
+	}
+	for _, test := range tests {
+		if got := quoteArg(test.arg); got != test.want {
+			t.Errorf("quoteArg(%q) = %s, want %s", test.arg, got, test.want)
+		}
+	}
+}
+
+func TestDownloadJSONDryRunDoesNotCache(t *testing.T) {
+	cs := newCatalogServer(t, nil)
+	os.Remove(catalogCachePath())
+	DryRun = true
+	defer func() { DryRun = false }()
+	runCatalog(t, cs, t.TempDir())
+	if _, err := os.Stat(catalogCachePath()); !os.IsNotExist(err) {
+		t.Errorf("catalog is cached in dry run: %v", err)
+	}
+}
+
+func TestShowBatchPlan(t *testing.T) {
+	archives := map[string]string{"/IE11.Win7.zip": "win7 archive", "/IE11.Win81.zip": "win81 archive"}
+	server, downloads := batchServer(t, archives, 0)
+	downloadPath := filepath.Join(t.TempDir(), "VMs")
+	console := captureConsole(t)
+
+	if err := ShowBatchPlan(batchVMs(server.URL, archives), "Linux", downloadPath); err != nil {
+		t.Fatalf("ShowBatchPlan: %s", err)
+	}
+	if *downloads != 0 {
+		t.Errorf("%d archives are downloaded in dry run", *downloads)
+	}
+	if _, err := os.Stat(downloadPath); !os.IsNotExist(err) {
+		t.Errorf("download path is created in dry run: %v", err)
+	}
+	for name := range archives {
+		want := filepath.Join(downloadPath, "VirtualBox", strings.TrimPrefix(name, "/"))
+		if !strings.Contains(console.String(), "Archive path: "+want) {
+			t.Errorf("plan doesn't show %s:\n%s", want, console.String())
+		}
+	}
+}
+
+func TestShowArchivePlan(t *testing.T) {
+	downloadPath := t.TempDir()
+	uc := writeTestZip(t, downloadPath, "IE11.Win7.VirtualBox.zip", map[string]string{"IE11 - Win7/IE11 - Win7.ova": "ova"})
+	out := captureConsole(t)
+
+	ShowArchivePlan(uc, "", "")
+	unzipFolder := filepath.Join(downloadPath, "IE11.Win7.VirtualBox")
+	if !strings.Contains(out.String(), "Unzip path: "+unzipFolder) {
+		t.Errorf("unzip path isn't shown:\n%s", out)
+	}
+	if !strings.Contains(out.String(), "vboxmanage import") {
+		t.Errorf("install commands aren't shown:\n%s", out)
+	}
+	if _, err := os.Stat(unzipFolder); !os.IsNotExist(err) {
+		t.Errorf("archive was unzipped: %v", err)
+	}
+}
+
+func TestShowInstallPlan(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("commands are quoted for Windows shell")
+	}
+	defer func(group string) { VMGroup = group }(VMGroup)
+	VMGroup = "/getIE"
+	uc := UserChoice{Spec: Spec{Platform: "Linux", Hypervisor: "VirtualBox"}}
+	out := captureConsole(t)
+
+	ShowInstallPlan(uc, "/vms/IE11 - Win7/IE11 - Win7.ova", "", "")
+	want := "vboxmanage import '/vms/IE11 - Win7/IE11 - Win7.ova' --vsys 0 --vmname 'IE11 - Win7' --group /getIE"
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("output doesn't contain %q:\n%s", want, out)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+// Package utils contains various supplementary functions and data structures.
+// This file process_other.go contains process functions for non-Windows platforms.
+package utils
+
+import "syscall"
+
+// processAlive function checks if a process with a given PID is running. Signal 0 only checks that the process
+// exists, EPERM means it exists but belongs to another user.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,27 @@
+// Package utils contains various supplementary functions and data structures.
+// This file process_windows.go contains Windows specific process functions.
+package utils
+
+import "syscall"
+
+const (
+	// processQueryLimitedInformation is an access right required to get an exit code of a process.
+	processQueryLimitedInformation = 0x1000
+	// stillActive is an exit code of a running process.
+	stillActive = 259
+)
+
+// processAlive function checks if a process with a given PID is running. A process which can't be opened because
+// of access rights is considered running.
+func processAlive(pid int) bool {
+	handle, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return err == syscall.ERROR_ACCESS_DENIED
+	}
+	defer syscall.CloseHandle(handle)
+	var exitCode uint32
+	if err := syscall.GetExitCodeProcess(handle, &exitCode); err != nil {
+		return true
+	}
+	return exitCode == stillActive
+}
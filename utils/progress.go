@@ -0,0 +1,168 @@
+// Package utils contains various supplementary functions and data structures.
+// This file progress.go contains a display which coordinates progress lines of simultaneous operations.
+package utils
+
+import (
+	"fmt"
+	"sync"
+)
+
+// progressBar type defines the last state of a single progress line registered in progressDisplay.
+type progressBar struct {
+	label string
+	line  string
+	total int64
+	// size is -1 if it is unknown.
+	size int64
+}
+
+// progressDisplay type draws progress lines of all running operations. On ANSI terminals every operation has its
+// own line and the lines are redrawn in place, finished lines are left above them. Other outputs get a single
+// line which is rewritten, it shows totals if several operations run at once.
+// Log messages are written between progress redraws, see suspend method.
+type progressDisplay struct {
+	mutex sync.Mutex
+	bars  []*progressBar
+	// drawn is the number of lines drawn on ANSI terminal which must be moved over before the next redraw.
+	drawn int
+	// partial is true if a single line without a new line is drawn on other outputs.
+	partial bool
+}
+
+// display var is the progress display shared by all ProgressWrapper instances.
+var display = &progressDisplay{}
+
+// register method adds a new progress line with a given label which is shown if several lines are drawn.
+func (pd *progressDisplay) register(label string) *progressBar {
+	pd.mutex.Lock()
+	defer pd.mutex.Unlock()
+	bar := &progressBar{label: label, size: -1}
+	pd.bars = append(pd.bars, bar)
+	return bar
+}
+
+// update method stores a new state of a progress line and redraws the display. A finished line is removed from
+// the display and it is written as a regular line.
+func (pd *progressDisplay) update(bar *progressBar, line string, total, size int64, finished bool) {
+	pd.mutex.Lock()
+	defer pd.mutex.Unlock()
+	bar.line, bar.total, bar.size = line, total, size
+	if !finished {
+		pd.draw()
+		return
+	}
+
+	final := pd.render(bar)
+	if pd.partial {
+		// NOTE: the final line replaces the single rewritten line.
+		fmt.Fprint(Console, "\r")
+		pd.partial = false
+	}
+	pd.unregister(bar)
+	pd.erase()
+	fmt.Fprintf(Console, "%-80s\n", final)
+	pd.draw()
+}
+
+// remove method removes a progress line of an operation which failed or was stopped before it finished.
+func (pd *progressDisplay) remove(bar *progressBar) {
+	pd.mutex.Lock()
+	defer pd.mutex.Unlock()
+	pd.erase()
+	pd.unregister(bar)
+	pd.draw()
+}
+
+// unregister method removes a given bar from the list, the caller must hold the mutex.
+func (pd *progressDisplay) unregister(bar *progressBar) {
+	for idx, registered := range pd.bars {
+		if registered == bar {
+			pd.bars = append(pd.bars[:idx], pd.bars[idx+1:]...)
+			return
+		}
+	}
+}
+
+// suspend method erases progress lines, so a message could be written, and returns a function which draws them
+// again.
+func (pd *progressDisplay) suspend() func() {
+	pd.mutex.Lock()
+	if len(pd.bars) == 0 {
+		pd.mutex.Unlock()
+		return func() {}
+	}
+	pd.erase()
+	return func() {
+		pd.draw()
+		pd.mutex.Unlock()
+	}
+}
+
+// render method returns a line of a given bar, it is labeled if several operations run at once.
+func (pd *progressDisplay) render(bar *progressBar) string {
+	if len(pd.bars) > 1 && bar.label != "" {
+		return bar.label + " " + bar.line
+	}
+	return bar.line
+}
+
+// erase method removes drawn progress lines, the caller must hold the mutex.
+func (pd *progressDisplay) erase() {
+	if pd.drawn > 0 {
+		// NOTE: the cursor is moved up to the first drawn line and everything below it is cleared.
+		fmt.Fprintf(Console, "\x1b[%dA\r\x1b[J", pd.drawn)
+		pd.drawn = 0
+	}
+	if pd.partial {
+		fmt.Fprintln(Console)
+		pd.partial = false
+	}
+}
+
+// draw method draws all progress lines, the caller must hold the mutex.
+func (pd *progressDisplay) draw() {
+	if len(pd.bars) == 0 {
+		return
+	}
+	if ansiTerminal(Console) {
+		if pd.drawn > 0 {
+			fmt.Fprintf(Console, "\x1b[%dA", pd.drawn)
+		}
+		pd.drawn = 0
+		for _, bar := range pd.bars {
+			// NOTE: a bar is registered before its first line is ready.
+			if bar.line != "" {
+				fmt.Fprintf(Console, "\r\x1b[K%s\n", pd.render(bar))
+				pd.drawn++
+			}
+		}
+		return
+	}
+
+	// Progress is shown on a single line which is rewritten each time, so the line is padded to clear
+	// leftovers of a previous longer line.
+	line := pd.bars[0].line
+	if len(pd.bars) > 1 {
+		line = pd.totalLine()
+	}
+	fmt.Fprintf(Console, "\r%-80s", line)
+	pd.partial = true
+}
+
+// totalLine method formats progress of all running operations as a single line, the caller must hold the mutex.
+func (pd *progressDisplay) totalLine() string {
+	var total, size int64
+	for _, bar := range pd.bars {
+		total += bar.total
+		if size >= 0 && bar.size > 0 {
+			size += bar.size
+		} else {
+			size = -1
+		}
+	}
+	sizeText := "?"
+	if size > 0 {
+		sizeText = humanBytes(size)
+	}
+	return fmt.Sprintf("%d running: %s/%s", len(pd.bars), humanBytes(total), sizeText)
+}
@@ -0,0 +1,174 @@
+// Package utils contains various supplementary functions and data structures.
+// This file resources.go contains functions to adjust CPU and memory of imported VMs.
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// VMCPUs var defines number of virtual CPUs set for imported VMs. Zero means the VM archive default is kept.
+var VMCPUs = 0
+
+// VMMemory var defines memory size in megabytes set for imported VMs. Zero means the VM archive default is kept.
+var VMMemory = 0
+
+const (
+	// maxVMCPUs const defines the largest number of virtual CPUs accepted by all supported hypervisors.
+	maxVMCPUs = 32
+	// minVMMemory and maxVMMemory consts define memory range in megabytes which is reasonable for Windows VMs.
+	minVMMemory = 512
+	maxVMMemory = 65536
+)
+
+// ValidateVMResources function checks the number of virtual CPUs and memory size in megabytes. Zero values mean
+// the setting isn't changed.
+func ValidateVMResources(cpus, memory int) error {
+	if cpus < 0 || cpus > maxVMCPUs {
+		return fmt.Errorf("number of CPUs must be from 1 to %d", maxVMCPUs)
+	}
+	if memory != 0 && (memory < minVMMemory || memory > maxVMMemory) {
+		return fmt.Errorf("memory must be from %d to %d MB", minVMMemory, maxVMMemory)
+	}
+	return nil
+}
+
+// vmxSettingRe matches a single setting line of VMware .vmx file.
+var vmxSettingRe = regexp.MustCompile(`^\s*([\w.:]+)\s*=`)
+
+// setVmxSettings function replaces given settings in VMware .vmx file or Xen domain config, missed settings are
+// appended.
+func setVmxSettings(vmxPath string, settings map[string]string) error {
+	info, err := os.Stat(vmxPath)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(vmxPath)
+	if err != nil {
+		return err
+	}
+	eol := lineEnding(content)
+	lines := strings.Split(strings.TrimRight(string(content), "\r\n"), "\n")
+	for idx, line := range lines {
+		lines[idx] = strings.TrimSuffix(line, "\r")
+	}
+	written := make(map[string]bool)
+	for idx, line := range lines {
+		match := vmxSettingRe.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		if value, ok := settings[match[1]]; ok {
+			lines[idx] = fmt.Sprintf("%s = \"%s\"", match[1], value)
+			written[match[1]] = true
+		}
+	}
+	for name, value := range settings {
+		if !written[name] {
+			lines = append(lines, fmt.Sprintf("%s = \"%s\"", name, value))
+		}
+	}
+	return ioutil.WriteFile(vmxPath, []byte(strings.Join(lines, eol)+eol), info.Mode())
+}
+
+// resourceCommands function returns commands which set CPUs and memory of an imported VM. vmID is the ID returned
+// by verifyImported. Nil is returned if a hypervisor doesn't support changing resources with its tools.
+func resourceCommands(hypervisor, name, vmID string, cpus, memory int) [][]string {
+	var commands [][]string
+	switch hypervisor {
+	case "VirtualBox":
+		args := []string{vboxManageCmd, "modifyvm", name}
+		if cpus > 0 {
+			args = append(args, "--cpus", strconv.Itoa(cpus))
+		}
+		if memory > 0 {
+			args = append(args, "--memory", strconv.Itoa(memory))
+		}
+		commands = append(commands, args)
+	case "HyperV":
+		if cpus > 0 {
+			commands = append(commands, []string{"powershell", "-NoProfile", "-NonInteractive", "-Command",
+				fmt.Sprintf("Set-VMProcessor -VMName %s -Count %d", psQuote(name), cpus)})
+		}
+		if memory > 0 {
+			commands = append(commands, []string{"powershell", "-NoProfile", "-NonInteractive", "-Command",
+				fmt.Sprintf("Set-VMMemory -VMName %s -StartupBytes %dMB", psQuote(name), memory)})
+		}
+	case "Parallels":
+		args := []string{"prlctl", "set", name}
+		if cpus > 0 {
+			args = append(args, "--cpus", strconv.Itoa(cpus))
+		}
+		if memory > 0 {
+			args = append(args, "--memsize", strconv.Itoa(memory))
+		}
+		commands = append(commands, args)
+	case "QEMU":
+		if cpus > 0 {
+			commands = append(commands,
+				[]string{"virsh", "setvcpus", name, strconv.Itoa(cpus), "--config", "--maximum"},
+				[]string{"virsh", "setvcpus", name, strconv.Itoa(cpus), "--config"})
+		}
+		if memory > 0 {
+			size := strconv.Itoa(memory) + "M"
+			commands = append(commands,
+				[]string{"virsh", "setmaxmem", name, size, "--config"},
+				[]string{"virsh", "setmem", name, size, "--config"})
+		}
+	case "Proxmox":
+		args := []string{"qm", "set", vmID}
+		if cpus > 0 {
+			args = append(args, "--cores", strconv.Itoa(cpus))
+		}
+		if memory > 0 {
+			args = append(args, "--memory", strconv.Itoa(memory))
+		}
+		commands = append(commands, args)
+	}
+	return commands
+}
+
+// setVMResources function sets CPUs and memory of an imported VM if VMCPUs or VMMemory are set.
+func setVMResources(hypervisor, name, vmID string) error {
+	if VMCPUs == 0 && VMMemory == 0 {
+		return nil
+	}
+	Log.Infof("Setting %d CPUs and %d MB of memory for VM '%s', 0 means unchanged.", VMCPUs, VMMemory, name)
+	if hypervisor == "VMware" {
+		// NOTE: vmID of VMware VM is a path to its .vmx file.
+		settings := make(map[string]string)
+		if VMCPUs > 0 {
+			settings["numvcpus"] = strconv.Itoa(VMCPUs)
+		}
+		if VMMemory > 0 {
+			settings["memsize"] = strconv.Itoa(VMMemory)
+		}
+		return setVmxSettings(vmID, settings)
+	}
+	if hypervisor == "Xen" {
+		// NOTE: vmID of Xen VM is a path to its xl domain config which has the same syntax as .vmx files.
+		settings := make(map[string]string)
+		if VMCPUs > 0 {
+			settings["vcpus"] = strconv.Itoa(VMCPUs)
+		}
+		if VMMemory > 0 {
+			settings["memory"] = strconv.Itoa(VMMemory)
+		}
+		return setVmxSettings(vmID, settings)
+	}
+	commands := resourceCommands(hypervisor, name, vmID, VMCPUs, VMMemory)
+	if commands == nil {
+		return fmt.Errorf("%s doesn't support changing CPUs and memory", hypervisor)
+	}
+	for _, command := range commands {
+		if result, err := execCommand(command[0], command[1:]...).CombinedOutput(); err != nil {
+			Log.Error(string(result))
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+// Package utils contains various supplementary functions and data structures.
+// This file run.go contains a single entry point to download, unzip and install a VM from other Go programs.
+package utils
+
+import (
+	"context"
+	"fmt"
+)
+
+// Options type defines optional settings of Run function.
+type Options struct {
+	// Context stops the download when it is cancelled. context.Background is used if it is nil.
+	Context context.Context
+	// Download defines download settings, e.g. progress callback.
+	Download DownloadOptions
+	// Installer is an external command used instead of built-in hypervisor import, see RunInstaller.
+	Installer string
+	// VMName is a name of the imported VM. DefaultVMName is used if it is empty, or VM file name if a browser is unknown.
+	VMName string
+	// DeleteArchive removes VM archive after successful install.
+	DeleteArchive bool
+	// ArchivePath is a path to an already downloaded VM archive, the download step is skipped if it is set.
+	// The archive must be named as in the catalog and UserChoice.DownloadPath must be its folder.
+	ArchivePath string
+	// VMPath is a path to a VM file in an already unzipped folder, download and unzip steps are skipped if it is
+	// set. See FindVMFile.
+	VMPath string
+	// DownloadOnly stops the run after the download step. It can't be combined with ArchivePath or VMPath.
+	DownloadOnly bool
+	// StepFinished is called with a message after download and unzip steps, it could be nil.
+	StepFinished func(msg string)
+	// PhaseStarted is called with a phase number, total number of phases and a phase name when the next phase
+	// starts, it could be nil. See ShowPhase.
+	PhaseStarted func(phase, total int, name string)
+}
+
+// ShowPhase function shows which phase of the whole run has started, e.g. '[2/3] Unzipping...'.
+func ShowPhase(phase, total int, name string) {
+	fmt.Fprintf(Console, "[%d/%d] %s...\n", phase, total, name)
+}
+
+// importName function returns a name of the imported VM, DefaultVMName is used if name is empty.
+func importName(uc UserChoice, vmPath, name string) string {
+	if name != "" {
+		return name
+	}
+	if uc.BrowserOs == "" {
+		// NOTE: browser and OS could be unknown for VM installed from a folder, its file name is used then.
+		return vmName(vmPath)
+	}
+	return DefaultVMName(uc)
+}
+
+// Run function downloads, unzips and installs VM defined by a pre-built UserChoice. It doesn't exit or panic,
+// outcomes of finished steps are returned in RunSummary even if a step failed, they are recorded in the history
+// too. Some steps could ask a user for confirmation, set AssumeYes to avoid reading stdin.
+func Run(uc UserChoice, opts Options) (RunSummary, error) {
+	if opts.DownloadOnly && (opts.ArchivePath != "" || opts.VMPath != "") {
+		// NOTE: there is nothing to download, so such run would do nothing or steps which weren't asked for.
+		err := fmt.Errorf("download only run can't start from a downloaded archive or an unzipped VM")
+		return RunSummary{UserChoice: uc, Err: err}, err
+	}
+	summary := RunSummary{UserChoice: uc}
+	name := ""
+	defer func() {
+		recordRun(summary, name)
+	}()
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	stepFinished := opts.StepFinished
+	if stepFinished == nil {
+		stepFinished = func(string) {}
+	}
+	var phases []string
+	if opts.VMPath != "" {
+		phases = append(phases, "Installing")
+	} else {
+		if opts.ArchivePath == "" {
+			phases = append(phases, "Downloading")
+		}
+		if !opts.DownloadOnly {
+			phases = append(phases, "Unzipping", "Installing")
+			if opts.DeleteArchive {
+				phases = append(phases, "Deleting archive")
+			}
+		}
+	}
+	phase := 0
+	nextPhase := func() {
+		if opts.PhaseStarted != nil {
+			opts.PhaseStarted(phase+1, len(phases), phases[phase])
+		}
+		phase++
+	}
+
+	downloadOpts := opts.Download
+	downloadOpts.Finished = func(stats DownloadStats) {
+		summary.Download.Bytes += stats.Bytes
+		summary.Download.Elapsed += stats.Elapsed
+		if opts.Download.Finished != nil {
+			opts.Download.Finished(stats)
+		}
+	}
+
+	archivePath := opts.ArchivePath
+	vmPath := opts.VMPath
+	summary.ArchivePath = archivePath
+	summary.VMPath = vmPath
+	if vmPath == "" && archivePath == "" {
+		nextPhase()
+		var err error
+		if archivePath, err = DownloadVM(ctx, uc, downloadOpts); err != nil {
+			summary.Err = err
+			return summary, err
+		}
+		summary.ArchivePath = archivePath
+		summary.Verified = true
+		if opts.DownloadOnly {
+			return summary, nil
+		}
+		stepFinished("Download finished.")
+	}
+
+	if vmPath == "" {
+		nextPhase()
+		var err error
+		if vmPath, summary.UnzipFolder, err = unzipVM(uc); err != nil {
+			summary.Err = err
+			return summary, err
+		}
+		summary.VMPath = vmPath
+		stepFinished("Unzip finished.")
+	}
+
+	var err error
+	nextPhase()
+	imported := true
+	if opts.Installer != "" {
+		err = RunInstaller(opts.Installer, uc, vmPath)
+	} else {
+		name = importName(uc, vmPath, opts.VMName)
+		imported, err = installVM(ctx, uc.Hypervisor, vmPath, name)
+	}
+	if err != nil {
+		summary.Err = err
+		return summary, err
+	}
+	summary.Installed = imported
+	summary.AlreadyImported = !imported
+
+	if opts.DeleteArchive && opts.VMPath == "" {
+		nextPhase()
+		if err := DeleteArchive(uc, archivePath); err != nil {
+			Log.Warnf("Can't delete archive: %s", err)
+		}
+	}
+	return summary, nil
+}
+
+// RunAll function runs several VMs one by one with the same options. A failed VM doesn't stop the others,
+// outcomes of every VM are returned in the same order. VMName option is ignored if there are several VMs because
+// imported VMs must have different names, DefaultVMName is used instead.
+func RunAll(userChoices []UserChoice, opts Options) []RunSummary {
+	if len(userChoices) > 1 {
+		opts.VMName = ""
+	}
+	summaries := make([]RunSummary, 0, len(userChoices))
+	for idx, uc := range userChoices {
+		if opts.Context != nil && opts.Context.Err() != nil {
+			summaries = append(summaries, RunSummary{UserChoice: uc, Err: opts.Context.Err()})
+			continue
+		}
+		Log.Infof("VM %d of %d: %s for %s", idx+1, len(userChoices), uc.BrowserOs, uc.Hypervisor)
+		summary, err := Run(uc, opts)
+		if err != nil {
+			Log.Errorf("%s for %s failed: %s", uc.BrowserOs, uc.Hypervisor, err)
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries
+}
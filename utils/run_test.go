@@ -0,0 +1,258 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain function keeps tests away from user's home folder and terminal: the catalog cache, history and
+// other state files are written into a temporary HOME and messages are discarded.
+func TestMain(m *testing.M) {
+	home, err := ioutil.TempDir("", "getie-home")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Setenv("HOME", home)
+	os.Setenv("USERPROFILE", home)
+	Console = ioutil.Discard
+	ErrConsole = ioutil.Discard
+	RetryDelay = time.Millisecond
+	AssumeYes = true
+	code := m.Run()
+	os.RemoveAll(home)
+	os.Exit(code)
+}
+
+// newTestZip function builds a zip archive in memory with given files, keys are entry names.
+func newTestZip(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	for name, content := range files {
+		entry, err := writer.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := entry.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// catalogServer type is a fake Microsoft VMs site which serves a catalog page, a VM zip archive and its md5 file.
+type catalogServer struct {
+	*httptest.Server
+	archive []byte
+	md5     string
+}
+
+// newCatalogServer function starts a fake VMs site, the catalog lists a single VirtualBox VM for Linux.
+func newCatalogServer(t *testing.T, archive []byte) *catalogServer {
+	t.Helper()
+	cs := &catalogServer{archive: archive, md5: fmt.Sprintf("%X", md5.Sum(archive))}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/vms/", func(w http.ResponseWriter, r *http.Request) {
+		catalog := fmt.Sprintf(`{"active": true, "softwareList": [{"osList": ["Linux"], "softwareName": "VirtualBox",
+			"vms": [{"browserName": "IE11", "osVersion": "Win7", "files": [{"name": "IE11.Win7.VirtualBox.zip",
+			"url": "%[1]s/files/IE11.Win7.VirtualBox.zip", "md5": "%[1]s/files/IE11.Win7.VirtualBox.zip.md5.txt"}]}]}]}`,
+			cs.URL)
+		fmt.Fprintf(w, "<html><head><title>VMs</title></head><body><script>var vms = %s;</script></body></html>", catalog)
+	})
+	mux.HandleFunc("/files/IE11.Win7.VirtualBox.zip", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "IE11.Win7.VirtualBox.zip", time.Time{}, bytes.NewReader(cs.archive))
+	})
+	mux.HandleFunc("/files/IE11.Win7.VirtualBox.zip.md5.txt", func(w http.ResponseWriter, r *http.Request) {
+		// NOTE: Microsoft's md5 files are lower case with Windows line ending.
+		fmt.Fprintf(w, "%s\r\n", strings.ToLower(cs.md5))
+	})
+	cs.Server = httptest.NewServer(mux)
+	t.Cleanup(cs.Close)
+	return cs
+}
+
+// runCatalog function downloads and parses the catalog of a given server and returns a choice of its only VM.
+func runCatalog(t *testing.T, cs *catalogServer, downloadPath string) UserChoice {
+	t.Helper()
+	Insecure = true
+	defer func() { Insecure = false }()
+	rawData, err := DownloadJSON(cs.URL + "/vms/")
+	if err != nil {
+		t.Fatalf("DownloadJSON: %s", err)
+	}
+	_, _, browsers, availableVms, err := ParseJSON(&rawData)
+	if err != nil {
+		t.Fatalf("ParseJSON: %s", err)
+	}
+	if got := browsers["VirtualBox"]; len(got) != 1 || got[0] != "IE11 Win7" {
+		t.Fatalf("browsers = %v, want [IE11 Win7]", got)
+	}
+	spec := Spec{Platform: "Linux", Hypervisor: "VirtualBox", BrowserOs: "IE11 Win7"}
+	vm, ok := availableVms[spec]
+	if !ok {
+		t.Fatalf("%v isn't available", spec)
+	}
+	return UserChoice{Spec: spec, VMImage: vm, DownloadPath: downloadPath}
+}
+
+func TestDownloadAndUnzipVM(t *testing.T) {
+	ova := strings.Repeat("ova data ", 1000)
+	cs := newCatalogServer(t, newTestZip(t, map[string]string{"IE11 - Win7/IE11 - Win7.ova": ova}))
+	downloadPath := t.TempDir()
+	uc := runCatalog(t, cs, downloadPath)
+
+	archivePath, err := DownloadVM(context.Background(), uc, DownloadOptions{})
+	if err != nil {
+		t.Fatalf("DownloadVM: %s", err)
+	}
+	if want := filepath.Join(downloadPath, "IE11.Win7.VirtualBox.zip"); archivePath != want {
+		t.Errorf("archive path = %s, want %s", archivePath, want)
+	}
+	if _, err := os.Stat(partialFilePath(archivePath)); !os.IsNotExist(err) {
+		t.Errorf("partial file is left after download: %v", err)
+	}
+	content, err := ioutil.ReadFile(archivePath)
+	if err != nil || !bytes.Equal(content, cs.archive) {
+		t.Fatalf("downloaded archive differs from the served one: %v", err)
+	}
+
+	vmPath, err := UnzipVM(uc)
+	if err != nil {
+		t.Fatalf("UnzipVM: %s", err)
+	}
+	if want := filepath.Join(downloadPath, "IE11.Win7.VirtualBox", "IE11 - Win7", "IE11 - Win7.ova"); vmPath != want {
+		t.Errorf("VM path = %s, want %s", vmPath, want)
+	}
+	if content, err := ioutil.ReadFile(vmPath); err != nil || string(content) != ova {
+		t.Errorf("unzipped VM file differs from the archived one: %v", err)
+	}
+
+	// The second download finds the verified archive and doesn't replace it.
+	if _, err := DownloadVM(context.Background(), uc, DownloadOptions{}); err != nil {
+		t.Errorf("DownloadVM of existing archive: %s", err)
+	}
+}
+
+func TestDownloadVMChecksumMismatch(t *testing.T) {
+	cs := newCatalogServer(t, newTestZip(t, map[string]string{"IE11 - Win7/IE11 - Win7.ova": "ova"}))
+	cs.md5 = strings.Repeat("0", 32)
+	downloadPath := t.TempDir()
+	uc := runCatalog(t, cs, downloadPath)
+
+	defer func(retries int) { MaxRetries = retries }(MaxRetries)
+	MaxRetries = 1
+	if _, err := DownloadVM(context.Background(), uc, DownloadOptions{}); err == nil {
+		t.Fatal("DownloadVM succeeded with wrong md5 sum")
+	}
+	for _, name := range []string{"IE11.Win7.VirtualBox.zip", "IE11.Win7.VirtualBox.zip.partial"} {
+		if _, err := os.Stat(filepath.Join(downloadPath, name)); !os.IsNotExist(err) {
+			t.Errorf("%s is left after failed verification: %v", name, err)
+		}
+	}
+}
+
+func TestDownloadJSONRejectsPlainHTTP(t *testing.T) {
+	cs := newCatalogServer(t, nil)
+	if _, err := DownloadJSON(cs.URL + "/vms/"); err == nil {
+		t.Fatal("catalog was downloaded over plain HTTP without Insecure")
+	}
+}
+
+func TestDownloadAndUnzipVMUnicodePaths(t *testing.T) {
+	tests := []struct {
+		name   string
+		folder string
+		entry  string
+	}{
+		{"cyrillic", "Загрузки", "IE11 - Win7/IE11 - Win7.ova"},
+		{"japanese", "ダウンロード", "IE11 - Win7/仮想マシン.ova"},
+		{"accents", "Téléchargements", "IE11 - Win7 é/IE11 - Win7 é.ova"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cs := newCatalogServer(t, newTestZip(t, map[string]string{test.entry: "ova"}))
+			downloadPath := filepath.Join(t.TempDir(), test.folder)
+			if err := os.Mkdir(downloadPath, 0755); err != nil {
+				t.Fatal(err)
+			}
+			uc := runCatalog(t, cs, downloadPath)
+
+			if _, err := DownloadVM(context.Background(), uc, DownloadOptions{}); err != nil {
+				t.Fatalf("DownloadVM: %s", err)
+			}
+			vmPath, err := UnzipVM(uc)
+			if err != nil {
+				t.Fatalf("UnzipVM: %s", err)
+			}
+			want := filepath.Join(downloadPath, "IE11.Win7.VirtualBox", filepath.FromSlash(test.entry))
+			if vmPath != want {
+				t.Errorf("VM path = %s, want %s", vmPath, want)
+			}
+			if content, err := ioutil.ReadFile(want); err != nil || string(content) != "ova" {
+				t.Errorf("%s is %q, %v, want unpacked VM", want, content, err)
+			}
+		})
+	}
+}
+
+func TestRunDownloadOnlyWithDownloadedArchive(t *testing.T) {
+	downloadPath := t.TempDir()
+	uc := writeTestZip(t, downloadPath, "IE11.Win7.VirtualBox.zip", map[string]string{"IE11 - Win7/IE11 - Win7.ova": "ova"})
+	archivePath := filepath.Join(downloadPath, "IE11.Win7.VirtualBox.zip")
+
+	phases := 0
+	summary, err := Run(uc, Options{
+		ArchivePath:  archivePath,
+		DownloadOnly: true,
+		PhaseStarted: func(int, int, string) { phases++ },
+	})
+	if err == nil || summary.Err == nil {
+		t.Fatal("download only run of a downloaded archive succeeded")
+	}
+	if phases != 0 {
+		t.Errorf("%d phases started, want none", phases)
+	}
+	if _, err := os.Stat(unzipFolderPath(uc)); !os.IsNotExist(err) {
+		t.Errorf("archive was unzipped: %v", err)
+	}
+}
+
+func TestRunSummaryUniqueUnzipFolder(t *testing.T) {
+	UniqueRun = true
+	defer func() { UniqueRun = false }()
+	stubCommands(t, map[string]fakeCommand{"installer": {}})
+	downloadPath := t.TempDir()
+	uc := writeTestZip(t, downloadPath, "IE11.Win7.VirtualBox.zip", map[string]string{"IE11 - Win7/IE11 - Win7.ova": "ova"})
+
+	summary, err := Run(uc, Options{
+		ArchivePath: filepath.Join(downloadPath, "IE11.Win7.VirtualBox.zip"),
+		Installer:   "installer {path}",
+	})
+	if err != nil {
+		t.Fatalf("Run: %s", err)
+	}
+	if !strings.HasPrefix(filepath.Base(summary.UnzipFolder), "IE11.Win7.VirtualBox-") {
+		t.Errorf("unzip folder %s has no per-run suffix", summary.UnzipFolder)
+	}
+	if want := filepath.Join(summary.UnzipFolder, "IE11 - Win7", "IE11 - Win7.ova"); summary.VMPath != want {
+		t.Errorf("VM path = %s, want %s", summary.VMPath, want)
+	}
+	if got := newSummaryJSON(summary).UnzipFolder; got != summary.UnzipFolder {
+		t.Errorf("JSON summary unzip folder = %s, want %s", got, summary.UnzipFolder)
+	}
+}
@@ -0,0 +1,81 @@
+// Package utils contains various supplementary functions and data structures.
+// This file sandbox.go contains functions to prepare Windows Sandbox configuration for a downloaded VM.
+package utils
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// sandboxDesktop const defines a desktop folder of the Windows Sandbox user, host folders are mapped into it.
+const sandboxDesktop = `C:\Users\WDAGUtilityAccount\Desktop`
+
+// sandboxConfig type defines Windows Sandbox .wsb configuration file.
+type sandboxConfig struct {
+	XMLName       xml.Name `xml:"Configuration"`
+	MappedFolders struct {
+		MappedFolder []sandboxMappedFolder `xml:"MappedFolder"`
+	} `xml:"MappedFolders"`
+	LogonCommand struct {
+		Command string `xml:"Command"`
+	} `xml:"LogonCommand"`
+}
+
+// sandboxMappedFolder type defines a host folder shared with Windows Sandbox.
+type sandboxMappedFolder struct {
+	HostFolder    string `xml:"HostFolder"`
+	SandboxFolder string `xml:"SandboxFolder"`
+	ReadOnly      bool   `xml:"ReadOnly"`
+}
+
+// checkWindowsSandbox function checks if Windows Sandbox optional feature is enabled.
+func checkWindowsSandbox(logger *Logger) (string, error) {
+	logger.Info("Checking Windows Sandbox installation.")
+	if runtime.GOOS != "windows" {
+		return "", fmt.Errorf("Windows Sandbox is available on Windows only")
+	}
+	sandboxPath := filepath.Join(os.Getenv("SystemRoot"), "System32", "WindowsSandbox.exe")
+	if _, err := os.Stat(sandboxPath); err != nil {
+		return "", fmt.Errorf("Windows Sandbox isn't enabled, enable 'Windows Sandbox' optional feature: %s", err)
+	}
+	logger.Info("Windows Sandbox is present.")
+	return "Windows Sandbox", nil
+}
+
+// sandboxConfigPath function returns a path of .wsb file created for a VM, it is placed next to the unzipped VM
+// folder.
+func sandboxConfigPath(vmPath, name string) string {
+	return filepath.Join(filepath.Dir(filepath.Dir(vmPath)), name+".wsb")
+}
+
+// newSandboxConfig function returns Windows Sandbox configuration which maps a folder with VM disk into the sandbox
+// read-only and opens it on logon.
+func newSandboxConfig(vmPath string) sandboxConfig {
+	vmFolder := filepath.Dir(vmPath)
+	sandboxFolder := sandboxDesktop + `\` + filepath.Base(vmFolder)
+	var config sandboxConfig
+	config.MappedFolders.MappedFolder = []sandboxMappedFolder{
+		{HostFolder: vmFolder, SandboxFolder: sandboxFolder, ReadOnly: true},
+	}
+	config.LogonCommand.Command = fmt.Sprintf(`explorer.exe "%s"`, sandboxFolder)
+	return config
+}
+
+// importSandboxVM function writes Windows Sandbox configuration for a VM. Windows Sandbox can't boot VM disks,
+// so the disk is only available inside a sandbox, e.g. to copy files from it.
+func importSandboxVM(vmPath, name string) error {
+	content, err := xml.MarshalIndent(newSandboxConfig(vmPath), "", "  ")
+	if err != nil {
+		return err
+	}
+	configPath := sandboxConfigPath(vmPath, name)
+	if err := ioutil.WriteFile(configPath, content, 0644); err != nil {
+		return err
+	}
+	Log.Infof("Windows Sandbox configuration is written to %s, open it to start the sandbox.", configPath)
+	return nil
+}
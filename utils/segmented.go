@@ -0,0 +1,136 @@
+// Package utils contains various supplementary functions and data structures.
+// This file segmented.go contains functions to download a file with several concurrent connections.
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+)
+
+// Connections var defines how many concurrent range requests are used to download a VM archive.
+// A single connection is used if it is 1 or if the server doesn't support range requests.
+var Connections = 1
+
+// offsetWriter type writes data into a file starting from a given offset.
+type offsetWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (ow *offsetWriter) Write(p []byte) (int, error) {
+	n, err := ow.file.WriteAt(p, ow.offset)
+	ow.offset += int64(n)
+	return n, err
+}
+
+// segmentReader type reports read bytes into a progress shared by all segments.
+type segmentReader struct {
+	io.Reader
+	progress *ProgressWrapper
+}
+
+func (sr *segmentReader) Read(p []byte) (int, error) {
+	n, err := sr.Reader.Read(p)
+	sr.progress.advance(n, false)
+	return n, err
+}
+
+// downloadSegment function downloads a given inclusive bytes range of a file into the same range of a local file.
+func downloadSegment(ctx context.Context, fileURL string, file *os.File, start, end int64, progress *ProgressWrapper,
+	limiter *rateLimiter) error {
+	resp, err := httpGetRange(ctx, fileURL, start, end)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("server ignored range request for bytes %d-%d: %s", start, end, resp.Status)
+	}
+
+	src := &segmentReader{Reader: throttle(ctx, resp.Body, limiter), progress: progress}
+	written, err := io.CopyBuffer(&offsetWriter{file: file, offset: start}, src, make([]byte, CopyBufferSize))
+	if err != nil {
+		return err
+	}
+	if written != end-start+1 {
+		return fmt.Errorf("segment %d-%d is incomplete, got %d bytes", start, end, written)
+	}
+	return nil
+}
+
+// minSegmentSize var defines the smallest segment in bytes which is downloaded with its own connection.
+var minSegmentSize int64 = 1024 * 1024
+
+// downloadSegmented function downloads a given URL into a file using Connections concurrent range requests
+// and returns checksum of the file. If the server doesn't support range requests a single connection is used.
+func downloadSegmented(ctx context.Context, fileURL string, file *os.File, algo string, opts *DownloadOptions) (string, error) {
+	size, acceptRanges, err := remoteInfo(ctx, fileURL)
+	if err != nil || !acceptRanges || size <= 0 {
+		switch {
+		case err != nil:
+			Log.Warnf("Can't get file info, download with a single connection: %s", err)
+		case !acceptRanges:
+			Log.Info("Server doesn't support range requests, download with a single connection.")
+		default:
+			Log.Warn("Server didn't report file size, download with a single connection.")
+		}
+		checksum, _, err := downloadFile(ctx, fileURL, file, algo, opts)
+		return checksum, err
+	}
+
+	// NOTE: the file is preallocated so segments could be written at their offsets in any order.
+	if err := file.Truncate(size); err != nil {
+		return "", err
+	}
+	// NOTE: small files are split into fewer segments, so no segment is empty or too small to be worth a request.
+	connections := Connections
+	if maxConnections := size / minSegmentSize; int64(connections) > maxConnections {
+		connections = int(maxConnections)
+	}
+	if connections < 1 {
+		connections = 1
+	}
+	Log.Infof("File size %d bytes, download with %d connections", size, connections)
+
+	progress := &ProgressWrapper{ctx: ctx, size: size, step: 1024 * 1024, callback: opts.Progress, finished: opts.Finished,
+		label: path.Base(fileURL)}
+	defer progress.close()
+	// NOTE: all segments share the same limiter so the whole download is limited, not each connection.
+	limiter := newRateLimiter()
+	// NOTE: the first failed segment stops the others, there is no point to download the rest of the file.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var firstErr error
+	var errOnce sync.Once
+	segmentSize := size / int64(connections)
+	var wg sync.WaitGroup
+	for i := 0; i < connections; i++ {
+		start := int64(i) * segmentSize
+		end := start + segmentSize - 1
+		if i == connections-1 {
+			end = size - 1
+		}
+		wg.Add(1)
+		go func(start, end int64) {
+			defer wg.Done()
+			if err := downloadSegment(ctx, fileURL, file, start, end, progress, limiter); err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return "", firstErr
+	}
+
+	// Segments are written out of order so the checksum is calculated when the whole file is ready.
+	return fileChecksum(file.Name(), algo, true)
+}
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDownloadSegmentedSmallFiles(t *testing.T) {
+	defer func(connections int) { Connections = connections }(Connections)
+	Connections = 8
+	tests := []struct {
+		name         string
+		size         int
+		wantRequests int32
+	}{
+		{"fewer bytes than connections", 5, 1},
+		{"one segment", int(minSegmentSize) + 10, 1},
+		{"three segments", 3*int(minSegmentSize) + 10, 3},
+		{"all connections", 10 * int(minSegmentSize), 8},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content := bytes.Repeat([]byte("0123456789abcdef"), test.size/16+1)[:test.size]
+			var requests int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet {
+					atomic.AddInt32(&requests, 1)
+				}
+				http.ServeContent(w, r, "IE11.zip", time.Time{}, bytes.NewReader(content))
+			}))
+			defer server.Close()
+			file, err := os.Create(filepath.Join(t.TempDir(), "IE11.zip"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+
+			checksum, err := downloadSegmented(context.Background(), server.URL+"/IE11.zip", file, "md5", &DownloadOptions{})
+			if err != nil {
+				t.Fatalf("downloadSegmented: %s", err)
+			}
+			if want := fmt.Sprintf("%X", md5.Sum(content)); checksum != want {
+				t.Errorf("checksum = %s, want %s", checksum, want)
+			}
+			if got, err := ioutil.ReadFile(file.Name()); err != nil || !bytes.Equal(got, content) {
+				t.Errorf("downloaded file differs from the served one: %v", err)
+			}
+			if requests != test.wantRequests {
+				t.Errorf("%d range requests, want %d", requests, test.wantRequests)
+			}
+		})
+	}
+}
+
+func TestDownloadSegmentedStopsOnFailedSegment(t *testing.T) {
+	defer func(connections int) { Connections = connections }(Connections)
+	Connections = 2
+	content := bytes.Repeat([]byte("0123456789abcdef"), 2*int(minSegmentSize)/16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method != http.MethodGet:
+			http.ServeContent(w, r, "IE11.zip", time.Time{}, bytes.NewReader(content))
+		case r.Header.Get("Range") == fmt.Sprintf("bytes=0-%d", minSegmentSize-1):
+			http.Error(w, "segment is gone", http.StatusNotFound)
+		default:
+			// NOTE: the second segment stalls until its request is cancelled.
+			w.WriteHeader(http.StatusPartialContent)
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+			case <-time.After(10 * time.Second):
+			}
+		}
+	}))
+	defer server.Close()
+	file, err := os.Create(filepath.Join(t.TempDir(), "IE11.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	started := time.Now()
+	if _, err := downloadSegmented(context.Background(), server.URL+"/IE11.zip", file, "md5", &DownloadOptions{}); err == nil {
+		t.Fatal("download with a failed segment succeeded")
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("other segments weren't stopped, download took %s", elapsed)
+	}
+}
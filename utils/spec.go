@@ -0,0 +1,134 @@
+// Package utils contains various supplementary functions and data structures.
+// This file spec.go contains functions to select a VM with a single spec string.
+package utils
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxClosestSpecs const defines how many closest specs are suggested if a given spec isn't available.
+const maxClosestSpecs = 5
+
+// String method formats Spec as platform/hypervisor/browser string which is accepted by ParseSpec.
+func (spec Spec) String() string {
+	return strings.Join([]string{spec.Platform, spec.Hypervisor, spec.BrowserOs}, "/")
+}
+
+// ParseSpec function parses a spec string like 'Linux/VirtualBox/MSEdge Win10' into Spec.
+func ParseSpec(value string) (Spec, error) {
+	parts := strings.SplitN(value, "/", 3)
+	if len(parts) != 3 {
+		return Spec{}, fmt.Errorf("spec '%s' must look like platform/hypervisor/browser", value)
+	}
+	for idx := range parts {
+		parts[idx] = strings.TrimSpace(parts[idx])
+		if parts[idx] == "" {
+			return Spec{}, fmt.Errorf("spec '%s' has an empty part", value)
+		}
+	}
+	return Spec{Platform: parts[0], Hypervisor: parts[1], BrowserOs: parts[2]}, nil
+}
+
+// specFieldScore function scores how close two spec fields are.
+func specFieldScore(wanted, available string) int {
+	wanted = strings.ToLower(wanted)
+	available = strings.ToLower(available)
+	switch {
+	case wanted == available:
+		return 2
+	case strings.Contains(available, wanted) || strings.Contains(wanted, available):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// ClosestSpecs function returns available specs which are the most similar to a given one.
+func ClosestSpecs(availableVms AvailableVM, wanted Spec) []Spec {
+	scores := make(map[Spec]int)
+	var specs []Spec
+	for spec := range availableVms {
+		score := specFieldScore(wanted.Platform, spec.Platform) +
+			specFieldScore(wanted.Hypervisor, spec.Hypervisor) +
+			specFieldScore(wanted.BrowserOs, spec.BrowserOs)
+		if score > 0 {
+			scores[spec] = score
+			specs = append(specs, spec)
+		}
+	}
+	sort.Sort(closestSpecs{specs: specs, scores: scores})
+	if len(specs) > maxClosestSpecs {
+		specs = specs[:maxClosestSpecs]
+	}
+	return specs
+}
+
+// closestSpecs type sorts specs by their score, specs with the same score are sorted by name.
+type closestSpecs struct {
+	specs  []Spec
+	scores map[Spec]int
+}
+
+func (cs closestSpecs) Len() int      { return len(cs.specs) }
+func (cs closestSpecs) Swap(i, j int) { cs.specs[i], cs.specs[j] = cs.specs[j], cs.specs[i] }
+func (cs closestSpecs) Less(i, j int) bool {
+	if cs.scores[cs.specs[i]] != cs.scores[cs.specs[j]] {
+		return cs.scores[cs.specs[i]] > cs.scores[cs.specs[j]]
+	}
+	return cs.specs[i].String() < cs.specs[j].String()
+}
+
+// FindSpec function checks that a given spec string defines an available VM.
+// If it doesn't the error suggests the closest available specs.
+func FindSpec(availableVms AvailableVM, value string) (Spec, error) {
+	spec, err := ParseSpec(value)
+	if err != nil {
+		return Spec{}, err
+	}
+	if _, ok := availableVms[spec]; ok {
+		return spec, nil
+	}
+	var suggestions []string
+	for _, closest := range ClosestSpecs(availableVms, spec) {
+		suggestions = append(suggestions, closest.String())
+	}
+	if len(suggestions) == 0 {
+		return Spec{}, fmt.Errorf("spec '%s' isn't available", value)
+	}
+	return Spec{}, fmt.Errorf("spec '%s' isn't available. Closest matches: %s", value, strings.Join(suggestions, ", "))
+}
+
+// FindArchiveSpec function finds a spec of a local VM archive by its file name for a given platform. The same
+// archive could be used by several hypervisors, so a given hypervisor is preferred, otherwise a default one is
+// chosen among them.
+func FindArchiveSpec(availableVms AvailableVM, filePath, platform, hypervisor string,
+	defaultHypervisor DefaultChoice) (Spec, error) {
+	name := path.Base(filepath.ToSlash(filePath))
+	specs := make(map[string]Spec)
+	var hypervisors Choice
+	for spec, vm := range availableVms {
+		if spec.Platform == platform && vm.archiveName() == name {
+			specs[spec.Hypervisor] = spec
+			hypervisors = append(hypervisors, spec.Hypervisor)
+		}
+	}
+	if len(hypervisors) == 0 {
+		return Spec{}, fmt.Errorf("%s isn't a known VM archive name for %s platform", name, platform)
+	}
+	if hypervisor != "" {
+		if spec, ok := specs[hypervisor]; ok {
+			return spec, nil
+		}
+		return Spec{}, fmt.Errorf("%s can't be installed into %s. Available hypervisors: %v", name, hypervisor, hypervisors)
+	}
+	sort.Sort(hypervisors)
+	idx := defaultHypervisor(hypervisors)
+	if idx < 0 || idx >= len(hypervisors) {
+		idx = 0
+	}
+	return specs[hypervisors[idx]], nil
+}
@@ -0,0 +1,114 @@
+// Package utils contains various supplementary functions and data structures.
+// This file throttle.go contains functions to limit download speed.
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxRate var defines maximum download speed in bytes per second for a single VM archive download.
+// Zero means unlimited.
+var MaxRate int64
+
+// ParseRate function parses rate values like 500K, 2M or 1G into bytes per second. Plain numbers are bytes.
+func ParseRate(rateValue string) (int64, error) {
+	value := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(rateValue)), "B")
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(value, "K"):
+		multiplier = 1024
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate < 0 {
+		return 0, fmt.Errorf("invalid rate '%s', use values like 500K, 2M or 1G", rateValue)
+	}
+	bytesRate := int64(math.Round(rate * float64(multiplier)))
+	// NOTE: zero means unlimited, so a tiny rate mustn't silently turn into no limit at all.
+	if rate > 0 && bytesRate == 0 {
+		return 0, fmt.Errorf("rate '%s' is less than 1 byte per second", rateValue)
+	}
+	return bytesRate, nil
+}
+
+// rateLimiter type limits how many bytes could be read per second. It could be shared by several readers,
+// e.g. segments of the same download.
+type rateLimiter struct {
+	rate  int64
+	total int64
+	start time.Time
+	mutex sync.Mutex
+}
+
+// newRateLimiter function returns a limiter for MaxRate or nil if speed isn't limited.
+func newRateLimiter() *rateLimiter {
+	if MaxRate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: MaxRate}
+}
+
+// wait method accounts n read bytes and sleeps long enough to keep the average speed under the rate. The sleep
+// is interrupted and an error is returned if ctx is cancelled.
+func (rl *rateLimiter) wait(ctx context.Context, n int) error {
+	rl.mutex.Lock()
+	if rl.start.IsZero() {
+		rl.start = time.Now()
+	}
+	rl.total += int64(n)
+	due := rl.start.Add(time.Duration(float64(rl.total) / float64(rl.rate) * float64(time.Second)))
+	rl.mutex.Unlock()
+	timer := time.NewTimer(time.Until(due))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// throttledReader type reads data not faster than its limiter allows.
+type throttledReader struct {
+	io.Reader
+	ctx     context.Context
+	limiter *rateLimiter
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	// NOTE: reads are kept small enough so speed is smooth instead of big bursts followed by long pauses.
+	chunk := int(tr.limiter.rate / 10)
+	if chunk < 1 {
+		chunk = 1
+	}
+	if len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := tr.Reader.Read(p)
+	if waitErr := tr.limiter.wait(tr.ctx, n); err == nil {
+		err = waitErr
+	}
+	return n, err
+}
+
+// throttle function wraps a given reader with a limiter, waiting for the limiter stops when ctx is cancelled.
+// The reader is returned as-is if limiter is nil.
+func throttle(ctx context.Context, reader io.Reader, limiter *rateLimiter) io.Reader {
+	if limiter == nil {
+		return reader
+	}
+	return &throttledReader{Reader: reader, ctx: ctx, limiter: limiter}
+}
@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"500", 500, false},
+		{"500K", 500 * 1024, false},
+		{"1.5M", 3 * 512 * 1024, false},
+		{"2GB", 2 * 1024 * 1024 * 1024, false},
+		{"0.6", 1, false},
+		{"0.4", 0, true},
+		{"0.0001K", 0, true},
+		{"-1M", 0, true},
+		{"fast", 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			got, err := ParseRate(test.value)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseRate error = %v, want error %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("ParseRate = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestThrottleSmallRate(t *testing.T) {
+	limiter := &rateLimiter{rate: 5}
+	reader := throttle(context.Background(), bytes.NewReader([]byte("ab")), limiter)
+	buf := make([]byte, 16)
+	// NOTE: a rate under 10 bytes per second still reads a byte at a time instead of the whole buffer.
+	if n, err := reader.Read(buf); err != nil || n != 1 {
+		t.Errorf("Read = %d, %v, want 1 byte", n, err)
+	}
+}
+
+func TestThrottleStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	limiter := &rateLimiter{rate: 10}
+	reader := throttle(ctx, bytes.NewReader(bytes.Repeat([]byte("a"), 100)), limiter)
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	started := time.Now()
+	if _, err := ioutil.ReadAll(reader); err != context.Canceled {
+		t.Errorf("ReadAll error = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("throttled read wasn't stopped, it took %s", elapsed)
+	}
+}
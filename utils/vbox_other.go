@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+// Package utils contains various supplementary functions and data structures.
+// This file vbox_other.go contains VirtualBox functions for non-Windows platforms.
+package utils
+
+// findVBoxManage function returns vboxmanage command name because VirtualBox adds it to PATH on these platforms.
+func findVBoxManage() string {
+	return "vboxmanage"
+}
@@ -0,0 +1,42 @@
+// Package utils contains various supplementary functions and data structures.
+// This file vbox_windows.go contains Windows specific VirtualBox functions.
+package utils
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// findVBoxManage function returns VBoxManage.exe path. VirtualBox installer doesn't add it to PATH, so the install
+// folder is taken from the installer's env var, the registry or the default location.
+func findVBoxManage() string {
+	if vboxPath, err := exec.LookPath("vboxmanage"); err == nil {
+		return vboxPath
+	}
+
+	var folders []string
+	for _, envName := range []string{"VBOX_MSI_INSTALL_PATH", "VBOX_INSTALL_PATH"} {
+		if folder := os.Getenv(envName); folder != "" {
+			folders = append(folders, folder)
+		}
+	}
+	// NOTE: reg tool is used to avoid extra dependencies for registry access.
+	result, err := execCommand("reg", "query", `HKLM\SOFTWARE\Oracle\VirtualBox`, "/v", "InstallDir").Output()
+	if err == nil {
+		for _, line := range strings.Split(string(result), "\n") {
+			if parts := strings.SplitN(line, "REG_SZ", 2); len(parts) == 2 {
+				folders = append(folders, strings.TrimSpace(parts[1]))
+			}
+		}
+	}
+	folders = append(folders, pathJoin(os.Getenv("ProgramFiles"), `Oracle\VirtualBox`))
+
+	for _, folder := range folders {
+		vboxPath := pathJoin(folder, "VBoxManage.exe")
+		if _, err := os.Stat(vboxPath); err == nil {
+			return vboxPath
+		}
+	}
+	return "vboxmanage"
+}
@@ -3,425 +3,1964 @@
 package utils
 
 import (
+	"archive/tar"
 	"archive/zip"
-	"crypto/md5"
+	"context"
+	"errors"
 	"fmt"
-	"hash"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 )
 
+// UniqueRun var enables per-run unique names for unzip folders, files derived from them and imported VMs.
+var UniqueRun = false
+
+// uniqueSuffix function returns a suffix which makes a name unique for a run when UniqueRun is set.
+func uniqueSuffix() string {
+	return fmt.Sprintf("-%d-%d", os.Getpid(), time.Now().UnixNano())
+}
+
+// CopyBufferSize var defines buffer size in bytes used to copy downloaded and unpacked data.
+// Only one buffer is allocated per copy operation so memory usage is bounded by this value.
+var CopyBufferSize = 1024 * 1024
+
+// ForceDownload var makes DownloadVM download VM archives again even if valid archives exist.
+var ForceDownload = false
+
+// execCommand var is used to run all hypervisor tools. Tests could replace it to simulate tools and check
+// the arguments passed to them.
+var execCommand = exec.Command
+
+// progressBarWidth defines how many characters the progress bar takes.
+const progressBarWidth = 30
+
+// ProgressFunc type defines a function which receives download progress, e.g. to show it in a GUI.
+// total is -1 if the size is unknown.
+type ProgressFunc func(downloaded, total int64)
+
+// DownloadStats type defines statistics of a finished download.
+type DownloadStats struct {
+	Bytes   int64
+	Elapsed time.Duration
+}
+
+// Speed method returns average download speed in bytes per second.
+func (ds DownloadStats) Speed() float64 {
+	if ds.Elapsed <= 0 {
+		return 0
+	}
+	return float64(ds.Bytes) / ds.Elapsed.Seconds()
+}
+
+// String method formats download statistics, e.g. 'Downloaded 5.00 GB in 6m12s (13.8 MB/s)'.
+func (ds DownloadStats) String() string {
+	return fmt.Sprintf("Downloaded %s in %s (%s/s)", humanBytes(ds.Bytes), ds.Elapsed.Round(time.Second),
+		humanBytes(int64(ds.Speed())))
+}
+
+// DownloadOptions type defines optional settings of a VM archive download.
+type DownloadOptions struct {
+	// Progress is called on each downloaded chunk instead of showing progress in the terminal.
+	Progress ProgressFunc
+	// Finished is called with download statistics when a download is finished, it could be nil.
+	Finished func(stats DownloadStats)
+}
+
 // ProgressWrapper type is used to track download progress.
+// It is safe to use a single ProgressWrapper from several goroutines via advance method. Several ProgressWrapper
+// instances could be used at once, their progress is drawn by the shared display.
 type ProgressWrapper struct {
 	io.Reader
-	total    int64
-	size     int64
-	progress float64
-	step     float64
+	total int64
+	// size is -1 if it is unknown.
+	size int64
+	// step defines how many bytes should be read before progress is shown again.
+	step  int64
+	shown int64
+	start time.Time
+	done  bool
+	mutex sync.Mutex
+	// ctx stops reading when it is cancelled, it could be nil.
+	ctx context.Context
+	// callback receives progress instead of the terminal if it is set.
+	callback ProgressFunc
+	// action names what is tracked, e.g. Verification. Download is tracked if it is empty.
+	action string
+	// finished receives statistics when reading is finished, it could be nil.
+	finished func(stats DownloadStats)
+	// label names tracked data if several operations are shown at once, e.g. a file name.
+	label string
+	// bar is a line of the shared progress display, it is registered on the first read.
+	bar *progressBar
+}
+
+// Stats method returns number of bytes read so far and time elapsed since the first read.
+func (pw *ProgressWrapper) Stats() DownloadStats {
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+	return pw.stats()
+}
+
+// stats method returns statistics, the caller must hold the mutex.
+func (pw *ProgressWrapper) stats() DownloadStats {
+	if pw.start.IsZero() {
+		return DownloadStats{}
+	}
+	return DownloadStats{Bytes: pw.total, Elapsed: time.Since(pw.start)}
+}
+
+func (pw *ProgressWrapper) Read(p []byte) (int, error) {
+	if pw.ctx != nil && pw.ctx.Err() != nil {
+		return 0, pw.ctx.Err()
+	}
+	n, err := pw.Reader.Read(p)
+	pw.advance(n, err == io.EOF)
+	return n, err
+}
+
+// close method removes progress from the display if reading didn't finish, e.g. it failed.
+func (pw *ProgressWrapper) close() {
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+	if pw.bar != nil && !pw.done {
+		display.remove(pw.bar)
+		pw.bar = nil
+	}
+}
+
+// advance method adds a given number of read bytes to the progress and shows it. Callbacks are called after the
+// mutex is released, so they could take their time or call Stats.
+func (pw *ProgressWrapper) advance(n int, eof bool) {
+	pw.mutex.Lock()
+	if pw.start.IsZero() {
+		pw.start = time.Now()
+	}
+	pw.total += int64(n)
+	// NOTE: if the size is unknown only EOF tells that reading is finished.
+	finished := eof || (pw.size > 0 && pw.total >= pw.size)
+	if pw.done {
+		pw.mutex.Unlock()
+		return
+	}
+	if pw.callback != nil {
+		pw.done = finished
+		callback, finishedFunc := pw.callback, pw.finished
+		total, size, stats := pw.total, pw.size, pw.stats()
+		pw.mutex.Unlock()
+		callback(total, size)
+		if finished && finishedFunc != nil {
+			finishedFunc(stats)
+		}
+		return
+	}
+	if pw.bar == nil {
+		pw.bar = display.register(pw.label)
+	}
+	if pw.total-pw.shown >= pw.step || finished {
+		display.update(pw.bar, pw.render(), pw.total, pw.size, finished)
+		pw.shown = pw.total
+	}
+	if !finished {
+		pw.mutex.Unlock()
+		return
+	}
+	pw.done = true
+	finishedFunc, stats := pw.finished, pw.stats()
+	pw.mutex.Unlock()
+	if pw.action != "" {
+		Log.Infof("%s finished in %s", pw.action, stats.Elapsed.Round(time.Second))
+	} else {
+		Log.Info(stats)
+	}
+	if finishedFunc != nil {
+		finishedFunc(stats)
+	}
+}
+
+// render method formats progress line with downloaded bytes, speed and estimated time left.
+func (pw *ProgressWrapper) render() string {
+	speed := 0.0
+	if elapsed := time.Since(pw.start).Seconds(); elapsed > 0 {
+		speed = float64(pw.total) / elapsed
+	}
+	if pw.size <= 0 {
+		// NOTE: without size, e.g. for chunked responses, neither percentage nor ETA could be calculated.
+		line := fmt.Sprintf("%s... %s/s elapsed %s", humanBytes(pw.total), humanBytes(int64(speed)),
+			formatETA(time.Since(pw.start)))
+		if pw.action != "" {
+			return pw.action + " " + line
+		}
+		return "Downloaded " + line
+	}
+
+	ratio := float64(pw.total) / float64(pw.size)
+	if ratio > 1 {
+		// The server could send more data than it announced.
+		ratio = 1
+	}
+	filled := int(ratio * progressBarWidth)
+	bar := strings.Repeat("#", filled) + strings.Repeat("-", progressBarWidth-filled)
+	eta := "--:--"
+	if remaining := pw.size - pw.total; speed > 0 && remaining >= 0 {
+		eta = formatETA(time.Duration(float64(remaining) / speed * float64(time.Second)))
+	}
+	line := fmt.Sprintf("[%s] %.0f%% %s/%s %s/s ETA %s",
+		bar, ratio*100, humanBytes(pw.total), humanBytes(pw.size), humanBytes(int64(speed)), eta)
+	if pw.action != "" {
+		return pw.action + " " + line
+	}
+	return line
+}
+
+// humanBytes function formats a given number of bytes in human readable units.
+func humanBytes(bytes int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(bytes)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", bytes, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// formatETA function formats a given duration as mm:ss or hh:mm:ss for long durations.
+func formatETA(eta time.Duration) string {
+	seconds := int64(eta.Seconds())
+	if seconds >= 3600 {
+		return fmt.Sprintf("%02d:%02d:%02d", seconds/3600, seconds%3600/60, seconds%60)
+	}
+	return fmt.Sprintf("%02d:%02d", seconds/60, seconds%60)
+}
+
+// pathJoin function joins two paths with OS specific separators. On Windows forward slashes are converted to
+// backslashes and UNC prefixes like \\server\share are kept.
+func pathJoin(path1, path2 string) string {
+	return filepath.Join(path1, path2)
+}
+
+// downloadFile function downloads a given URL into dst and returns checksum and size of the downloaded data.
+// Progress is reported according to opts, it isn't reported at all if opts is nil.
+func downloadFile(ctx context.Context, fileURL string, dst io.Writer, algo string, opts *DownloadOptions) (string, int64, error) {
+	dstSum := &ChecksumWrapper{Writer: dst, hashSum: newHash(algo)}
+
+	resp, err := httpGet(ctx, fileURL)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	size, err := copyBody(ctx, resp, dstSum, opts)
+	if err != nil {
+		return "", size, err
+	}
+	return fmt.Sprintf("%X", dstSum.hashSum.Sum([]byte{})), size, nil
+}
+
+// copyBody function copies response body into dst with throttling and progress reported according to opts.
+func copyBody(ctx context.Context, resp *http.Response, dst io.Writer, opts *DownloadOptions) (int64, error) {
+	src := throttle(ctx, resp.Body, newRateLimiter())
+	if opts != nil {
+		if resp.ContentLength >= 0 {
+			Log.Infof("File size %d bytes", resp.ContentLength)
+		} else {
+			Log.Info("File size is unknown")
+		}
+		progress := &ProgressWrapper{
+			ctx:      ctx,
+			callback: opts.Progress,
+			finished: opts.Finished,
+			Reader:   src,
+			size:     resp.ContentLength,
+			// progress download step for 1Mb chunks
+			step:  1024 * 1024,
+			label: path.Base(resp.Request.URL.Path),
+		}
+		defer progress.close()
+		src = progress
+	}
+	return io.CopyBuffer(dst, src, make([]byte, CopyBufferSize))
+}
+
+// errCantResume error means that a partial download should be started from scratch.
+var errCantResume = errors.New("download can't be resumed")
+
+// partialFilePath function returns a path where VM archive is downloaded before it is complete.
+func partialFilePath(vmFile string) string {
+	return vmFile + ".partial"
+}
+
+// resumeDownload function continues downloading a given URL into a partially downloaded file. The checksum is
+// seeded with the data already present in the file, so it matches the checksum of the whole file.
+// errCantResume is returned if the file is empty or the server doesn't support range requests.
+func resumeDownload(ctx context.Context, fileURL string, file *os.File, algo string, opts *DownloadOptions) (string, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.Size() == 0 || Connections > 1 {
+		return "", errCantResume
+	}
+	size, acceptRanges, err := remoteInfo(ctx, fileURL)
+	if err != nil || !acceptRanges || size <= info.Size() {
+		return "", errCantResume
+	}
+
+	Log.Infof("Found partial download %s, checking it.", file.Name())
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	// NOTE: the file is read till the end while the checksum is seeded, so new data is appended.
+	dstSum, offset, err := newSeededChecksumWrapper(file, algo, file)
+	if err != nil {
+		return "", err
+	}
+	Log.Infof("Resume download from %s of %s", humanBytes(offset), humanBytes(size))
+	resp, err := httpGetRange(ctx, fileURL, offset, size-1)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return "", errCantResume
+	}
+	if _, err := copyBody(ctx, resp, dstSum, opts); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%X", dstSum.hashSum.Sum([]byte{})), nil
+}
+
+// removeIncomplete function closes and removes a partially written file.
+// The file is closed first because Windows doesn't allow to remove opened files.
+func removeIncomplete(file *os.File) {
+	file.Close()
+	if err := os.Remove(file.Name()); err != nil {
+		Log.Warnf("Can't remove incomplete file %s: %s", file.Name(), err)
+		return
+	}
+	Log.Infof("Incomplete file %s removed.", file.Name())
+}
+
+// remoteInfo function gets size of a remote file with HEAD request and checks if the server supports range
+// requests. -1 size is returned if the size is unknown.
+func remoteInfo(ctx context.Context, fileURL string) (int64, bool, error) {
+	resp, err := httpHead(ctx, fileURL)
+	if err != nil {
+		return -1, false, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, resp.Header.Get("Accept-Ranges") == "bytes", nil
+}
+
+// remoteSize function gets size of a remote file with HEAD request. -1 is returned if the size is unknown.
+func remoteSize(ctx context.Context, fileURL string) (int64, error) {
+	size, _, err := remoteInfo(ctx, fileURL)
+	return size, err
+}
+
+// offerRedownload function explains why an existing VM archive has unexpected checksum and offers to download
+// it again. If a user agrees the existing archive is removed and true is returned.
+func offerRedownload(ctx context.Context, vm VMImage, vmFile string) bool {
+	localFile, err := os.Stat(vmFile)
+	if err != nil {
+		return false
+	}
+	// NOTE: Microsoft could publish a new build under the same file name. Different sizes mean the local file is
+	// a previous version rather than a corrupted download.
+	if size, err := remoteSize(ctx, vm.FileURL); err == nil && size >= 0 && size != localFile.Size() {
+		Log.Warnf("Local file size %d bytes differs from remote size %d bytes. "+
+			"Probably a new version was published.", localFile.Size(), size)
+	} else {
+		Log.Warn("Local file has the same size as the remote one but checksum differs. Probably it is corrupted.")
+	}
+	if !AskYesNo("Download the file again") {
+		return false
+	}
+	if err := os.Remove(vmFile); err != nil {
+		Log.Error(err)
+		return false
+	}
+	return true
+}
+
+// checkDiskSpace function checks if there is enough free space for a given number of bytes on a given path.
+func checkDiskSpace(diskPath string, need int64) error {
+	have, err := freeSpace(diskPath)
+	if err != nil {
+		Log.Warnf("Can't check free disk space: %s", err)
+		return nil
+	}
+	Log.Debugf("Free disk space %s, need %s", humanBytes(have), humanBytes(need))
+	if have < need {
+		return fmt.Errorf("not enough disk space: need %s, have %s", humanBytes(need), humanBytes(have))
+	}
+	return nil
+}
+
+// archivePath function returns a path where VM archive defined by a user is stored.
+func archivePath(uc UserChoice) string {
+	return pathJoin(uc.DownloadPath, uc.VMImage.archiveName())
+}
+
+// downloadParts function downloads all parts of a split VM archive, verifies each of them and joins them into
+// a single archive. An existing archive is reused only if it was joined from the same part files.
+func downloadParts(ctx context.Context, uc UserChoice, opts DownloadOptions) (string, error) {
+	var partPaths []string
+	var partsSize int64
+	fingerprint := crc32.NewIEEE()
+	for idx, part := range uc.VMImage.Parts {
+		Log.Infof("Download part %d of %d", idx+1, len(uc.VMImage.Parts))
+		partChoice := uc
+		partChoice.VMImage = part
+		partPath, err := DownloadVM(ctx, partChoice, opts)
+		if err != nil {
+			return "", err
+		}
+		info, err := os.Stat(partPath)
+		if err != nil {
+			return "", err
+		}
+		partPaths = append(partPaths, partPath)
+		partsSize += info.Size()
+		fmt.Fprintf(fingerprint, "%s %d %d\n", partPath, info.Size(), info.ModTime().UnixNano())
+	}
+
+	// NOTE: the joined archive is reused only if it was joined from the same part files, parts which were
+	// downloaded again or a joined file of the same size left by other tools make it joined again.
+	vmFile := archivePath(uc)
+	partsSum := fmt.Sprintf("%08X", fingerprint.Sum32())
+	if loadChecksumCache(vmFile, partsFingerprintAlgo) == partsSum && !ForceDownload {
+		Log.Infof("File %s is already joined from parts.", vmFile)
+		return vmFile, nil
+	}
+	Log.Infof("Join %d parts into %s", len(partPaths), vmFile)
+	if err := checkDiskSpace(uc.DownloadPath, partsSize); err != nil {
+		return "", err
+	}
+	// NOTE: parts are joined into a temporary file, so the archive path never holds a partially joined archive.
+	joinedFile, err := os.Create(partialFilePath(vmFile))
+	if err != nil {
+		return "", err
+	}
+	defer joinedFile.Close()
+	for _, partPath := range partPaths {
+		if err := appendFile(joinedFile, partPath); err != nil {
+			removeIncomplete(joinedFile)
+			return "", err
+		}
+	}
+	joinedFile.Close()
+	if err := os.Rename(joinedFile.Name(), vmFile); err != nil {
+		return "", err
+	}
+	saveChecksumCache(vmFile, partsFingerprintAlgo, partsSum)
+	return vmFile, nil
+}
+
+// partsFingerprintAlgo defines a sidecar file suffix which keeps a fingerprint of parts a split archive was joined
+// from, see saveChecksumCache.
+const partsFingerprintAlgo = "parts"
+
+// appendFile function copies content of a given file into dst.
+func appendFile(dst io.Writer, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.CopyBuffer(dst, file, make([]byte, CopyBufferSize))
+	return err
+}
+
+// DownloadVM function downloads VM archive defined by a user and returns the path where it was stored.
+// The download is stopped and the incomplete file is removed when ctx is cancelled.
+// Split archives are downloaded part by part and joined into a single archive.
+func DownloadVM(ctx context.Context, uc UserChoice, opts DownloadOptions) (string, error) {
+	if len(uc.VMImage.Parts) > 0 {
+		return downloadParts(ctx, uc, opts)
+	}
+	vmFile := archivePath(uc)
+	Log.Infof("Download: %s\nTo: %s", uc.VMImage.FileURL, vmFile)
+
+	algo := uc.VMImage.hashAlgo()
+	origSum, err := getExpectedChecksum(ctx, uc.VMImage)
+	if err != nil {
+		return "", err
+	}
+
+	if ForceDownload {
+		os.Remove(partialFilePath(vmFile))
+	}
+	if _, err := os.Stat(vmFile); err == nil && ForceDownload {
+		Log.Infof("File %s already exists, remove it to download again.", vmFile)
+		if err := os.Remove(vmFile); err != nil {
+			return "", err
+		}
+		os.Remove(checksumCachePath(vmFile, algo))
+	} else if err == nil {
+		Log.Infof("File %s already exists.\nChecking %s sum", vmFile, algoName(algo))
+		vmSum, err := cachedFileChecksum(vmFile, algo, true)
+		if err != nil {
+			return "", err
+		}
+		Log.Infof("Local file %s sum %s", algoName(algo), vmSum)
+		if strings.EqualFold(vmSum, origSum) || !offerRedownload(ctx, uc.VMImage, vmFile) {
+			return vmFile, compareChecksum(algo, origSum, vmSum)
+		}
+	}
+
+	// NOTE: the archive is unpacked next to itself, so there should be space at least for the archive and the same
+	// amount of unpacked data. Precise unpacked size is checked again by UnzipVM.
+	if size, err := remoteSize(ctx, uc.VMImage.FileURL); err == nil && size > 0 {
+		if err := checkDiskSpace(uc.DownloadPath, 2*size); err != nil {
+			return "", err
+		}
+	}
+
+	// NOTE: the archive is downloaded into a partial file which is renamed only after its checksum is verified,
+	// so the archive path always holds a complete and verified archive.
+	urls := mirrorURLs(uc.VMImage.FileURL)
+	partialPath := partialFilePath(vmFile)
+	for attempt := 1; ; attempt++ {
+		vmSum, err := downloadMirrors(ctx, urls, vmFile, algo, origSum, &opts)
+		if err != nil {
+			return "", err
+		}
+		Log.Infof("Downloaded file %s sum %s", algoName(algo), vmSum)
+		err = compareChecksum(algo, origSum, vmSum)
+		if err == nil {
+			if err := os.Rename(partialPath, vmFile); err != nil {
+				return "", err
+			}
+			saveChecksumCache(vmFile, algo, vmSum)
+			return vmFile, nil
+		}
+		// NOTE: a corrupted file can't be resumed, it is removed whether it is downloaded again or not.
+		if err := os.Remove(partialPath); err != nil {
+			return "", err
+		}
+		if !retryCorruptDownload(attempt, err) {
+			return "", err
+		}
+	}
+}
+
+// retryCorruptDownload function decides if a download with wrong checksum should be done again. A user is asked
+// about it, but without prompting the download is retried up to MaxRetries times.
+func retryCorruptDownload(attempt int, checksumErr error) bool {
+	Log.Error(checksumErr)
+	if AssumeYes {
+		if attempt > MaxRetries {
+			return false
+		}
+		Log.Warnf("Download it again, retry %d of %d.", attempt, MaxRetries)
+		return true
+	}
+	return AskYesNo("Downloaded file is corrupted. Delete it and download again")
+}
+
+// downloadArchive function downloads VM archive into a given file and returns its checksum.
+// The archive is downloaded into a partial file, see partialFilePath, DownloadVM renames it when its checksum is
+// verified. If the download fails the partial file is kept, so the next run could resume it. A partial file written
+// by several connections isn't contiguous so it is removed.
+func downloadArchive(ctx context.Context, fileURL, vmFile, algo string, opts *DownloadOptions) (string, error) {
+	partialPath := partialFilePath(vmFile)
+	newFile, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer newFile.Close()
+
+	vmSum, err := resumeDownload(ctx, fileURL, newFile, algo, opts)
+	if err == errCantResume {
+		Log.Info("Start downloading.")
+		if err = restartFile(newFile); err == nil {
+			if Connections > 1 {
+				if vmSum, err = downloadSegmented(ctx, fileURL, newFile, algo, opts); err != nil {
+					removeIncomplete(newFile)
+				}
+			} else {
+				vmSum, _, err = downloadFile(ctx, fileURL, newFile, algo, opts)
+			}
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return vmSum, nil
+}
+
+// restartFile function truncates a given file so it is written from scratch.
+func restartFile(file *os.File) error {
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := file.Seek(0, io.SeekStart)
+	return err
+}
+
+// StreamVM function downloads VM archive defined by a user into a given writer instead of a file.
+// It is used to pipe VM archive into other tools so all messages should be written to Console other than dst.
+func StreamVM(ctx context.Context, uc UserChoice, dst io.Writer) error {
+	if len(uc.VMImage.Parts) > 0 {
+		// NOTE: parts are streamed one after another, so dst gets the joined archive.
+		for _, part := range uc.VMImage.Parts {
+			partChoice := uc
+			partChoice.VMImage = part
+			if err := StreamVM(ctx, partChoice, dst); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	Log.Infof("Download: %s", uc.VMImage.FileURL)
+	algo := uc.VMImage.hashAlgo()
+	origSum, err := getExpectedChecksum(ctx, uc.VMImage)
+	if err != nil {
+		return err
+	}
+	vmSum, _, err := downloadFile(ctx, uc.VMImage.FileURL, dst, algo, &DownloadOptions{})
+	if err != nil {
+		return err
+	}
+	Log.Infof("Streamed data %s sum %s", algoName(algo), vmSum)
+	return compareChecksum(algo, origSum, vmSum)
+}
+
+// vmFileExtensions function returns extensions of VM entry point files for a given hypervisor in order of preference.
+func vmFileExtensions(hypervisor string) []string {
+	switch hypervisor {
+	case "VirtualBox":
+		return []string{".ova"}
+	case "VMware":
+		return []string{".ovf"}
+	case "HyperV":
+		return []string{".xml", ".vmcx"}
+	case "Parallels":
+		return []string{".pvs"}
+	case "Vagrant":
+		return []string{".box"}
+	case "QEMU", "Proxmox", "Xen":
+		// QEMU, Proxmox and Xen use VirtualBox images, a disk could be unpacked already or it is inside .ova file.
+		return []string{".vmdk", ".ova"}
+	case "WindowsSandbox":
+		// Windows Sandbox uses Hyper-V images, only their disks are used.
+		return []string{".vhdx", ".vhd"}
+	}
+	return nil
+}
+
+// vmFilePath function finds a specific file path depending on a hypervisor.
+// Different hypervisors have different file names for VMs. For example, VirtualBox has .ova extension but VMware needs
+// .ovf file etc.
+func vmFilePath(hypervisor string, collectedPaths []string) (string, error) {
+	for _, search := range vmFileExtensions(hypervisor) {
+		for _, vmPath := range collectedPaths {
+			if strings.HasSuffix(vmPath, search) {
+				return vmPath, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("Din't find VM path for %s\n", hypervisor)
+}
+
+// FindVMFile function finds a VM file for a given hypervisor in an already unzipped VM folder, e.g. after
+// a failed install. An error describes expected files if the folder doesn't contain any of them.
+func FindVMFile(hypervisor, folder string) (string, error) {
+	info, err := os.Stat(folder)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s isn't a folder", folder)
+	}
+	var collectedPaths []string
+	err = filepath.Walk(folder, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		collectedPaths = append(collectedPaths, filePath)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	vmPath, err := selectVMFile(hypervisor, collectedPaths)
+	if err != nil {
+		message := fmt.Sprintf("%s doesn't contain %s VM file, expected one of: %s", folder, hypervisor,
+			strings.Join(vmFileExtensions(hypervisor), ", "))
+		if !ConvertDisks && nativeDiskFormats[hypervisor] != "" {
+			message += ". Use -convert to install a VM unzipped for another hypervisor"
+		}
+		return "", fmt.Errorf("%s", message)
+	}
+	return vmPath, nil
+}
+
+// fileCRC32 function calculates CRC32 checksum of a given file.
+func fileCRC32(filePath string) (uint32, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	crc := crc32.NewIEEE()
+	if _, err := io.Copy(crc, file); err != nil {
+		return 0, err
+	}
+	return crc.Sum32(), nil
+}
+
+// unzipFile function unpacks a single archive entry into a given path and returns CRC32 of the written data.
+func unzipFile(file *zip.File, filePath string) (uint32, error) {
+	fileReader, err := file.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer fileReader.Close()
+
+	targetFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, file.Mode())
+	if err != nil {
+		return 0, err
+	}
+	defer targetFile.Close()
+	unpacked := false
+	defer func() {
+		if !unpacked {
+			removeIncomplete(targetFile)
+		}
+	}()
+
+	crc := crc32.NewIEEE()
+	targetCRC := &ChecksumWrapper{Writer: targetFile, hashSum: crc}
+	if _, err := io.CopyBuffer(targetCRC, fileReader, make([]byte, CopyBufferSize)); err != nil {
+		return 0, err
+	}
+	unpacked = true
+	return crc.Sum32(), nil
+}
+
+// restoreAttributes function sets permissions and modification time of an unpacked file or folder to the ones
+// stored in the archive. Permissions given on creation are limited by umask, so they are set explicitly.
+// The owner always keeps write permission, otherwise a damaged file couldn't be unpacked again by the next run.
+func restoreAttributes(file *zip.File, filePath string) error {
+	if err := os.Chmod(filePath, file.Mode().Perm()|0200); err != nil {
+		return err
+	}
+	return os.Chtimes(filePath, file.Modified, file.Modified)
+}
+
+// DeleteArchive function removes downloaded VM archive and its cached checksum file.
+// It should be called only after the archive was verified and unpacked.
+// Parts of a split archive are removed as well.
+func DeleteArchive(uc UserChoice, archivePath string) error {
+	if err := os.Remove(archivePath); err != nil {
+		return err
+	}
+	Log.Infof("Archive %s removed.", archivePath)
+	sidecarPath := checksumCachePath(archivePath, uc.VMImage.hashAlgo())
+	if err := os.Remove(sidecarPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(uc.VMImage.Parts) > 0 {
+		os.Remove(checksumCachePath(archivePath, partsFingerprintAlgo))
+	}
+	for _, part := range uc.VMImage.Parts {
+		partChoice := uc
+		partChoice.VMImage = part
+		if err := DeleteArchive(partChoice, pathJoin(uc.DownloadPath, part.archiveName())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unzipFolderPath function returns a folder where VM archive is unpacked, it is the archive path without extension.
+func unzipFolderPath(uc UserChoice) string {
+	return trimArchiveExtension(archivePath(uc))
+}
+
+// UnzipVM function unpack downloaded VM archive. Zip, tar.gz and 7z archives are supported, 7z archives are
+// unpacked with 7z tool.
+func UnzipVM(uc UserChoice) (string, error) {
+	vmPath, _, err := unzipVM(uc)
+	return vmPath, err
+}
+
+// unzipVM function unpacks VM archive like UnzipVM does and returns the folder it was unpacked into too, the folder
+// name is unique if UniqueRun is set.
+func unzipVM(uc UserChoice) (string, string, error) {
+	vmPath := archivePath(uc)
+	format, err := archiveFormat(vmPath)
+	if err != nil {
+		return "", "", err
+	}
+
+	unzipFolder := unzipFolderPath(uc)
+	if UniqueRun {
+		// Per-run suffix lets concurrent or repeated runs of the same VM work with their own files.
+		unzipFolder += uniqueSuffix()
+	}
+	if _, err := os.Stat(unzipFolder); os.IsNotExist(err) {
+		if err := os.Mkdir(unzipFolder, 0755); err != nil {
+			return "", "", err
+		}
+	}
+	Log.Infof("Unpack data into '%s'", unzipFolder)
+
+	if MinimalExtract && format != "zip" {
+		Log.Warnf("Minimal extraction isn't supported for %s archives, all files are unpacked.", format)
+	}
+	var collectedPaths []string
+	switch format {
+	case "tar.gz":
+		collectedPaths, err = untarGzip(vmPath, unzipFolder)
+	case "7z":
+		collectedPaths, err = un7z(vmPath, unzipFolder)
+	default:
+		collectedPaths, err = unzipArchive(uc, vmPath, unzipFolder)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	vmFile, err := selectVMFile(uc.Hypervisor, collectedPaths)
+	return vmFile, unzipFolder, err
+}
+
+// unzipArchive function unpacks a given zip archive into a folder and returns paths of unpacked files.
+func unzipArchive(uc UserChoice, vmPath, unzipFolder string) ([]string, error) {
+	zipReader, err := zip.OpenReader(vmPath)
+	if err != nil {
+		return nil, err
+	}
+	defer zipReader.Close()
+
+	files := zipReader.File
+	// NOTE: all files are unpacked if a disk could be converted, because the archive may be made for another
+	// hypervisor.
+	if MinimalExtract && !(ConvertDisks && nativeDiskFormats[uc.Hypervisor] != "") {
+		if files, err = requiredFiles(uc.Hypervisor, files); err != nil {
+			return nil, err
+		}
+	}
+	// NOTE: entries are checked before anything is unpacked, so an archive with entries pointing outside of
+	// the folder, e.g. '../file', doesn't leave any files behind.
+	targets := make(map[*zip.File]string, len(files))
+	var unpackedSize int64
+	for _, file := range files {
+		target, err := safeJoin(unzipFolder, file.Name)
+		if err != nil {
+			return nil, err
+		}
+		targets[file] = target
+		unpackedSize += int64(file.UncompressedSize64)
+	}
+	if err := checkDiskSpace(uc.DownloadPath, unpackedSize); err != nil {
+		return nil, err
+	}
+
+	fileCount := 0
+	for _, file := range files {
+		if !file.FileInfo().IsDir() {
+			fileCount++
+		}
+	}
+
+	var collectedPaths, failedPaths []string
+	var folders []*zip.File
+	fileNumber := 0
+	for _, file := range files {
+		filePath := targets[file]
+		if file.FileInfo().IsDir() {
+			os.MkdirAll(filePath, file.Mode().Perm())
+			folders = append(folders, file)
+			continue
+		}
+		fileNumber++
+		// NOTE: folder entries of skipped files aren't unpacked with minimal extraction.
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			return nil, err
+		}
+
+		// Collected paths are required because each hypervisor has its own entry point file.
+		// For example, VirtualBox needs .ova file, VMware needs .ovf file and Hyper-V needs .xml file etc.
+		collectedPaths = append(collectedPaths, filePath)
+
+		if existing, err := os.Stat(filePath); err == nil {
+			// NOTE: an existing file could be left by an interrupted unzip so it is trusted only if its size and
+			// CRC32 match the ones stored in the archive. Otherwise it is truncated and unpacked again.
+			if existing.Size() == int64(file.UncompressedSize64) {
+				if crc, err := fileCRC32(filePath); err == nil && crc == file.CRC32 {
+					Log.Infof("File '%s' already exist and its CRC32 matches, skip.", filePath)
+					continue
+				}
+			}
+			Log.Infof("File '%s' already exist but it doesn't match the archive, unpack it again.", filePath)
+		}
+
+		Log.Infof("Unpacking %d/%d '%s'", fileNumber, fileCount, file.Name)
+		crc, err := unzipFile(file, filePath)
+		if err != nil {
+			return nil, err
+		}
+		if crc != file.CRC32 {
+			failedPaths = append(failedPaths, filePath)
+			continue
+		}
+		if err := restoreAttributes(file, filePath); err != nil {
+			return nil, err
+		}
+	}
+	// NOTE: unpacking files changes modification time of their folders, so folders are handled last.
+	for _, folder := range folders {
+		if err := restoreAttributes(folder, targets[folder]); err != nil {
+			return nil, err
+		}
+	}
+	if len(failedPaths) > 0 {
+		return nil, fmt.Errorf("CRC32 validation failed for %s", strings.Join(failedPaths, ", "))
+	}
+	return collectedPaths, nil
+}
+
+// VMGroup var defines a group which imported VMs are added to, e.g. /IE-VMs. Only VirtualBox supports groups.
+// Empty value means no group.
+var VMGroup = ""
+
+// ValidateVMGroup function checks a VM group name and returns it in the form expected by VirtualBox, i.e. with
+// leading slash and nested groups separated by slashes, e.g. /IE-VMs/Win10.
+func ValidateVMGroup(group string) (string, error) {
+	group = "/" + strings.Trim(strings.TrimSpace(group), "/")
+	if group == "/" {
+		return "", fmt.Errorf("group name is empty")
+	}
+	for _, part := range strings.Split(group[1:], "/") {
+		if strings.TrimSpace(part) == "" {
+			return "", fmt.Errorf("group '%s' has an empty nested group", group)
+		}
+	}
+	// NOTE: VirtualBox uses commas to separate several groups of a VM.
+	if strings.Contains(group, ",") {
+		return "", fmt.Errorf("group '%s' must not contain commas", group)
+	}
+	return group, nil
+}
+
+// vboxImportArgs function returns vboxmanage import arguments for a given VM file and name.
+func vboxImportArgs(vmPath, name string) []string {
+	args := []string{"import", vmPath, "--vsys", "0", "--vmname", name}
+	if VMGroup != "" {
+		args = append(args, "--group", VMGroup)
+	}
+	return args
+}
+
+// vboxManageCmd var keeps vboxmanage command path resolved by checkVirtualBox.
+var vboxManageCmd = "vboxmanage"
+
+func checkVirtualBox(logger *Logger) (string, error) {
+	logger.Info("Checking VirtualBox installation.")
+	vboxManageCmd = findVBoxManage()
+	cmdName := vboxManageCmd
+	cmdArgs := []string{"--version"}
+	result, err := execCommand(cmdName, cmdArgs...).CombinedOutput()
+	if err != nil {
+		logger.Error(string(result), err)
+		return "", err
+	}
+	version := strings.TrimSpace(string(result))
+	logger.Info("Detected vboxmanage version", version)
+	return version, nil
+}
+
+func importVirtualBoxVM(vmPath, name string) error {
+	// NOTE: vboxmanage can import the same VM many times, so InstallVM checks existing VMs first.
+	Log.Info("Import VM into VirtualBox. Please wait.")
+	cmdName := vboxManageCmd
+	cmdArgs := vboxImportArgs(vmPath, name)
+	result, err := execCommand(cmdName, cmdArgs...).CombinedOutput()
+	if err != nil {
+		Log.Error(string(result), err)
+		return err
+	}
+	Log.Info(string(result))
+	return nil
+}
+
+func checkVmware(logger *Logger) (string, error) {
+	// TODO: improve VMware installation checks for Windows platforms.
+	// NOTE: VMware requires two command line tools to works with VMs.
+	logger.Info("Checking VMware installation.")
+	cmdName := "ovftool"
+	cmdArgs := []string{"--version"}
+	result, err := execCommand(cmdName, cmdArgs...).CombinedOutput()
+	if err != nil {
+		logger.Error(string(result), err)
+		return "", err
+	}
+	ovftoolVersion := strings.TrimSpace(string(result))
+	logger.Info("Detected", ovftoolVersion)
+
+	// NOTE: vmrun doesn't have --help or --version or similar options.
+	// Without any parameters it exits with status code 255 (Linux, Mac)
+	// or 4294967295 (Windows) and shows help text. So command execution
+	// output is checked to determine if vmrun is present.
+	cmdName = "vmrun"
+	result, err = execCommand(cmdName).CombinedOutput()
+	lines := strings.Split(string(result), "\n")
+	if len(lines) < 2 || !strings.Contains(lines[1], "vmrun version") {
+		logger.Error(string(result), err)
+		return "", fmt.Errorf("vmrun isn't found")
+	}
+	version := strings.TrimSpace(lines[1])
+	logger.Info("Detected", version)
+	return ovftoolVersion + ", " + version, nil
+}
+
+// convertVmware function converts provided .ovf file into .vmx file.
+func convertVmware(ovfPath, name string) (string, error) {
+	// NOTE: ovftool fails if .vmx file exists
+	vmxPath := strings.Replace(ovfPath, ".ovf", ".vmx", 1)
+	Log.Infof("Convert %s to %s. Please wait.", ovfPath, vmxPath)
+
+	command := ovftoolCommand(ovfPath, vmxPath, name)
+	result, err := execCommand(command[0], command[1:]...).CombinedOutput()
+	if err != nil {
+		Log.Error(string(result), err)
+		return "", err
+	}
+	Log.Info(string(result))
+	return vmxPath, nil
+}
+
+// ovftoolCommand function returns a command line which converts .ovf file into .vmx file of a named VM.
+func ovftoolCommand(ovfPath, vmxPath, name string) []string {
+	return []string{"ovftool", "--name=" + name, ovfPath, vmxPath}
+}
+
+// lineEnding function detects line ending used in a given content.
+// If content has no line endings the OS specific one is returned.
+func lineEnding(content []byte) string {
+	switch {
+	case strings.Contains(string(content), "\r\n"):
+		return "\r\n"
+	case strings.Contains(string(content), "\n"):
+		return "\n"
+	case runtime.GOOS == "windows":
+		return "\r\n"
+	default:
+		return "\n"
+	}
+}
+
+// fixVmwareNetwork function adds missed network configuration into .vmx file.
+func fixVmwareNetwork(vmxPath string) {
+	if vmxFile, err := os.Stat(vmxPath); err == nil {
+		content, err := ioutil.ReadFile(vmxPath)
+		if err != nil {
+			return
+		}
+		eol := lineEnding(content)
+		if vmxFile, err := os.OpenFile(vmxPath, os.O_APPEND|os.O_WRONLY, vmxFile.Mode()); err == nil {
+			vmxFile.WriteString("ethernet0.present = \"TRUE\"" + eol)
+			vmxFile.WriteString("ethernet0.connectionType = \"nat\"" + eol)
+			vmxFile.WriteString("ethernet0.wakeOnPcktRcv = \"FALSE\"" + eol)
+			vmxFile.WriteString("ethernet0.addressType = \"generated\"" + eol)
+			vmxFile.Close()
+		}
+	}
+}
+
+func importVmwareVM(vmxPath string) error {
+	// NOTE: VMware runvm command doesn't have anything like import, so start and stop sub-commands
+	// are used to add a VM into the library.
+	for _, command := range vmrunCommands(vmxPath) {
+		Log.Infof("Run vmrun %s %s", command[1], vmxPath)
+		if _, err := execCommand(command[0], command[1:]...).Output(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// vmrunCommands function returns command lines which start and stop a VM to add it into VMware library.
+func vmrunCommands(vmxPath string) [][]string {
+	return [][]string{{"vmrun", "start", vmxPath}, {"vmrun", "stop", vmxPath}}
+}
+
+// hypervisorLaunchRe matches hypervisorlaunchtype setting of bcdedit output.
+var hypervisorLaunchRe = regexp.MustCompile(`(?im)^hypervisorlaunchtype\s+(\w+)`)
+
+// hypervEnabled function checks if Windows runs on top of Hyper-V hypervisor. Other hypervisors like VirtualBox and
+// VMware fail or work very slowly then.
+func hypervEnabled() (bool, error) {
+	if runtime.GOOS != "windows" {
+		return false, nil
+	}
+	return hypervLaunched()
+}
+
+// hypervLaunched function checks if Hyper-V is configured to start with Windows. Boot configuration is the most
+// reliable source, but bcdedit and Get-WindowsOptionalFeature require Administrator rights. HypervisorPresent is
+// the last resort because it is true in a Windows guest of any hypervisor too.
+func hypervLaunched() (bool, error) {
+	if result, err := execCommand("bcdedit", "/enum", "{current}").Output(); err == nil {
+		match := hypervisorLaunchRe.FindSubmatch(result)
+		return match != nil && !strings.EqualFold(string(match[1]), "Off"), nil
+	}
+	result, err := execCommand("powershell", "-NoProfile", "-NonInteractive", "-Command",
+		"(Get-WindowsOptionalFeature -Online -FeatureName Microsoft-Hyper-V).State").Output()
+	if state := strings.TrimSpace(string(result)); err == nil && state != "" {
+		return strings.EqualFold(state, "Enabled"), nil
+	}
+	result, err = execCommand("powershell", "-NoProfile", "-NonInteractive", "-Command",
+		"(Get-CimInstance Win32_ComputerSystem).HypervisorPresent").Output()
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(strings.TrimSpace(string(result)), "True"), nil
+}
+
+func checkHyperv(logger *Logger) (string, error) {
+	// Powershell is required for Hyper-V.
+	logger.Info("Checking Hyper-V installation.")
+	cmdName := "powershell"
+	cmdArgs1 := []string{"-Command", "Get-Host"}
+	if result, err := execCommand(cmdName, cmdArgs1...).CombinedOutput(); err != nil {
+		logger.Error(string(result))
+		return "", err
+	}
+	logger.Info("Powershell is present.")
+
+	// Check if Hyper-V Cmdlets are available.
+	cmdArgs2 := []string{"-Command", "Get-Command", "-Module", "Hyper-V"}
+	if result, err := execCommand(cmdName, cmdArgs2...).CombinedOutput(); err != nil {
+		logger.Error(string(result))
+		return "", err
+	}
+	logger.Info("Hyper-V Cmdlets are present.")
+
+	// NOTE: the version of Virtual Machine Management service is the version of Hyper-V itself.
+	cmdArgs3 := []string{"-NoProfile", "-NonInteractive", "-Command",
+		"(Get-Item (Join-Path $env:SystemRoot 'System32\\vmms.exe')).VersionInfo.ProductVersion"}
+	result, err := execCommand(cmdName, cmdArgs3...).CombinedOutput()
+	version := strings.TrimSpace(string(result))
+	if err != nil || version == "" {
+		logger.Error(version)
+		return "", fmt.Errorf("Hyper-V Virtual Machine Management service isn't installed")
+	}
+	version = "Hyper-V " + version
+	logger.Info("Detected", version)
+	return version, nil
+}
+
+// psQuote function quotes a given string as PowerShell literal, so spaces and special characters like $ or `
+// aren't interpreted. Only single quotes have to be escaped inside such literals by doubling them.
+func psQuote(value string) string {
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
+
+// hypervImportScript function returns PowerShell script which imports a VM config file and renames the VM.
+func hypervImportScript(configPath, name string) string {
+	return fmt.Sprintf("Import-VM -Path %s | Rename-VM -NewName %s", psQuote(configPath), psQuote(name))
+}
+
+// hypervImportCommand function returns a command line which imports a VM config file and renames the VM.
+// NOTE: the whole script is passed as a single argument, so the path isn't split on spaces by PowerShell.
+func hypervImportCommand(configPath, name string) []string {
+	return []string{"powershell", "-NoProfile", "-NonInteractive", "-Command", hypervImportScript(configPath, name)}
+}
+
+// hypervConfigPath function returns path to a VM config file which Import-VM requires. Hyper-V exports keep
+// the config in 'Virtual Machines' sub-folder, so if a folder is given it is searched for .xml or .vmcx file.
+func hypervConfigPath(vmPath string) (string, error) {
+	info, err := os.Stat(vmPath)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return vmPath, nil
+	}
+	var configPath string
+	err = filepath.Walk(vmPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || configPath != "" {
+			return err
+		}
+		ext := strings.ToLower(filepath.Ext(filePath))
+		if !info.IsDir() && (ext == ".xml" || ext == ".vmcx") {
+			configPath = filePath
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if configPath == "" {
+		return "", fmt.Errorf("Hyper-V VM config file not found in %s", vmPath)
+	}
+	return configPath, nil
+}
+
+func importHypervVM(vmPath, name string) error {
+	configPath, err := hypervConfigPath(vmPath)
+	if err != nil {
+		return err
+	}
+	Log.Infof("Import '%s' as '%s'. Please wait.", configPath, name)
+	command := hypervImportCommand(configPath, name)
+	if result, err := execCommand(command[0], command[1:]...).CombinedOutput(); err != nil {
+		Log.Error(string(result))
+		return err
+	}
+	// NOTE: Hyper-V uses virtual network switches for VMs. After installation it doesn't have any network switches
+	// set. Also it could have several virtual network switches. So the imported VM is left as-is and a user should
+	// configure networking manually.
+	Log.Warn("Please check Network adapter settings. By default it isn't connected.")
+	return nil
 }
 
-// Md5Wrapper type is used to calculate file's md5 sum during download.
-type Md5Wrapper struct {
-	io.Writer
-	md5sum hash.Hash
+func checkVagrant(logger *Logger) (string, error) {
+	logger.Info("Checking Vagrant installation.")
+	cmdName := "vagrant"
+	cmdArgs := []string{"--version"}
+	result, err := execCommand(cmdName, cmdArgs...).CombinedOutput()
+	if err != nil {
+		logger.Error(string(result), err)
+		return "", err
+	}
+	version := strings.TrimSpace(string(result))
+	logger.Info("Detected", version)
+	return version, nil
 }
 
-func (pw *ProgressWrapper) Read(p []byte) (int, error) {
-	n, err := pw.Reader.Read(p)
-	if n > 0 {
-		pw.total += int64(n)
-		progress := float64(pw.total) / float64(pw.size) * float64(100)
-		// Show progress for each N%
-		if progress-pw.progress > pw.step {
-			fmt.Printf("Downloaded %.2f%%\r", progress)
-			pw.progress = progress
-		} else if pw.total == pw.size {
-			fmt.Println("Download finished")
-		}
-	}
-	return n, err
+// vagrantBoxName function generates Vagrant box name from a VM name, e.g. 'IE11 - Win7' becomes 'getie/ie11-win7'.
+func vagrantBoxName(name string) string {
+	return "getie/" + slugName(name)
 }
 
-func (mw *Md5Wrapper) Write(p []byte) (int, error) {
-	n, err := mw.Writer.Write(p)
-	mw.md5sum.Write(p)
-	return n, err
+// slugName function returns a given name with only lower case letters, digits, dots, underscores and dashes,
+// e.g. 'IE11 - Win7' becomes 'ie11-win7'.
+func slugName(name string) string {
+	name = strings.ToLower(name)
+	return strings.Join(strings.FieldsFunc(name, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '.' || r == '_')
+	}), "-")
 }
 
-// getOrigMd5 function gets MD5 provided by Microsoft for each VM archive.
-func getOrigMd5(vm VMImage) string {
-	resp, err := http.Get(vm.Md5URL)
+// vagrantBoxes function lists names of boxes added into Vagrant.
+func vagrantBoxes() ([]string, error) {
+	// NOTE: vagrant lists boxes as 'name (provider, version)' lines.
+	result, err := execCommand("vagrant", "box", "list").Output()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer resp.Body.Close()
-
-	origMd5, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		panic(err)
+	var names []string
+	for _, line := range strings.Split(string(result), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			names = append(names, fields[0])
+		}
 	}
-	return string(origMd5)
+	return names, nil
 }
 
-func compareMd5(md5str1, md5str2 string) {
-	if md5str1 != md5str2 {
-		fmt.Println("MD5 sum doesn't match. Aborting.")
-		os.Exit(1)
-	} else {
-		fmt.Println("MD5 sum matches.")
-	}
+// vagrantAddCommand function returns a command line which adds a box file into Vagrant.
+func vagrantAddCommand(boxPath, name string) []string {
+	return []string{"vagrant", "box", "add", "--name", vagrantBoxName(name), boxPath}
 }
 
-func pathJoin(path1, path2 string) string {
-	if runtime.GOOS == "windows" {
-		return strings.Replace(path.Join(path1, path2), "/", "\\", -1)
+func importVagrantBox(boxPath, name string) error {
+	boxName := vagrantBoxName(name)
+	Log.Infof("Add %s box into Vagrant. Please wait.", boxName)
+	command := vagrantAddCommand(boxPath, name)
+	result, err := execCommand(command[0], command[1:]...).CombinedOutput()
+	if err != nil {
+		Log.Error(string(result), err)
+		return err
 	}
-	return path.Join(path1, path2)
+	Log.Info(string(result))
+	Log.Infof("Use it with: vagrant init %s", boxName)
+	return nil
 }
 
-// DownloadVM function downloads VM archive defined by a user and returns the path where it was stored.
-func DownloadVM(uc UserChoice) string {
-	vmFile := pathJoin(uc.DownloadPath, path.Base(uc.VMImage.FileURL))
-	fmt.Printf("Download: %s\nTo: %s\n", uc.VMImage.FileURL, vmFile)
-
-	origMd5 := getOrigMd5(uc.VMImage)
-	fmt.Printf("Expected MD5 sum %s\n", origMd5)
-
-	if _, err := os.Stat(vmFile); err == nil {
-		fmt.Printf("File %s already exists.\nChecking MD5 sum\n", vmFile)
-		oldFile, err := os.Open(vmFile)
-		if err != nil {
-			panic(err)
-		}
-		defer oldFile.Close()
-
-		oldMd5 := md5.New()
-		if _, err := io.Copy(oldMd5, oldFile); err != nil {
-			panic(err)
-		}
-
-		vmMd5 := fmt.Sprintf("%X", oldMd5.Sum([]byte{}))
-		fmt.Printf("Local file MD5 sum %s\n", vmMd5)
-		compareMd5(origMd5, vmMd5)
-	} else {
-		fmt.Println("Start downloading.")
-
-		newFile, err := os.Create(vmFile)
-		if err != nil {
-			panic(err)
+func checkParallels(logger *Logger) (string, error) {
+	// NOTE: Parallels has two command line tools prlsrvctl and prlctl.
+	// Parallels version could be checked with prlsrvctl but VM management is done with prlctl.
+	logger.Info("Checking Parallels installation.")
+	cmdName := "prlsrvctl"
+	cmdArgs := []string{"info"}
+	result, err := execCommand(cmdName, cmdArgs...).CombinedOutput()
+	if err != nil {
+		logger.Error(string(result), err)
+		return "", err
+	}
+	logger.Info(string(result))
+	// NOTE: prlsrvctl info shows many details, only the version line is kept.
+	version := "Parallels Desktop"
+	for _, line := range strings.Split(string(result), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "Version:") {
+			version = strings.TrimSpace(line)
 		}
-		defer newFile.Close()
-		newFileMd5 := &Md5Wrapper{Writer: newFile, md5sum: md5.New()}
+	}
+	return version, nil
+}
 
-		resp, err := http.Get(uc.VMImage.FileURL)
+func importParallelsVM(vmPath, name string) error {
+	Log.Info("Import VM into Parallels. Please wait.")
+	for _, command := range parallelsImportCommands(vmPath, name) {
+		result, err := execCommand(command[0], command[1:]...).CombinedOutput()
 		if err != nil {
-			panic(err)
-		}
-		defer resp.Body.Close()
-		fmt.Printf("File size %d bytes\n", resp.ContentLength)
-		vmSrc := &ProgressWrapper{
-			Reader: resp.Body,
-			size:   resp.ContentLength,
-			// progress download step for 1Mb chunks
-			step: float64(1024*1024) / float64(resp.ContentLength) * float64(100),
-		}
-
-		if _, err := io.Copy(newFileMd5, vmSrc); err != nil {
-			panic(err)
+			Log.Error(string(result), err)
+			return err
 		}
-
-		vmMd5 := fmt.Sprintf("%X", newFileMd5.md5sum.Sum([]byte{}))
-		fmt.Printf("Downloaded file MD5 sum %s\n", vmMd5)
-		compareMd5(origMd5, vmMd5)
+		Log.Info(string(result))
 	}
-	return vmFile
+	return nil
 }
 
-// vmFilePath function finds a specific file path depending on a hypervisor.
-// Different hypervisors have different file names for VMs. For example, VirtualBox has .ova extension but VMware needs
-// .ovf file etc.
-func vmFilePath(hypervisor string, collectedPaths []string) (string, error) {
-	search := ""
-	switch hypervisor {
-	case "VirtualBox":
-		search = ".ova"
-	case "VMware":
-		search = ".ovf"
-	case "HyperV":
-		search = ".xml"
-	case "Parallels":
-		search = ".pvs"
-	}
-	if search != "" {
-		for _, vmPath := range collectedPaths {
-			if strings.HasSuffix(vmPath, search) {
-				return vmPath, nil
-			}
-		}
+// parallelsImportCommands function returns command lines which register a VM in Parallels and rename it.
+// NOTE: prlctl register doesn't accept a name, so the registered VM is renamed.
+func parallelsImportCommands(vmPath, name string) [][]string {
+	return [][]string{
+		{"prlctl", "register", vmPath},
+		{"prlctl", "set", parallelsRegisteredName(vmPath), "--name", name},
 	}
-	return "", fmt.Errorf("Din't find VM path for %s\n", hypervisor)
 }
 
-// UnzipVM function unpack downloaded VM archive.
-func UnzipVM(uc UserChoice) (string, error) {
-	vmPath := pathJoin(uc.DownloadPath, path.Base(uc.VMImage.FileURL))
-	zipReader, err := zip.OpenReader(vmPath)
+func checkQemu(logger *Logger) (string, error) {
+	// NOTE: qemu-img is used to convert disks, virt-install and virsh are used to define libvirt domains.
+	logger.Info("Checking QEMU installation.")
+	cmdName := "qemu-img"
+	cmdArgs := []string{"--version"}
+	result, err := execCommand(cmdName, cmdArgs...).CombinedOutput()
 	if err != nil {
+		logger.Error(string(result), err)
 		return "", err
 	}
-	defer zipReader.Close()
+	version := strings.TrimSpace(strings.Split(string(result), "\n")[0])
+	logger.Info("Detected", version)
 
-	unzipFolder := pathJoin(uc.DownloadPath, path.Base(uc.VMImage.FileURL))
-	unzipFolderParts := strings.Split(unzipFolder, ".")
-	unzipFolder = strings.Join(unzipFolderParts[:len(unzipFolderParts)-1], ".")
-	if _, err := os.Stat(unzipFolder); os.IsNotExist(err) {
-		if err := os.Mkdir(unzipFolder, 0755); err != nil {
+	for _, cmdName := range []string{"virt-install", "virsh"} {
+		result, err := execCommand(cmdName, "--version").CombinedOutput()
+		if err != nil {
+			logger.Error(string(result), err)
 			return "", err
 		}
+		logger.Infof("Detected %s version %s", cmdName, strings.TrimSpace(string(result)))
 	}
-	fmt.Printf("Unpack data into '%s'\n", unzipFolder)
-
-	var collectedPaths []string
-	for _, file := range zipReader.File {
-		fmt.Printf("Unpacking '%s'\n", file.Name)
-		filePath := pathJoin(unzipFolder, file.Name)
-		if _, err := os.Stat(filePath); err == nil {
-			collectedPaths = append(collectedPaths, filePath)
-			fmt.Printf("File '%s' already exist, skip.\n", filePath)
-			continue
-		}
-		if file.FileInfo().IsDir() {
-			os.MkdirAll(filePath, file.Mode())
-			continue
-		}
+	return version, nil
+}
 
-		// Collected paths are required because each hypervisor has its own entry point file.
-		// For example, VirtualBox needs .ova file, VMware needs .ovf file and Hyper-V needs .xml file etc.
-		collectedPaths = append(collectedPaths, filePath)
+// extractOvaDisk function extracts .vmdk disk from .ova file which is a tar archive.
+func extractOvaDisk(ovaPath string) (string, error) {
+	ovaFile, err := os.Open(ovaPath)
+	if err != nil {
+		return "", err
+	}
+	defer ovaFile.Close()
 
-		fileReader, err := file.Open()
+	ovaReader := tar.NewReader(ovaFile)
+	for {
+		header, err := ovaReader.Next()
+		if err == io.EOF {
+			return "", fmt.Errorf("Didn't find .vmdk disk in %s", ovaPath)
+		}
 		if err != nil {
 			return "", err
 		}
-		defer fileReader.Close()
+		if !strings.HasSuffix(header.Name, ".vmdk") {
+			continue
+		}
 
-		targetFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_CREATE, file.Mode())
+		// NOTE: entries of .ova files always use slashes, but the .ova path is a native one.
+		diskPath := pathJoin(filepath.Dir(ovaPath), path.Base(header.Name))
+		Log.Infof("Extract %s from %s", header.Name, ovaPath)
+		diskFile, err := os.Create(diskPath)
 		if err != nil {
 			return "", err
 		}
-		defer targetFile.Close()
-
-		if _, err := io.Copy(targetFile, fileReader); err != nil {
+		_, err = io.CopyBuffer(diskFile, ovaReader, make([]byte, CopyBufferSize))
+		if closeErr := diskFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			// NOTE: a partial disk isn't usable and it would be picked up as a VM disk later.
+			os.Remove(diskPath)
 			return "", err
 		}
+		return diskPath, nil
 	}
-	return vmFilePath(uc.Hypervisor, collectedPaths)
 }
 
-func checkVirtualBox() error {
-	// TODO: improve VirtualBox installation checks for Windows platforms.
-	fmt.Println("Checking VirtualBox installation.")
-	cmdName := "vboxmanage"
-	cmdArgs := []string{"--version"}
-	result, err := exec.Command(cmdName, cmdArgs...).CombinedOutput()
-	if err != nil {
-		fmt.Println(string(result), err)
+// qcowDiskPath function returns a path of qcow2 disk converted from a given .vmdk disk.
+func qcowDiskPath(diskPath string) string {
+	return strings.TrimSuffix(diskPath, ".vmdk") + ".qcow2"
+}
+
+// qemuImgConvertCommand function returns a command line which converts a disk into qcow2 format.
+func qemuImgConvertCommand(diskPath, qcowPath string) []string {
+	return []string{"qemu-img", "convert", "-O", "qcow2", diskPath, qcowPath}
+}
+
+// convertToQcow function converts a disk into qcow2 format with qemu-img.
+func convertToQcow(diskPath, qcowPath string) error {
+	Log.Infof("Convert %s to %s. Please wait.", diskPath, qcowPath)
+	command := qemuImgConvertCommand(diskPath, qcowPath)
+	if result, err := execCommand(command[0], command[1:]...).CombinedOutput(); err != nil {
+		Log.Error(string(result), err)
 		return err
 	}
-	fmt.Println("Detected vboxmanage version", string(result))
 	return nil
 }
 
-func importVirtualBoxVM(vmPath string) error {
-	// NOTE: vboxmanage can import the same VM many times
-	fmt.Println("Import VM into VirtualBox. Please wait.")
-	cmdName := "vboxmanage"
-	cmdArgs := []string{"import", vmPath}
-	result, err := exec.Command(cmdName, cmdArgs...).CombinedOutput()
-	if err != nil {
-		fmt.Println(string(result), err)
+// virtInstallCommand function returns a command line which prints libvirt domain XML of a VM with a given disk.
+func virtInstallCommand(name, qcowPath string) []string {
+	return []string{"virt-install", "--import", "--print-xml", "--name", name, "--memory", "2048", "--vcpus", "2",
+		"--disk", "path=" + qcowPath + ",format=qcow2", "--os-variant", "win7", "--noautoconsole"}
+}
+
+// virshDefineCommand function returns a command line which defines libvirt domain from its XML file.
+func virshDefineCommand(xmlPath string) []string {
+	return []string{"virsh", "define", xmlPath}
+}
+
+func importQemuVM(vmPath, name string) error {
+	diskPath := vmPath
+	if strings.HasSuffix(vmPath, ".ova") {
+		var err error
+		if diskPath, err = extractOvaDisk(vmPath); err != nil {
+			Log.Error(err)
+			return err
+		}
+	}
+
+	qcowPath := qcowDiskPath(diskPath)
+	if err := convertToQcow(diskPath, qcowPath); err != nil {
 		return err
 	}
-	fmt.Println(string(result))
-	return nil
-}
 
-func checkVmware() error {
-	// TODO: improve VMware installation checks for Windows platforms.
-	// NOTE: VMware requires two command line tools to works with VMs.
-	fmt.Println("Checking VMware installation.")
-	cmdName := "ovftool"
-	cmdArgs := []string{"--version"}
-	result, err := exec.Command(cmdName, cmdArgs...).CombinedOutput()
+	// NOTE: virt-install only generates domain XML here, the domain itself is defined with virsh.
+	Log.Infof("Define %s libvirt domain.", name)
+	command := virtInstallCommand(name, qcowPath)
+	domainXML, err := execCommand(command[0], command[1:]...).Output()
 	if err != nil {
-		fmt.Println(string(result), err)
+		Log.Error(string(domainXML), err)
 		return err
 	}
-	fmt.Println("Detected", string(result))
-
-	// NOTE: vmrun doesn't have --help or --version or similar options.
-	// Without any parameters it exits with status code 255 (Linux, Mac)
-	// or 4294967295 (Windows) and shows help text. So command execution
-	// output is checked to determine if vmrun is present.
-	cmdName = "vmrun"
-	result, err = exec.Command(cmdName).CombinedOutput()
-	if len(result) < 2 {
-		fmt.Println(string(result), err)
+	xmlPath := strings.TrimSuffix(qcowPath, ".qcow2") + ".xml"
+	if err := ioutil.WriteFile(xmlPath, domainXML, 0644); err != nil {
+		Log.Error(err)
 		return err
 	}
 
-	version := strings.Split(string(result), "\n")[1]
-	if !strings.Contains(version, "vmrun version") {
-		fmt.Println(string(result), err)
+	command = virshDefineCommand(xmlPath)
+	result, err := execCommand(command[0], command[1:]...).CombinedOutput()
+	if err != nil {
+		Log.Error(string(result), err)
 		return err
 	}
-	fmt.Println("Detected", version)
+	Log.Info(string(result))
 	return nil
 }
 
-// convertVmware function converts provided .ovf file into .vmx file.
-func convertVmware(ovfPath string) (string, error) {
-	// NOTE: ovftool fails if .vmx file exists
-	vmxPath := strings.Replace(ovfPath, ".ovf", ".vmx", 1)
-	fmt.Printf("Convert %s to %s. Please wait.\n", ovfPath, vmxPath)
+// ProxmoxStorage var defines Proxmox storage where imported VM disks are stored.
+var ProxmoxStorage = "local-lvm"
 
-	cmdName := "ovftool"
-	cmdArgs := []string{ovfPath, vmxPath}
-	result, err := exec.Command(cmdName, cmdArgs...).CombinedOutput()
+func checkProxmox(logger *Logger) (string, error) {
+	// NOTE: qm tool is available only on Proxmox VE nodes, pveversion is shipped with it.
+	logger.Info("Checking Proxmox VE installation.")
+	cmdName := "pveversion"
+	result, err := execCommand(cmdName).CombinedOutput()
 	if err != nil {
-		fmt.Println(string(result), err)
+		logger.Error(string(result), err)
 		return "", err
 	}
-	fmt.Println(string(result))
-	return vmxPath, nil
+	version := strings.TrimSpace(string(result))
+	logger.Info("Detected", version)
+	return version, nil
 }
 
-// fixVmwareNetwork function adds missed network configuration into .vmx file.
-func fixVmwareNetwork(vmxPath string) {
-	if vmxFile, err := os.Stat(vmxPath); err == nil {
-		if vmxFile, err := os.OpenFile(vmxPath, os.O_APPEND|os.O_WRONLY, vmxFile.Mode()); err == nil {
-			vmxFile.WriteString("ethernet0.present = \"TRUE\"\n")
-			vmxFile.WriteString("ethernet0.connectionType = \"nat\"\n")
-			vmxFile.WriteString("ethernet0.wakeOnPcktRcv = \"FALSE\"\n")
-			vmxFile.WriteString("ethernet0.addressType = \"generated\"\n")
-			vmxFile.Close()
+// proxmoxVMs function lists names of Proxmox VMs on the current node.
+func proxmoxVMs() ([]string, error) {
+	// NOTE: qm lists VMs as a table with VMID and NAME first columns.
+	result, err := execCommand("qm", "list").Output()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, line := range strings.Split(string(result), "\n")[1:] {
+		if fields := strings.Fields(line); len(fields) > 1 {
+			names = append(names, fields[1])
 		}
 	}
+	return names, nil
 }
 
-func importVmwareVM(vmxPath string) error {
-	// NOTE: VMware runvm command doesn't have anything like import, so start and stop sub-commands
-	// are used to add a VM into the library.
-	fmt.Printf("Starting %s VM\n", vmxPath)
+func importProxmoxVM(vmPath, vmName string) error {
+	diskPath := vmPath
+	if strings.HasSuffix(vmPath, ".ova") {
+		var err error
+		if diskPath, err = extractOvaDisk(vmPath); err != nil {
+			Log.Error(err)
+			return err
+		}
+	}
 
-	cmdName := "vmrun"
-	cmdArgs := []string{"start", vmxPath}
-	if _, err := exec.Command(cmdName, cmdArgs...).Output(); err != nil {
+	command := proxmoxNextIDCommand()
+	result, err := execCommand(command[0], command[1:]...).Output()
+	if err != nil {
+		Log.Error(string(result), err)
 		return err
 	}
+	vmID := strings.Trim(strings.TrimSpace(string(result)), "\"")
+	// NOTE: Proxmox VM names must be valid DNS names.
+	name := slugName(vmName)
 
-	fmt.Printf("Stopping %s VM\n", vmxPath)
-	cmdArgs[0] = "stop"
-	if _, err := exec.Command(cmdName, cmdArgs...).Output(); err != nil {
+	Log.Infof("Create Proxmox VM %s with ID %s.", name, vmID)
+	for _, command := range proxmoxImportCommands(vmID, diskPath, vmName) {
+		Log.Infof("Run %s. Please wait.", strings.Join(command[:2], " "))
+		result, err = execCommand(command[0], command[1:]...).CombinedOutput()
+		if err != nil {
+			Log.Error(string(result), err)
+			return err
+		}
+	}
+	// NOTE: volume ID depends on the storage type, e.g. local-lvm:vm-100-disk-0 for LVM and
+	// local:100/vm-100-disk-0.raw for directory and NFS storages, so it is taken from qm output.
+	match := proxmoxVolumeRe.FindStringSubmatch(string(result))
+	if match == nil {
+		err := fmt.Errorf("imported disk isn't found in qm importdisk output: %s", strings.TrimSpace(string(result)))
+		Log.Error(err)
 		return err
 	}
+	Log.Infof("Attach disk %s.", match[1])
+	command = proxmoxAttachCommand(vmID, match[1])
+	if result, err := execCommand(command[0], command[1:]...).CombinedOutput(); err != nil {
+		Log.Error(string(result), err)
+		return err
+	}
+	Log.Infof("VM %s is created.", name)
 	return nil
 }
 
-func checkHyperv() error {
-	// Powershell is required for Hyper-V.
-	fmt.Println("Checking Hyper-V installation.")
-	cmdName := "powershell"
-	cmdArgs1 := []string{"-Command", "Get-Host"}
-	if result, err := exec.Command(cmdName, cmdArgs1...).CombinedOutput(); err != nil {
-		fmt.Println(string(result))
-		return err
+// proxmoxNextIDCommand function returns a command line which prints ID for a new Proxmox VM.
+func proxmoxNextIDCommand() []string {
+	return []string{"pvesh", "get", "/cluster/nextid"}
+}
+
+// proxmoxImportCommands function returns command lines which create a Proxmox VM with a given ID and import
+// a disk into ProxmoxStorage.
+// NOTE: qm importdisk converts the disk into the storage format, the disk is attached as unused first.
+func proxmoxImportCommands(vmID, diskPath, name string) [][]string {
+	return [][]string{
+		{"qm", "create", vmID, "--name", slugName(name), "--memory", "2048", "--cores", "2", "--ostype", "win7",
+			"--net0", "e1000,bridge=vmbr0"},
+		{"qm", "importdisk", vmID, diskPath, ProxmoxStorage},
 	}
-	fmt.Println("Powershell is present.")
+}
 
-	// Check if Hyper-V Cmdlets are available.
-	cmdArgs2 := []string{"-Command", "Get-Command", "-Module", "Hyper-V"}
-	if result, err := exec.Command(cmdName, cmdArgs2...).CombinedOutput(); err != nil {
-		fmt.Println(string(result))
-		return err
+// proxmoxAttachCommand function returns a command line which attaches an imported volume as the boot disk.
+func proxmoxAttachCommand(vmID, volume string) []string {
+	return []string{"qm", "set", vmID, "--sata0", volume, "--boot", "order=sata0"}
+}
+
+// proxmoxVolumeRe matches volume ID of a disk in qm importdisk output. Older Proxmox VE versions print
+// "Successfully imported disk as 'unused0:local-lvm:vm-100-disk-0'", newer ones print
+// "unused0: successfully imported disk 'local-lvm:vm-100-disk-0'".
+var proxmoxVolumeRe = regexp.MustCompile(`(?i)imported disk (?:as )?'(?:unused\d+:)?([^']+)'`)
+
+// RunInstaller function hands unpacked VM to an external installer command instead of built-in hypervisor imports.
+// The command template could contain {path}, {hypervisor} and {name} placeholders. The same values are also
+// available to the command as GETIE_VM_PATH, GETIE_HYPERVISOR and GETIE_VM_NAME environment variables.
+func RunInstaller(template string, uc UserChoice, vmPath string) error {
+	cmdParts := strings.Fields(template)
+	if len(cmdParts) == 0 {
+		return fmt.Errorf("installer command is empty")
 	}
-	fmt.Println("Hyper-V Cmdlets are present.")
-	return nil
+	replacer := strings.NewReplacer("{path}", vmPath, "{hypervisor}", uc.Hypervisor, "{name}", uc.BrowserOs)
+	for idx, part := range cmdParts {
+		cmdParts[idx] = replacer.Replace(part)
+	}
+
+	Log.Infof("Run installer %s", cmdParts[0])
+	cmd := execCommand(cmdParts[0], cmdParts[1:]...)
+	// NOTE: nil Env means the environment of the tool, it is extended and environment set by execCommand is kept.
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env,
+		"GETIE_VM_PATH="+vmPath,
+		"GETIE_HYPERVISOR="+uc.Hypervisor,
+		"GETIE_VM_NAME="+uc.BrowserOs,
+	)
+	result, err := cmd.CombinedOutput()
+	Log.Info(string(result))
+	return err
 }
 
-func importHypervVM(vmPath string) error {
-	fmt.Printf("Import '%s'. Please wait.\n", vmPath)
-	cmdName := "powershell"
-	cmdArgs1 := []string{"-Command", "Import-VM", "-Path", fmt.Sprintf("'%s'", vmPath)}
-	if result, err := exec.Command(cmdName, cmdArgs1...).CombinedOutput(); err != nil {
-		fmt.Println(string(result))
-		return err
+// installCommands function returns command lines which InstallVM runs to import a given VM into a hypervisor.
+// Commands are built by the same functions which import functions run, values known only during the import,
+// e.g. a disk extracted from .ova file, are shown as placeholders in angle brackets. Installation checks are
+// omitted.
+func installCommands(hypervisor, vmPath, name string) []string {
+	diskPath := vmPath
+	if !strings.HasSuffix(vmPath, ".vmdk") {
+		diskPath = "<disk>.vmdk"
 	}
-	// NOTE: Hyper-V uses virtual network switches for VMs. After installation it doesn't have any network switches
-	// set. Also it could have several virtual network switches. So the imported VM is left as-is and a user should
-	// configure networking manually.
-	fmt.Println("WARNING: Please check Network adapter settings. By default it isn't connected.")
-	return nil
+	var commands [][]string
+	var lines []string
+	switch hypervisor {
+	case "VirtualBox":
+		commands = [][]string{append([]string{findVBoxManage()}, vboxImportArgs(vmPath, name)...)}
+	case "VMware":
+		vmxPath := strings.Replace(vmPath, ".ovf", ".vmx", 1)
+		commands = append([][]string{ovftoolCommand(vmPath, vmxPath, name)}, vmrunCommands(vmxPath)...)
+	case "HyperV":
+		commands = [][]string{hypervImportCommand(vmPath, name)}
+	case "Parallels":
+		commands = parallelsImportCommands(vmPath, name)
+	case "Proxmox":
+		commands = append([][]string{proxmoxNextIDCommand()}, proxmoxImportCommands("<next id>", diskPath, name)...)
+		commands = append(commands, proxmoxAttachCommand("<next id>", "<imported volume>"))
+	case "Vagrant":
+		commands = [][]string{vagrantAddCommand(vmPath, name)}
+	case "QEMU":
+		qcowPath := qcowDiskPath(diskPath)
+		xmlPath := strings.TrimSuffix(qcowPath, ".qcow2") + ".xml"
+		lines = []string{
+			commandText(qemuImgConvertCommand(diskPath, qcowPath)),
+			commandText(virtInstallCommand(name, qcowPath)) + " > " + quoteArg(xmlPath),
+			commandText(virshDefineCommand(xmlPath)),
+		}
+	case "Xen":
+		qcowPath := qcowDiskPath(diskPath)
+		lines = []string{commandText(qemuImgConvertCommand(diskPath, qcowPath)), "write " + quoteArg(xenConfigFile(name))}
+	case "WindowsSandbox":
+		lines = []string{"write " + quoteArg(sandboxConfigPath(vmPath, name))}
+	}
+	for _, command := range commands {
+		lines = append(lines, commandText(command))
+	}
+	return lines
 }
 
-func checkParallels() error {
-	// NOTE: Parallels has two command line tools prlsrvctl and prlctl.
-	// Parallels version could be checked with prlsrvctl but VM management is done with prlctl.
-	fmt.Println("Checking Parallels installation.")
-	cmdName := "prlsrvctl"
-	cmdArgs := []string{"info"}
-	result, err := exec.Command(cmdName, cmdArgs...).CombinedOutput()
+// commandText function formats a command line to be shown to a user, arguments with spaces or special characters
+// are quoted for the current platform's shell. Placeholders in angle brackets aren't quoted.
+func commandText(command []string) string {
+	quoted := make([]string, 0, len(command))
+	for _, arg := range command {
+		quoted = append(quoted, quoteArg(arg))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// shellSafeRe matches arguments which don't need quotes in a shell.
+var shellSafeRe = regexp.MustCompile(`^[\w@%+=:,./-]+$`)
+
+// quoteArg function quotes a command argument if needed, double quotes are used on Windows and single quotes on
+// other platforms.
+func quoteArg(arg string) string {
+	switch {
+	case strings.HasPrefix(arg, "<") && strings.HasSuffix(arg, ">") && !strings.ContainsAny(arg[1:len(arg)-1], "<>"):
+		return arg
+	case runtime.GOOS == "windows" && shellSafeRe.MatchString(strings.Replace(arg, "\\", "/", -1)):
+		return arg
+	case runtime.GOOS == "windows":
+		return "\"" + strings.Replace(arg, "\"", "\\\"", -1) + "\""
+	case shellSafeRe.MatchString(arg):
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", "'\\''", -1) + "'"
+}
+
+// DefaultVMName function derives a name of an imported VM from a user's choice, e.g. 'MSEdge-Win10-VBox'.
+// If UniqueRun is set every call returns a new name, so concurrent runs of the same VM import their own VMs.
+func DefaultVMName(uc UserChoice) string {
+	hypervisor := uc.Hypervisor
+	if hypervisor == "VirtualBox" {
+		hypervisor = "VBox"
+	}
+	name := strings.Join(append(strings.Fields(uc.BrowserOs), hypervisor), "-")
+	if UniqueRun {
+		name += uniqueSuffix()
+	}
+	return name
+}
+
+// parallelsRegisteredName function returns a name which Parallels gives to a registered VM, it is the name of
+// .pvm bundle which contains config.pvs file.
+func parallelsRegisteredName(pvsPath string) string {
+	return strings.TrimSuffix(vmName(path.Dir(strings.Replace(pvsPath, "\\", "/", -1))), ".pvm")
+}
+
+// vmName function returns the VM file name without extension.
+func vmName(vmPath string) string {
+	// NOTE: Windows paths are normalized so path.Base works on all platforms.
+	name := path.Base(strings.Replace(vmPath, "\\", "/", -1))
+	return strings.TrimSuffix(name, path.Ext(name))
+}
+
+// virtualBoxVMs function lists names of VMs registered in VirtualBox.
+func virtualBoxVMs() ([]string, error) {
+	// NOTE: vboxmanage lists VMs as "name" {uuid} lines.
+	result, err := execCommand(vboxManageCmd, "list", "vms").Output()
 	if err != nil {
-		fmt.Println(string(result), err)
-		return err
+		return nil, err
 	}
-	fmt.Println(string(result))
-	return nil
+	var names []string
+	for _, line := range strings.Split(string(result), "\n") {
+		if parts := strings.Split(line, "\""); len(parts) >= 3 {
+			names = append(names, parts[1])
+		}
+	}
+	return names, nil
 }
 
-func importParallelsVM(vmPath string) error {
-	fmt.Println("Import VM into Parallels. Please wait.")
-	cmdName := "prlctl"
-	cmdArgs := []string{"register", vmPath}
-	result, err := exec.Command(cmdName, cmdArgs...).CombinedOutput()
+// hypervVMs function lists names of Hyper-V VMs.
+func hypervVMs() ([]string, error) {
+	result, err := execCommand("powershell", "-Command", "Get-VM", "|", "Select-Object", "-ExpandProperty", "Name").Output()
 	if err != nil {
-		fmt.Println(string(result), err)
-		return err
+		return nil, err
 	}
-	fmt.Println(string(result))
-	return nil
+	return strings.Split(strings.Replace(string(result), "\r", "", -1), "\n"), nil
+}
+
+// parallelsVMs function lists names of Parallels VMs.
+func parallelsVMs() ([]string, error) {
+	result, err := execCommand("prlctl", "list", "--all", "--no-header", "-o", "name").Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(result), "\n"), nil
+}
+
+// qemuVMs function lists names of libvirt domains.
+func qemuVMs() ([]string, error) {
+	result, err := execCommand("virsh", "list", "--all", "--name").Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(result), "\n"), nil
+}
+
+// errAlreadyImported error means that import was skipped because a VM with the same name exists.
+var errAlreadyImported = errors.New("VM is already imported")
+
+// alreadyImported function checks if a VM with a given name is already present in a hypervisor.
+// If the list of VMs can't be obtained the VM is considered not imported.
+func alreadyImported(hypervisor, name string, listVMs func() ([]string, error)) bool {
+	names, err := listVMs()
+	if err != nil {
+		Log.Warnf("Can't list %s VMs: %s", hypervisor, err)
+		return false
+	}
+	for _, existing := range names {
+		if strings.TrimSpace(existing) == name {
+			Log.Warnf("VM %s is already imported into %s. Import skipped.", name, hypervisor)
+			return true
+		}
+	}
+	return false
+}
+
+// hypervisorChecks var maps hypervisors to functions which check that their tools are installed and return
+// detected versions.
+var hypervisorChecks = map[string]func(logger *Logger) (string, error){
+	"VirtualBox": checkVirtualBox,
+	"VMware":     checkVmware,
+	"HyperV":     checkHyperv,
+	"Parallels":  checkParallels,
+	"QEMU":       checkQemu,
+	"Proxmox":    checkProxmox,
+	"Vagrant":    checkVagrant,
+	"Xen":        checkXen,
+	// WindowsSandbox isn't a hypervisor of VM images, see importSandboxVM.
+	"WindowsSandbox": checkWindowsSandbox,
+}
+
+// HypervisorStatus type defines if tools of a hypervisor are installed.
+type HypervisorStatus struct {
+	Hypervisor string
+	Version    string
+	Err        error
+}
+
+// CheckHypervisors function runs installation checks of all supported hypervisors. Messages of the checks are
+// hidden, so only the returned statuses are shown.
+func CheckHypervisors() []HypervisorStatus {
+	var names []string
+	for name := range hypervisorChecks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var statuses []HypervisorStatus
+	for _, name := range names {
+		// NOTE: missing hypervisors are expected here, so even errors of the checks aren't shown.
+		version, err := hypervisorChecks[name](quietLog)
+		statuses = append(statuses, HypervisorStatus{Hypervisor: name, Version: version, Err: err})
+	}
+	return statuses
+}
+
+// ShowHypervisors function shows a table of supported hypervisors with their detected versions.
+func ShowHypervisors(statuses []HypervisorStatus, dst io.Writer) {
+	writer := tabwriter.NewWriter(dst, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "HYPERVISOR\tSTATUS\tVERSION")
+	for _, status := range statuses {
+		if status.Err != nil {
+			fmt.Fprintf(writer, "%s\tnot found\t-\n", status.Hypervisor)
+		} else {
+			fmt.Fprintf(writer, "%s\tavailable\t%s\n", status.Hypervisor, status.Version)
+		}
+	}
+	writer.Flush()
+}
+
+// InstallVM function installs unpacked VM into a selected hypervisor under a given name.
+// An error is returned if the hypervisor isn't available or the import failed. Imported VMs are recorded, so expired
+// ones could be removed by CleanupExpired.
+func InstallVM(hypervisor, vmPath, name string) error {
+	_, err := installVM(context.Background(), hypervisor, vmPath, name)
+	return err
+}
+
+// installVM function installs unpacked VM like InstallVM does and returns false if a VM with the same name was
+// already installed, so the import was skipped. Waiting for another import stops when ctx is cancelled.
+func installVM(ctx context.Context, hypervisor, vmPath, name string) (bool, error) {
+	// NOTE: some hypervisors misbehave if several imports run at the same time so imports are serialized.
+	unlock, err := lockHypervisor(ctx, hypervisor)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	if err := verifyVMFiles(vmPath); err != nil {
+		return false, err
+	}
+	if VMGroup != "" && hypervisor != "VirtualBox" {
+		Log.Warnf("%s doesn't support VM groups, VM isn't added to group %s.", hypervisor, VMGroup)
+	}
+	if needsConversion(hypervisor, vmPath) {
+		// NOTE: a VM created for a converted disk is identified by its own path, e.g. .vmx file for VMware.
+		vmPath, err = importConvertedVM(hypervisor, vmPath, name)
+	} else {
+		err = importVM(hypervisor, vmPath, name)
+	}
+	imported := err != errAlreadyImported
+	if imported && err != nil {
+		return false, err
+	}
+	vmID, err := verifyImported(hypervisor, vmPath, name)
+	if err != nil {
+		return false, fmt.Errorf("import finished but VM '%s' isn't found in %s: %s", name, hypervisor, err)
+	}
+	if err := setVMResources(hypervisor, name, vmID); err != nil {
+		Log.Warnf("Can't set CPUs and memory of VM '%s': %s", name, err)
+	}
+	if !imported {
+		// NOTE: the existing VM isn't recorded, so its expiry isn't reset and a VM imported by other tools
+		// isn't removed by CleanupExpired.
+		Log.Successf("VM '%s' is already installed into %s, ID %s.", name, hypervisor, vmID)
+		return false, nil
+	}
+	recordImport(hypervisor, vmPath, name)
+	Log.Successf("VM '%s' is installed into %s, ID %s.", name, hypervisor, vmID)
+	return true, nil
 }
 
-// InstallVM function installs unpacked VM into a selected hypervisor.
-func InstallVM(hypervisor string, vmPath string) {
+// importVM function imports a VM into a given hypervisor unless a VM with the same name exists, errAlreadyImported
+// is returned then.
+func importVM(hypervisor, vmPath, name string) error {
 	switch hypervisor {
 	case "VirtualBox":
-		if err := checkVirtualBox(); err == nil {
-			importVirtualBoxVM(vmPath)
+		if _, err := checkVirtualBox(Log); err != nil {
+			return err
+		}
+		if alreadyImported(hypervisor, name, virtualBoxVMs) {
+			return errAlreadyImported
 		}
+		return importVirtualBoxVM(vmPath, name)
 	case "VMware":
-		if err := checkVmware(); err == nil {
-			if vmxPath, err := convertVmware(vmPath); err == nil {
-				fixVmwareNetwork(vmxPath)
-				importVmwareVM(vmxPath)
-			}
+		if _, err := checkVmware(Log); err != nil {
+			return err
+		}
+		vmxPath, err := convertVmware(vmPath, name)
+		if err != nil {
+			return err
 		}
+		fixVmwareNetwork(vmxPath)
+		return importVmwareVM(vmxPath)
 	case "HyperV":
-		if err := checkHyperv(); err == nil {
-			importHypervVM(vmPath)
+		if _, err := checkHyperv(Log); err != nil {
+			return err
+		}
+		if alreadyImported(hypervisor, name, hypervVMs) {
+			return errAlreadyImported
 		}
+		return importHypervVM(vmPath, name)
 	case "Parallels":
-		fmt.Println(vmPath)
-		if err := checkParallels(); err == nil {
-			importParallelsVM(vmPath)
+		Log.Info(vmPath)
+		if _, err := checkParallels(Log); err != nil {
+			return err
+		}
+		if alreadyImported(hypervisor, name, parallelsVMs) {
+			return errAlreadyImported
+		}
+		return importParallelsVM(vmPath, name)
+	case "QEMU":
+		if _, err := checkQemu(Log); err != nil {
+			return err
+		}
+		if alreadyImported(hypervisor, name, qemuVMs) {
+			return errAlreadyImported
+		}
+		return importQemuVM(vmPath, name)
+	case "Proxmox":
+		if _, err := checkProxmox(Log); err != nil {
+			return err
+		}
+		if alreadyImported(hypervisor, slugName(name), proxmoxVMs) {
+			return errAlreadyImported
+		}
+		return importProxmoxVM(vmPath, name)
+	case "Vagrant":
+		if _, err := checkVagrant(Log); err != nil {
+			return err
+		}
+		if alreadyImported(hypervisor, vagrantBoxName(name), vagrantBoxes) {
+			return errAlreadyImported
+		}
+		return importVagrantBox(vmPath, name)
+	case "Xen":
+		if _, err := checkXen(Log); err != nil {
+			return err
+		}
+		if alreadyImported(hypervisor, slugName(name), xenVMs) {
+			return errAlreadyImported
+		}
+		return importXenVM(vmPath, name)
+	case "WindowsSandbox":
+		if _, err := checkWindowsSandbox(Log); err != nil {
+			return err
 		}
+		return importSandboxVM(vmPath, name)
 	default:
-		fmt.Printf("Hypervisor %s isn't supported.\n", hypervisor)
+		return fmt.Errorf("Hypervisor %s isn't supported", hypervisor)
 	}
 }
@@ -0,0 +1,514 @@
+package utils
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestZip function writes a zip archive with given files into a folder and returns a choice which points to it.
+func writeTestZip(t *testing.T, folder, name string, files map[string]string) UserChoice {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(folder, name), newTestZip(t, files), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return UserChoice{
+		Spec:         Spec{Platform: "Linux", Hypervisor: "VirtualBox", BrowserOs: "IE11 Win7"},
+		VMImage:      VMImage{FileURL: "https://example.com/" + name},
+		DownloadPath: folder,
+	}
+}
+
+func TestUnzipArchiveRejectsZipSlip(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry string
+	}{
+		{"parent folder", "../evil.txt"},
+		{"nested parent folder", "IE11/../../evil.txt"},
+		{"backslashes", `..\evil.txt`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			downloadPath := filepath.Join(root, "downloads")
+			if err := os.Mkdir(downloadPath, 0755); err != nil {
+				t.Fatal(err)
+			}
+			uc := writeTestZip(t, downloadPath, "IE11.zip", map[string]string{
+				"IE11/IE11.ova": "ova",
+				test.entry:      "evil",
+			})
+			_, err := UnzipVM(uc)
+			if filepath.Separator == '/' && strings.Contains(test.entry, `\`) {
+				// NOTE: backslash is a regular file name character on Unix, so the entry stays inside.
+				if err != nil {
+					t.Fatalf("UnzipVM: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "points outside") {
+				t.Fatalf("error = %v, want entry rejected", err)
+			}
+			for _, evilPath := range []string{filepath.Join(root, "evil.txt"), filepath.Join(downloadPath, "evil.txt")} {
+				if _, err := os.Stat(evilPath); !os.IsNotExist(err) {
+					t.Errorf("%s is written outside of the unzip folder", evilPath)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(downloadPath, "IE11", "IE11", "IE11.ova")); !os.IsNotExist(err) {
+				t.Error("entries of a rejected archive are unpacked")
+			}
+		})
+	}
+}
+
+func TestSafeJoin(t *testing.T) {
+	folder := filepath.Join("downloads", "IE11")
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"IE11.ova", filepath.Join(folder, "IE11.ova"), false},
+		{"disks/disk1.vmdk", filepath.Join(folder, "disks", "disk1.vmdk"), false},
+		{"./IE11.ova", filepath.Join(folder, "IE11.ova"), false},
+		{"disks/../IE11.ova", filepath.Join(folder, "IE11.ova"), false},
+		{"../IE11.ova", "", true},
+		{"disks/../../IE11.ova", "", true},
+		{"../IE11-other/IE11.ova", "", true},
+	}
+	for _, test := range tests {
+		got, err := safeJoin(folder, test.name)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("safeJoin(%q) = %q, %v, want %q, error %t", test.name, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestDownloadPartsRejoinsChangedArchive(t *testing.T) {
+	parts := map[string]string{"/IE11.zip.001": "first part ", "/IE11.zip.002": "second part"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := parts[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, path.Base(r.URL.Path), time.Time{}, strings.NewReader(content))
+	}))
+	defer server.Close()
+	var files []VMImage
+	for _, name := range []string{"/IE11.zip.001", "/IE11.zip.002"} {
+		files = append(files, VMImage{FileURL: server.URL + name, Md5: fmt.Sprintf("%X", md5.Sum([]byte(parts[name])))})
+	}
+	uc := UserChoice{
+		Spec:         Spec{Platform: "Linux", Hypervisor: "VirtualBox", BrowserOs: "IE11 Win7"},
+		VMImage:      joinParts(files),
+		DownloadPath: t.TempDir(),
+	}
+	want := parts["/IE11.zip.001"] + parts["/IE11.zip.002"]
+
+	vmFile, err := DownloadVM(context.Background(), uc, DownloadOptions{})
+	if err != nil {
+		t.Fatalf("DownloadVM: %s", err)
+	}
+	if content, err := ioutil.ReadFile(vmFile); err != nil || string(content) != want {
+		t.Fatalf("joined archive is %q, %v, want %q", content, err, want)
+	}
+
+	// An archive of the same size which wasn't joined from these parts is joined again.
+	if err := ioutil.WriteFile(vmFile, []byte(strings.Repeat("x", len(want))), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DownloadVM(context.Background(), uc, DownloadOptions{}); err != nil {
+		t.Fatalf("DownloadVM: %s", err)
+	}
+	if content, err := ioutil.ReadFile(vmFile); err != nil || string(content) != want {
+		t.Errorf("changed archive isn't joined again, got %q, %v", content, err)
+	}
+}
+
+func TestFixVmwareNetworkKeepsLineEndings(t *testing.T) {
+	osEOL := "\n"
+	if runtime.GOOS == "windows" {
+		osEOL = "\r\n"
+	}
+	tests := []struct {
+		name    string
+		content string
+		eol     string
+	}{
+		{"unix", ".encoding = \"UTF-8\"\nconfig.version = \"8\"\n", "\n"},
+		{"windows", ".encoding = \"UTF-8\"\r\nconfig.version = \"8\"\r\n", "\r\n"},
+		{"no line endings", ".encoding = \"UTF-8\"", osEOL},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vmxPath := filepath.Join(t.TempDir(), "IE11.vmx")
+			if err := ioutil.WriteFile(vmxPath, []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			fixVmwareNetwork(vmxPath)
+			content, err := ioutil.ReadFile(vmxPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			added := strings.TrimPrefix(string(content), test.content)
+			want := "ethernet0.present = \"TRUE\"" + test.eol + "ethernet0.connectionType = \"nat\"" + test.eol +
+				"ethernet0.wakeOnPcktRcv = \"FALSE\"" + test.eol + "ethernet0.addressType = \"generated\"" + test.eol
+			if added != want {
+				t.Errorf("added lines are %q, want %q", added, want)
+			}
+		})
+	}
+}
+
+func BenchmarkDownloadVMBufferSize(b *testing.B) {
+	content := strings.Repeat("getIE", 16*1024*1024/5)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/IE11.zip", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "IE11.zip", time.Time{}, strings.NewReader(content))
+	})
+	mux.HandleFunc("/IE11.zip.md5.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%X", md5.Sum([]byte(content)))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	defer func(size int) { CopyBufferSize = size }(CopyBufferSize)
+
+	for _, size := range []int{32 * 1024, 256 * 1024, 1024 * 1024, 4 * 1024 * 1024} {
+		b.Run(fmt.Sprintf("%dKB", size/1024), func(b *testing.B) {
+			CopyBufferSize = size
+			b.SetBytes(int64(len(content)))
+			for i := 0; i < b.N; i++ {
+				if _, err := DownloadVM(context.Background(), UserChoice{
+					VMImage:      VMImage{FileURL: server.URL + "/IE11.zip", Md5URL: server.URL + "/IE11.zip.md5.txt"},
+					DownloadPath: b.TempDir(),
+				}, DownloadOptions{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamVM(t *testing.T) {
+	const content = "VM archive data"
+	sum := fmt.Sprintf("%X", md5.Sum([]byte(content)))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/IE11.zip", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "IE11.zip", time.Time{}, strings.NewReader(content))
+	})
+	mux.HandleFunc("/IE11.zip.md5.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, sum)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		vm   VMImage
+	}{
+		{"inline sum", VMImage{FileURL: server.URL + "/IE11.zip", Md5: sum}},
+		{"remote sum", VMImage{FileURL: server.URL + "/IE11.zip", Md5URL: server.URL + "/IE11.zip.md5.txt"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var piped strings.Builder
+			if err := StreamVM(context.Background(), UserChoice{VMImage: test.vm}, &piped); err != nil {
+				t.Fatal(err)
+			}
+			if piped.String() != content {
+				t.Errorf("piped data is %q, want %q", piped.String(), content)
+			}
+			if got := fmt.Sprintf("%X", md5.Sum([]byte(piped.String()))); got != sum {
+				t.Errorf("piped data sum is %s, want %s", got, sum)
+			}
+		})
+	}
+
+	mismatch := UserChoice{VMImage: VMImage{FileURL: server.URL + "/IE11.zip", Md5: strings.Repeat("0", 32)}}
+	if err := StreamVM(context.Background(), mismatch, ioutil.Discard); err == nil {
+		t.Error("streamed data with mismatched sum was accepted")
+	}
+}
+
+func TestUnzipVMUniqueRunConcurrently(t *testing.T) {
+	UniqueRun = true
+	defer func() { UniqueRun = false }()
+	uc := writeTestZip(t, t.TempDir(), "IE11.zip", map[string]string{"IE11.ova": "ova"})
+
+	const runs = 2
+	vmPaths := make(chan string, runs)
+	errs := make(chan error, runs)
+	for i := 0; i < runs; i++ {
+		go func() {
+			vmPath, err := UnzipVM(uc)
+			vmPaths <- vmPath
+			errs <- err
+		}()
+	}
+	folders := map[string]bool{}
+	for i := 0; i < runs; i++ {
+		vmPath := <-vmPaths
+		if err := <-errs; err != nil {
+			t.Fatalf("UnzipVM: %s", err)
+		}
+		if content, err := ioutil.ReadFile(vmPath); err != nil || string(content) != "ova" {
+			t.Errorf("%s is %q, %v, want unpacked VM", vmPath, content, err)
+		}
+		folder := filepath.Dir(vmPath)
+		if !strings.HasPrefix(filepath.Base(folder), "IE11-") {
+			t.Errorf("unzip folder %s has no per-run suffix", folder)
+		}
+		folders[folder] = true
+	}
+	if len(folders) != runs {
+		t.Errorf("concurrent runs share unzip folders %v", folders)
+	}
+}
+
+func TestUnzipVMOverLeftoverFile(t *testing.T) {
+	ova := strings.Repeat("ova data ", 100)
+	tests := []struct {
+		name     string
+		leftover string
+	}{
+		{"truncated", ova[:len(ova)/2]},
+		{"corrupt of the same size", strings.Repeat("x", len(ova))},
+		{"longer", ova + "stale bytes"},
+		{"empty", ""},
+		{"complete", ova},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			downloadPath := t.TempDir()
+			uc := writeTestZip(t, downloadPath, "IE11.zip", map[string]string{"IE11/IE11.ova": ova})
+			vmPath := filepath.Join(downloadPath, "IE11", "IE11", "IE11.ova")
+			if err := os.MkdirAll(filepath.Dir(vmPath), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(vmPath, []byte(test.leftover), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := UnzipVM(uc)
+			if err != nil {
+				t.Fatalf("UnzipVM: %s", err)
+			}
+			if got != vmPath {
+				t.Errorf("VM path = %s, want %s", got, vmPath)
+			}
+			if content, err := ioutil.ReadFile(vmPath); err != nil || string(content) != ova {
+				t.Errorf("unpacked file doesn't match the archive entry: %d bytes, %v", len(content), err)
+			}
+		})
+	}
+}
+
+func TestUnzipVMRestoresAttributes(t *testing.T) {
+	modified := time.Date(2019, 3, 14, 15, 9, 26, 0, time.UTC)
+	tests := []struct {
+		name     string
+		mode     os.FileMode
+		wantMode os.FileMode
+	}{
+		{"IE11/", os.ModeDir | 0750, os.ModeDir | 0750},
+		{"IE11/IE11.ova", 0644, 0644},
+		{"IE11/run.sh", 0755, 0755},
+		{"IE11/readonly.txt", 0444, 0644},
+	}
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	for idx, test := range tests {
+		header := &zip.FileHeader{Name: test.name, Method: zip.Deflate, Modified: modified.Add(time.Duration(idx) * time.Hour)}
+		header.SetMode(test.mode)
+		entry, err := writer.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !test.mode.IsDir() {
+			fmt.Fprint(entry, test.name)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	downloadPath := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(downloadPath, "IE11.zip"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	uc := UserChoice{
+		Spec:         Spec{Platform: "Linux", Hypervisor: "VirtualBox", BrowserOs: "IE11 Win7"},
+		VMImage:      VMImage{FileURL: "https://example.com/IE11.zip"},
+		DownloadPath: downloadPath,
+	}
+
+	if _, err := UnzipVM(uc); err != nil {
+		t.Fatalf("UnzipVM: %s", err)
+	}
+	for idx, test := range tests {
+		info, err := os.Stat(filepath.Join(downloadPath, "IE11", filepath.FromSlash(test.name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := modified.Add(time.Duration(idx) * time.Hour); !info.ModTime().Equal(want) {
+			t.Errorf("%s modification time is %s, want %s", test.name, info.ModTime(), want)
+		}
+		// NOTE: Windows keeps only the read-only attribute, so permissions aren't compared there.
+		if runtime.GOOS != "windows" && info.Mode() != test.wantMode {
+			t.Errorf("%s mode is %s, want %s", test.name, info.Mode(), test.wantMode)
+		}
+	}
+}
+
+func TestDownloadArchiveResumesChecksum(t *testing.T) {
+	content := strings.Repeat("0123456789abcdef", 64*1024)
+	var ranged int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/no-ranges.zip" {
+			fmt.Fprint(w, content)
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			ranged++
+		}
+		http.ServeContent(w, r, "IE11.zip", time.Time{}, strings.NewReader(content))
+	}))
+	defer server.Close()
+	fullSum, _, err := downloadFile(context.Background(), server.URL+"/IE11.zip", ioutil.Discard, "md5", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		fileURL    string
+		partial    int
+		wantRanged int
+	}{
+		{"half", server.URL + "/IE11.zip", len(content) / 2, 1},
+		{"first byte", server.URL + "/IE11.zip", 1, 1},
+		{"all but last byte", server.URL + "/IE11.zip", len(content) - 1, 1},
+		{"nothing", server.URL + "/IE11.zip", 0, 0},
+		{"no range support", server.URL + "/no-ranges.zip", len(content) / 2, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ranged = 0
+			vmFile := filepath.Join(t.TempDir(), "IE11.zip")
+			// An interrupted download leaves the partial file with a prefix of the archive.
+			if err := ioutil.WriteFile(partialFilePath(vmFile), []byte(content[:test.partial]), 0644); err != nil {
+				t.Fatal(err)
+			}
+			vmSum, err := downloadArchive(context.Background(), test.fileURL, vmFile, "md5", nil)
+			if err != nil {
+				t.Fatalf("downloadArchive: %s", err)
+			}
+			if vmSum != fullSum {
+				t.Errorf("checksum %s differs from a single download checksum %s", vmSum, fullSum)
+			}
+			if written, err := ioutil.ReadFile(partialFilePath(vmFile)); err != nil || string(written) != content {
+				t.Errorf("partial file has %d bytes, %v, want the whole archive", len(written), err)
+			}
+			if ranged != test.wantRanged {
+				t.Errorf("%d range requests, want %d", ranged, test.wantRanged)
+			}
+		})
+	}
+}
+
+func TestPathJoin(t *testing.T) {
+	tests := []struct {
+		windows bool
+		path1   string
+		path2   string
+		want    string
+	}{
+		{true, `\\server\share`, "IE11.zip", `\\server\share\IE11.zip`},
+		{true, `\\server\share\VMs\`, "IE11/IE11.ova", `\\server\share\VMs\IE11\IE11.ova`},
+		{true, `C:\Users\Bob\Downloads`, "IE11.zip", `C:\Users\Bob\Downloads\IE11.zip`},
+		{true, `C:/Users/Bob/Downloads`, `IE11\IE11.ova`, `C:\Users\Bob\Downloads\IE11\IE11.ova`},
+		{true, `C:\Users\Bob\Downloads\`, `..\IE11.zip`, `C:\Users\Bob\IE11.zip`},
+		{false, "/home/bob/Downloads", "IE11.zip", "/home/bob/Downloads/IE11.zip"},
+		{false, "/home/bob/Downloads/", "IE11/IE11.ova", "/home/bob/Downloads/IE11/IE11.ova"},
+		{false, "//server/share", "IE11.zip", "/server/share/IE11.zip"},
+		// NOTE: backslash is a regular file name character on Unix.
+		{false, "/home/bob", `IE11\IE11.ova`, `/home/bob/IE11\IE11.ova`},
+	}
+	for _, test := range tests {
+		if test.windows != (runtime.GOOS == "windows") {
+			continue
+		}
+		if got := pathJoin(test.path1, test.path2); got != test.want {
+			t.Errorf("pathJoin(%q, %q) = %q, want %q", test.path1, test.path2, got, test.want)
+		}
+	}
+}
+
+func TestExtractOvaDiskRemovesPartialDisk(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	disk := strings.Repeat("disk", 1024)
+	if err := tw.WriteHeader(&tar.Header{Name: "IE11 - Win7-disk1.vmdk", Mode: 0644, Size: int64(len(disk))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(disk)); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	folder := t.TempDir()
+	ovaPath := filepath.Join(folder, "IE11 - Win7.ova")
+	// NOTE: the archive is cut in the middle of the disk.
+	if err := ioutil.WriteFile(ovaPath, buf.Bytes()[:512+len(disk)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := extractOvaDisk(ovaPath); err == nil {
+		t.Fatal("disk was extracted from a truncated .ova file")
+	}
+	if _, err := os.Stat(filepath.Join(folder, "IE11 - Win7-disk1.vmdk")); !os.IsNotExist(err) {
+		t.Errorf("partial disk is left: %v", err)
+	}
+}
+
+func TestProgressCallbacksWithoutLock(t *testing.T) {
+	var pw *ProgressWrapper
+	var finishedBytes int64
+	pw = &ProgressWrapper{
+		Reader: strings.NewReader("ova data"),
+		size:   8,
+		step:   1,
+		// NOTE: callbacks read statistics, it would deadlock if they were called under the mutex.
+		callback: func(downloaded, total int64) { pw.Stats() },
+		finished: func(stats DownloadStats) { finishedBytes = pw.Stats().Bytes },
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := ioutil.ReadAll(pw)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("progress callbacks are blocked by the mutex")
+	}
+	if finishedBytes != 8 {
+		t.Errorf("finished callback got %d bytes, want 8", finishedBytes)
+	}
+}
@@ -0,0 +1,137 @@
+// Package utils contains various supplementary functions and data structures.
+// This file xen.go contains functions to import VMs into Xen with xl toolstack.
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// XenConfigPath var defines a folder where xl domain configs of imported VMs are written.
+var XenConfigPath = "/etc/xen"
+
+// xenVersionRe matches Xen version line of 'xl info' output.
+var xenVersionRe = regexp.MustCompile(`(?m)^xen_version\s*:\s*(\S+)`)
+
+// xenDiskRe matches a disk target of xl domain config written by importXenVM.
+var xenDiskRe = regexp.MustCompile(`target=([^"]+)"`)
+
+func checkXen(logger *Logger) (string, error) {
+	// NOTE: xl talks to the hypervisor, so it works only in dom0 with Xen running. qemu-img converts disks.
+	logger.Info("Checking Xen installation.")
+	cmdName := "xl"
+	cmdArgs := []string{"info"}
+	result, err := execCommand(cmdName, cmdArgs...).CombinedOutput()
+	if err != nil {
+		logger.Error(string(result), err)
+		return "", err
+	}
+	match := xenVersionRe.FindStringSubmatch(string(result))
+	if match == nil {
+		err := fmt.Errorf("Xen version isn't found in 'xl info' output")
+		logger.Error(err)
+		return "", err
+	}
+	version := "Xen " + match[1]
+	logger.Info("Detected", version)
+
+	result, err = execCommand("qemu-img", "--version").CombinedOutput()
+	if err != nil {
+		logger.Error(string(result), err)
+		return "", err
+	}
+	return version, nil
+}
+
+// xenConfigFile function returns a path to xl domain config of a given VM.
+func xenConfigFile(name string) string {
+	return pathJoin(XenConfigPath, slugName(name)+".cfg")
+}
+
+// xenVMs function lists names of VMs which have xl domain configs written by importXenVM.
+// NOTE: xl doesn't keep stopped domains, so a domain config is the VM.
+func xenVMs() ([]string, error) {
+	files, err := ioutil.ReadDir(XenConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".cfg") {
+			names = append(names, strings.TrimSuffix(file.Name(), ".cfg"))
+		}
+	}
+	return names, nil
+}
+
+// xenConfig function returns xl domain config of a HVM guest which boots from a given qcow2 disk.
+func xenConfig(name, qcowPath string) string {
+	cpus, memory := 2, 2048
+	if VMCPUs > 0 {
+		cpus = VMCPUs
+	}
+	if VMMemory > 0 {
+		memory = VMMemory
+	}
+	lines := []string{
+		fmt.Sprintf("name = \"%s\"", slugName(name)),
+		"type = \"hvm\"",
+		fmt.Sprintf("vcpus = %d", cpus),
+		fmt.Sprintf("memory = %d", memory),
+		fmt.Sprintf("disk = [ \"format=qcow2,vdev=hda,access=rw,target=%s\" ]", qcowPath),
+		"vif = [ \"model=e1000\" ]",
+		"vnc = 1",
+		"usb = 1",
+		"usbdevice = \"tablet\"",
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func importXenVM(vmPath, name string) error {
+	diskPath := vmPath
+	if strings.HasSuffix(vmPath, ".ova") {
+		var err error
+		if diskPath, err = extractOvaDisk(vmPath); err != nil {
+			Log.Error(err)
+			return err
+		}
+	}
+
+	// NOTE: Xen device model could read .vmdk disks, but qcow2 disks are faster and support snapshots.
+	qcowPath := qcowDiskPath(diskPath)
+	if err := convertToQcow(diskPath, qcowPath); err != nil {
+		return err
+	}
+
+	configPath := xenConfigFile(name)
+	Log.Infof("Write Xen domain config %s.", configPath)
+	if err := ioutil.WriteFile(configPath, []byte(xenConfig(name, qcowPath)), 0644); err != nil {
+		Log.Error(err)
+		return err
+	}
+	Log.Infof("VM %s is created, start it with 'xl create %s'.", slugName(name), configPath)
+	return nil
+}
+
+// removeXenVM function stops a Xen domain if it runs and deletes its config and disk.
+func removeXenVM(name string) error {
+	configPath := xenConfigFile(name)
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	// NOTE: the domain is usually stopped, so xl fails to destroy it and the error is ignored.
+	execCommand("xl", "destroy", slugName(name)).Run()
+	if err := os.Remove(configPath); err != nil {
+		return err
+	}
+	for _, match := range xenDiskRe.FindAllStringSubmatch(string(content), -1) {
+		if err := os.Remove(match[1]); err != nil && !os.IsNotExist(err) {
+			Log.Warnf("Can't delete disk %s of VM '%s': %s", match[1], name, err)
+		}
+	}
+	return nil
+}